@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"code.nkcmr.net/opt"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+type configAlerts struct {
+	// Interval is how often every device is checked, reports are also checked
+	// as they come in.
+	Interval time.Duration `envDefault:"5m"`
+
+	// StaleAfter alerts when a device has not reported for this long, 0
+	// disables the rule.
+	StaleAfter time.Duration
+	// LowBattery alerts when a device reports a battery level below this
+	// percentage, 0 disables the rule.
+	LowBattery int
+	// UnpluggedBelow alerts when a device reports that it is unplugged while
+	// its battery level is below this percentage, 0 disables the rule.
+	UnpluggedBelow int
+
+	// WebhookURL is sent a JSON POST for each alert that fires or resolves.
+	WebhookURL string
+	SMTP       configSMTP `envPrefix:"SMTP_"`
+}
+
+type configSMTP struct {
+	// Addr is the host:port of the mail server, alerts are not mailed when
+	// it is empty.
+	Addr     string
+	Username string
+	Password string
+	From     string
+	To       []string `envSeparator:","`
+}
+
+func (cfg configAlerts) enabled() bool {
+	return cfg.Interval > 0 && (cfg.StaleAfter > 0 || cfg.LowBattery > 0 || cfg.UnpluggedBelow > 0)
+}
+
+const (
+	alertStale      = "stale"
+	alertLowBattery = "low_battery"
+	alertUnplugged  = "unplugged"
+)
+
+// batteryUnplugged is the OwnTracks battery status (bs) of a device that is
+// not charging.
+const batteryUnplugged = 1
+
+type alert struct {
+	ID         int64  `json:"id"`
+	User       string `json:"user"`
+	Device     string `json:"device"`
+	Rule       string `json:"rule"`
+	State      string `json:"state"`
+	Message    string `json:"message"`
+	FiredAt    int64  `json:"fired_at"`
+	ResolvedAt *int64 `json:"resolved_at"`
+}
+
+// deviceStatus is what the alert rules know about a device, taken from its
+// newest report.
+type deviceStatus struct {
+	user, device string
+	tst          int64
+	batt, bs     opt.Option[int]
+}
+
+func deviceStatusOf(loc otLocation) opt.Option[deviceStatus] {
+	user, uok := readString(loc, "username").MaybeUnwrap()
+	device, dok := readString(loc, "device").MaybeUnwrap()
+	tst, tok := readInt(loc, "tst").MaybeUnwrap()
+	if !uok || !dok || !tok {
+		return opt.None[deviceStatus]()
+	}
+	return opt.Some(deviceStatus{
+		user:   user,
+		device: device,
+		tst:    int64(tst),
+		batt:   readInt(loc, "batt"),
+		bs:     readInt(loc, "bs"),
+	})
+}
+
+// ruleResult is the outcome of checking a rule against a device, rules that
+// cannot be checked, like battery rules without a batt value, have no result.
+type ruleResult struct {
+	rule    string
+	firing  bool
+	message string
+}
+
+func checkAlertRules(cfg configAlerts, s deviceStatus, now time.Time) []ruleResult {
+	var results []ruleResult
+	if cfg.StaleAfter > 0 {
+		age := now.Sub(time.Unix(s.tst, 0))
+		r := ruleResult{
+			rule:    alertStale,
+			firing:  age > cfg.StaleAfter,
+			message: fmt.Sprintf("%s has not reported for %s", s.device, age.Round(time.Minute)),
+		}
+		if !r.firing {
+			r.message = fmt.Sprintf("%s is reporting again", s.device)
+		}
+		results = append(results, r)
+	}
+	batt, ok := s.batt.MaybeUnwrap()
+	if !ok {
+		return results
+	}
+	if cfg.LowBattery > 0 {
+		results = append(results, ruleResult{
+			rule:    alertLowBattery,
+			firing:  batt < cfg.LowBattery,
+			message: fmt.Sprintf("%s battery is at %d%%", s.device, batt),
+		})
+	}
+	if bs, ok := s.bs.MaybeUnwrap(); ok && cfg.UnpluggedBelow > 0 {
+		r := ruleResult{
+			rule:    alertUnplugged,
+			firing:  bs == batteryUnplugged && batt < cfg.UnpluggedBelow,
+			message: fmt.Sprintf("%s is unplugged with its battery at %d%%", s.device, batt),
+		}
+		if bs != batteryUnplugged {
+			r.message = fmt.Sprintf("%s is plugged in with its battery at %d%%", s.device, batt)
+		} else if !r.firing {
+			r.message = fmt.Sprintf("%s battery is at %d%%", s.device, batt)
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// applyRuleResults moves the device's alerts to the state its rule results
+// call for, and returns the alerts that fired or resolved. An alert that is
+// already firing is not fired again.
+func applyRuleResults(conn *sqlite.Conn, s deviceStatus, results []ruleResult, now time.Time) (_ []alert, err error) {
+	release, err := saveWrite(conn)
+	if err != nil {
+		return nil, err
+	}
+	defer release(&err)
+	var changed []alert
+	for _, r := range results {
+		var firing opt.Option[alert]
+		if err := sqlitex.Execute(conn, `
+			SELECT id, message, fired_at
+			FROM alerts
+			WHERE user = ?1 AND device = ?2 AND rule = ?3 AND state = 'firing'
+		`, &sqlitex.ExecOptions{
+			Args: []any{s.user, s.device, r.rule},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				firing = opt.Some(alert{
+					ID:      stmt.ColumnInt64(0),
+					User:    s.user,
+					Device:  s.device,
+					Rule:    r.rule,
+					Message: stmt.ColumnText(1),
+					FiredAt: stmt.ColumnInt64(2),
+				})
+				return nil
+			},
+		}); err != nil {
+			return nil, errors.Wrap(err, "failed to query firing alerts")
+		}
+
+		a, isFiring := firing.MaybeUnwrap()
+		switch {
+		case r.firing && !isFiring:
+			a = alert{
+				User:    s.user,
+				Device:  s.device,
+				Rule:    r.rule,
+				State:   "firing",
+				Message: r.message,
+				FiredAt: now.Unix(),
+			}
+			if err := sqlitex.Execute(conn, `
+				INSERT INTO alerts (user, device, rule, message, fired_at)
+				VALUES (?1, ?2, ?3, ?4, ?5)
+				RETURNING id
+			`, &sqlitex.ExecOptions{
+				Args: []any{a.User, a.Device, a.Rule, a.Message, a.FiredAt},
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					a.ID = stmt.ColumnInt64(0)
+					return nil
+				},
+			}); err != nil {
+				return nil, errors.Wrap(err, "failed to insert alert")
+			}
+			changed = append(changed, a)
+		case !r.firing && isFiring:
+			resolved := now.Unix()
+			a.State, a.Message, a.ResolvedAt = "resolved", r.message, &resolved
+			if err := sqlitex.Execute(conn, `
+				UPDATE alerts SET state = 'resolved', resolved_at = ?2
+				WHERE id = ?1
+			`, &sqlitex.ExecOptions{
+				Args: []any{a.ID, resolved},
+			}); err != nil {
+				return nil, errors.Wrap(err, "failed to resolve alert")
+			}
+			changed = append(changed, a)
+		}
+	}
+	return changed, nil
+}
+
+// deviceStatuses returns the status of every device from its newest report.
+func deviceStatuses(conn *sqlite.Conn) ([]deviceStatus, error) {
+	var statuses []deviceStatus
+	if err := sqlitex.Execute(conn, `
+		WITH last_location_report AS (
+			SELECT id, MAX(json_extract(data, '$.tst'))
+			FROM location_reports
+			GROUP BY user_id, device
+		)
+		SELECT
+			u.user, lr.device,
+			json_extract(lr.data, '$.tst'),
+			json_extract(lr.data, '$.batt'),
+			json_extract(lr.data, '$.bs')
+		FROM location_reports AS lr
+		INNER JOIN users AS u ON lr.user_id = u.id
+		WHERE lr.id IN (SELECT id FROM last_location_report)
+		ORDER BY u.user, lr.device
+	`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			s := deviceStatus{
+				user:   stmt.ColumnText(0),
+				device: stmt.ColumnText(1),
+				tst:    stmt.ColumnInt64(2),
+			}
+			if stmt.ColumnType(3) != sqlite.TypeNull {
+				s.batt = opt.Some(stmt.ColumnInt(3))
+			}
+			if stmt.ColumnType(4) != sqlite.TypeNull {
+				s.bs = opt.Some(stmt.ColumnInt(4))
+			}
+			statuses = append(statuses, s)
+			return nil
+		},
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to query device statuses")
+	}
+	return statuses, nil
+}
+
+func listAlerts(conn *sqlite.Conn, user, device, state string) ([]alert, error) {
+	conds, args := []string{"user = ?"}, []any{user}
+	if device != "" {
+		conds, args = append(conds, "device = ?"), append(args, device)
+	}
+	if state != "" {
+		conds, args = append(conds, "state = ?"), append(args, state)
+	}
+	alerts := []alert{}
+	if err := sqlitex.Execute(conn, fmt.Sprintf(`
+		SELECT id, user, device, rule, state, message, fired_at, resolved_at
+		FROM alerts
+		WHERE %s
+		ORDER BY fired_at DESC, id DESC
+	`, strings.Join(conds, " AND ")), &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			a := alert{
+				ID:      stmt.ColumnInt64(0),
+				User:    stmt.ColumnText(1),
+				Device:  stmt.ColumnText(2),
+				Rule:    stmt.ColumnText(3),
+				State:   stmt.ColumnText(4),
+				Message: stmt.ColumnText(5),
+				FiredAt: stmt.ColumnInt64(6),
+			}
+			if stmt.ColumnType(7) != sqlite.TypeNull {
+				resolved := stmt.ColumnInt64(7)
+				a.ResolvedAt = &resolved
+			}
+			alerts = append(alerts, a)
+			return nil
+		},
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to query alerts")
+	}
+	return alerts, nil
+}
+
+// alertNotifier delivers alerts to the configured channels in the
+// background, so a slow mail server does not hold up checks.
+type alertNotifier struct {
+	cfg    configAlerts
+	client *http.Client
+	queue  chan alert
+	done   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+const (
+	alertQueueSize        = 100
+	alertDeliveryAttempts = 3
+)
+
+func newAlertNotifier(cfg configAlerts) *alertNotifier {
+	client := cleanhttp.DefaultPooledClient()
+	client.Timeout = 10 * time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &alertNotifier{
+		cfg:    cfg,
+		client: client,
+		queue:  make(chan alert, alertQueueSize),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	go func() {
+		defer close(n.done)
+		for a := range n.queue {
+			n.deliver(a)
+		}
+	}()
+	return n
+}
+
+func (n *alertNotifier) notify(a alert) {
+	select {
+	case n.queue <- a:
+	default:
+		slog.Warn("alert queue is full, dropping alert",
+			slog.String("user", a.User),
+			slog.String("device", a.Device),
+			slog.String("rule", a.Rule),
+		)
+	}
+}
+
+// close delivers the alerts that are still queued, deliveries are abandoned
+// when ctx is done.
+func (n *alertNotifier) close(ctx context.Context) {
+	close(n.queue)
+	select {
+	case <-n.done:
+	case <-ctx.Done():
+		n.cancel()
+		<-n.done
+	}
+	n.cancel()
+}
+
+func (n *alertNotifier) deliver(a alert) {
+	type channel struct {
+		name string
+		send func(alert) error
+	}
+	var channels []channel
+	if n.cfg.WebhookURL != "" {
+		channels = append(channels, channel{"webhook", n.sendWebhook})
+	}
+	if n.cfg.SMTP.Addr != "" {
+		channels = append(channels, channel{"smtp", n.sendMail})
+	}
+	for _, c := range channels {
+		var err error
+		for attempt := 1; attempt <= alertDeliveryAttempts; attempt++ {
+			if err = c.send(a); err == nil || n.ctx.Err() != nil {
+				break
+			}
+			select {
+			case <-n.ctx.Done():
+			case <-time.After(time.Duration(attempt) * 5 * time.Second):
+			}
+		}
+		if err != nil {
+			slog.Error("failed to deliver alert",
+				slog.String("channel", c.name),
+				slog.Int64("alert", a.ID),
+				slog.String("err", err.Error()),
+			)
+		}
+	}
+}
+
+func alertSubject(a alert) string {
+	if a.State == "resolved" {
+		return fmt.Sprintf("[gotracks] resolved: %s/%s %s", a.User, a.Device, a.Rule)
+	}
+	return fmt.Sprintf("[gotracks] %s/%s: %s", a.User, a.Device, a.Message)
+}
+
+func (n *alertNotifier) sendWebhook(a alert) error {
+	body := mustJSONEncode(struct {
+		alert
+		// Text makes the payload usable with chat webhooks as is.
+		Text string `json:"text"`
+	}{a, alertSubject(a)})
+	req, err := http.NewRequestWithContext(n.ctx, http.MethodPost, n.cfg.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to build webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "webhook request failed")
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func (n *alertNotifier) sendMail(a alert) error {
+	cfg := n.cfg.SMTP
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		host, _, err := net.SplitHostPort(cfg.Addr)
+		if err != nil {
+			return errors.Wrap(err, "invalid smtp address")
+		}
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", alertSubject(a))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n", a.Message)
+	if err := smtp.SendMail(cfg.Addr, auth, cfg.From, cfg.To, msg.Bytes()); err != nil {
+		return errors.Wrap(err, "failed to send mail")
+	}
+	return nil
+}
+
+// startAlerts checks the alert rules against every device on an interval, and
+// against each live report as it comes in.
+func startAlerts(cfg configAlerts, liveLoc *liveLocations, db *sqlitemigration.Pool) func() {
+	n := newAlertNotifier(cfg)
+	updates := make(chan otLocation, 10)
+	unsubscribe := liveLoc.subscribe(updates)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			var statuses []deviceStatus
+			select {
+			case loc, ok := <-updates:
+				if !ok {
+					return
+				}
+				s, ok := deviceStatusOf(loc).MaybeUnwrap()
+				if !ok {
+					continue
+				}
+				statuses = []deviceStatus{s}
+			case <-ticker.C:
+			}
+			if err := runAlerts(context.Background(), cfg, db, n, statuses); err != nil {
+				slog.Error("alert check failed", slog.String("err", err.Error()))
+			}
+		}
+	}()
+	return func() {
+		// closes updates, which stops the checks
+		unsubscribe()
+		<-done
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		n.close(ctx)
+	}
+}
+
+// runAlerts checks the given devices, or every device when statuses is nil,
+// and queues notifications for the alerts that fired or resolved.
+func runAlerts(ctx context.Context, cfg configAlerts, db *sqlitemigration.Pool, n *alertNotifier, statuses []deviceStatus) error {
+	conn, err := getConn(ctx, db)
+	if err != nil {
+		return errors.Wrap(err, "failed to get db conn")
+	}
+	defer db.Put(conn)
+	if statuses == nil {
+		if statuses, err = deviceStatuses(conn); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	for _, s := range statuses {
+		changed, err := applyRuleResults(conn, s, checkAlertRules(cfg, s, now), now)
+		if err != nil {
+			return err
+		}
+		for _, a := range changed {
+			slog.Info("alert "+a.State,
+				slog.String("user", a.User),
+				slog.String("device", a.Device),
+				slog.String("rule", a.Rule),
+				slog.String("message", a.Message),
+			)
+			n.notify(a)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,660 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// archiveVersion is the version of the export archive layout. An archive is a
+// gzipped tar containing:
+//
+//	manifest.json                     archiveManifest
+//	users.json                        []archiveUser
+//	rec/<user>/<device>/YYYY-MM.rec   reports in the owntracks recorder layout
+//	cmd_outbox.json                   []archiveOutboxItem
+//	cmd_outbox_consumer_idx.json      []archiveConsumerIdx
+//	retention_policies.json           []retentionPolicy
+//	quarantined_reports.json          []archiveQuarantinedReport
+//	places.json                       []archivePlace
+//	place_visits.json                 []archivePlaceVisit
+//	feed_tokens.json                  []archiveFeedToken
+//	alerts.json                       []archiveAlert
+//
+// Version 1 archives have neither the retention policies nor any of the files
+// after them, they are restored as they are. Archives of a newer version than
+// this one are rejected, they may hold data that would be lost.
+//
+// gotracks does not store cards or waypoints, so there are none to archive.
+const archiveVersion = 2
+
+type archiveManifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Reports int       `json:"reports"`
+}
+
+type archiveUser struct {
+	User string `json:"user"`
+}
+
+type archiveOutboxItem struct {
+	ID          int64           `json:"id"`
+	User        string          `json:"user"`
+	Device      string          `json:"device"`
+	Data        json.RawMessage `json:"data"`
+	WhenCreated int64           `json:"when_created"`
+	WhenExpires *int64          `json:"when_expires,omitempty"`
+}
+
+type archiveConsumerIdx struct {
+	User         string `json:"user"`
+	Device       string `json:"device"`
+	LastOutboxID int64  `json:"last_outbox_id"`
+}
+
+type archiveQuarantinedReport struct {
+	ID          int64           `json:"id"`
+	User        string          `json:"user"`
+	Device      string          `json:"device"`
+	Data        json.RawMessage `json:"data"`
+	WhenCreated int64           `json:"when_created"`
+}
+
+type archivePlace struct {
+	ID          int64   `json:"id"`
+	User        string  `json:"user"`
+	Lat         float64 `json:"lat"`
+	Lon         float64 `json:"lon"`
+	Radius      float64 `json:"radius"`
+	Name        string  `json:"name"`
+	NameSource  string  `json:"name_source"`
+	WhenCreated int64   `json:"when_created"`
+}
+
+type archivePlaceVisit struct {
+	ID       int64  `json:"id"`
+	PlaceID  int64  `json:"place_id"`
+	Device   string `json:"device"`
+	Arrived  int64  `json:"arrived"`
+	Departed int64  `json:"departed"`
+}
+
+// archiveFeedToken is a feed token, only its hash is stored so the urls
+// handed out keep working after a restore.
+type archiveFeedToken struct {
+	ID          int64  `json:"id"`
+	User        string `json:"user"`
+	Device      string `json:"device"`
+	Name        string `json:"name"`
+	TokenHash   string `json:"token_hash"`
+	WhenCreated int64  `json:"when_created"`
+	WhenUsed    *int64 `json:"when_used,omitempty"`
+}
+
+type archiveAlert struct {
+	ID         int64  `json:"id"`
+	User       string `json:"user"`
+	Device     string `json:"device"`
+	Rule       string `json:"rule"`
+	State      string `json:"state"`
+	Message    string `json:"message"`
+	FiredAt    int64  `json:"fired_at"`
+	ResolvedAt *int64 `json:"resolved_at,omitempty"`
+}
+
+type archiveWriter struct {
+	tw      *tar.Writer
+	created time.Time
+}
+
+func (a archiveWriter) writeFile(name string, data []byte) error {
+	if err := a.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    int64(len(data)),
+		ModTime: a.created,
+	}); err != nil {
+		return errors.Wrapf(err, "failed to write %s header", name)
+	}
+	if _, err := a.tw.Write(data); err != nil {
+		return errors.Wrapf(err, "failed to write %s", name)
+	}
+	return nil
+}
+
+func (a archiveWriter) writeJSON(name string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode %s", name)
+	}
+	return a.writeFile(name, b)
+}
+
+// recorderRecType is the type field of a recorder .rec line for a report.
+func recorderRecType(data []byte) string {
+	var v struct {
+		Type string `json:"_type"`
+	}
+	_ = json.Unmarshal(data, &v)
+	if v.Type == "location" || v.Type == "" {
+		return "*"
+	}
+	return v.Type
+}
+
+// writeArchive writes everything stored in the database to w. The whole
+// export is read in a single transaction so it is a consistent snapshot.
+func writeArchive(ctx context.Context, conn *sqlite.Conn, w io.Writer) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	gz := gzip.NewWriter(w)
+	a := archiveWriter{tw: tar.NewWriter(gz), created: time.Now().UTC()}
+
+	var users []archiveUser
+	if err := sqlitex.Execute(conn, "SELECT user FROM users ORDER BY id", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			users = append(users, archiveUser{User: stmt.ColumnText(0)})
+			return nil
+		},
+	}); err != nil {
+		return errors.Wrap(err, "failed to query users")
+	}
+
+	var reports int
+	if err := sqlitex.Execute(conn, "SELECT COUNT(*) FROM location_reports", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			reports = stmt.ColumnInt(0)
+			return nil
+		},
+	}); err != nil {
+		return errors.Wrap(err, "failed to count location reports")
+	}
+
+	if err := a.writeJSON("manifest.json", archiveManifest{
+		Version: archiveVersion,
+		Created: a.created,
+		Reports: reports,
+	}); err != nil {
+		return err
+	}
+	if err := a.writeJSON("users.json", users); err != nil {
+		return err
+	}
+
+	// reports are buffered one month file at a time as tar needs the size of
+	// a file before its contents
+	var recName string
+	var rec bytes.Buffer
+	flushRec := func() error {
+		if recName == "" {
+			return nil
+		}
+		err := a.writeFile(recName, rec.Bytes())
+		rec.Reset()
+		return err
+	}
+	const reportsQuery = `
+		SELECT u.user, r.device, json_extract(r.data, '$.tst'), r.data
+		FROM location_reports r
+		JOIN users u ON u.id = r.user_id
+		ORDER BY u.user, r.device, json_extract(r.data, '$.tst'), r.id
+	`
+	if err := sqlitex.Execute(conn, reportsQuery, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			tst := time.Unix(stmt.ColumnInt64(2), 0).UTC()
+			name := path.Join("rec", stmt.ColumnText(0), stmt.ColumnText(1), tst.Format("2006-01")+".rec")
+			if name != recName {
+				if err := flushRec(); err != nil {
+					return err
+				}
+				recName = name
+			}
+			data := []byte(stmt.ColumnText(3))
+			fmt.Fprintf(&rec, "%s\t%-18s\t%s\n", tst.Format(time.RFC3339), recorderRecType(data), data)
+			return nil
+		},
+	}); err != nil {
+		return errors.Wrap(err, "failed to query location reports")
+	}
+	if err := flushRec(); err != nil {
+		return err
+	}
+
+	var outbox []archiveOutboxItem
+	if err := sqlitex.Execute(conn, "SELECT id, user, device, data, when_created, when_expires FROM cmd_outbox ORDER BY id", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			item := archiveOutboxItem{
+				ID:          stmt.ColumnInt64(0),
+				User:        stmt.ColumnText(1),
+				Device:      stmt.ColumnText(2),
+				Data:        json.RawMessage(stmt.ColumnText(3)),
+				WhenCreated: stmt.ColumnInt64(4),
+			}
+			if stmt.ColumnType(5) != sqlite.TypeNull {
+				v := stmt.ColumnInt64(5)
+				item.WhenExpires = &v
+			}
+			outbox = append(outbox, item)
+			return nil
+		},
+	}); err != nil {
+		return errors.Wrap(err, "failed to query cmd outbox")
+	}
+	if err := a.writeJSON("cmd_outbox.json", outbox); err != nil {
+		return err
+	}
+
+	var consumerIdx []archiveConsumerIdx
+	if err := sqlitex.Execute(conn, "SELECT user, device, last_outbox_id FROM cmd_outbox_consumer_idx ORDER BY user, device", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			consumerIdx = append(consumerIdx, archiveConsumerIdx{
+				User:         stmt.ColumnText(0),
+				Device:       stmt.ColumnText(1),
+				LastOutboxID: stmt.ColumnInt64(2),
+			})
+			return nil
+		},
+	}); err != nil {
+		return errors.Wrap(err, "failed to query cmd outbox consumer indexes")
+	}
+	if err := a.writeJSON("cmd_outbox_consumer_idx.json", consumerIdx); err != nil {
+		return err
+	}
+
+	policies, err := listRetentionPolicies(conn)
+	if err != nil {
+		return err
+	}
+	if err := a.writeJSON("retention_policies.json", policies); err != nil {
+		return err
+	}
+
+	var quarantined []archiveQuarantinedReport
+	if err := sqlitex.Execute(conn, `
+		SELECT q.id, u.user, q.device, q.data, q.when_created
+		FROM quarantined_reports q
+		JOIN users u ON u.id = q.user_id
+		ORDER BY q.id
+	`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			quarantined = append(quarantined, archiveQuarantinedReport{
+				ID:          stmt.ColumnInt64(0),
+				User:        stmt.ColumnText(1),
+				Device:      stmt.ColumnText(2),
+				Data:        json.RawMessage(stmt.ColumnText(3)),
+				WhenCreated: stmt.ColumnInt64(4),
+			})
+			return nil
+		},
+	}); err != nil {
+		return errors.Wrap(err, "failed to query quarantined reports")
+	}
+	if err := a.writeJSON("quarantined_reports.json", quarantined); err != nil {
+		return err
+	}
+
+	var places []archivePlace
+	if err := sqlitex.Execute(conn, `
+		SELECT p.id, u.user, p.lat, p.lon, p.radius, p.name, p.name_source, p.when_created
+		FROM places p
+		JOIN users u ON u.id = p.user_id
+		ORDER BY p.id
+	`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			places = append(places, archivePlace{
+				ID:          stmt.ColumnInt64(0),
+				User:        stmt.ColumnText(1),
+				Lat:         stmt.ColumnFloat(2),
+				Lon:         stmt.ColumnFloat(3),
+				Radius:      stmt.ColumnFloat(4),
+				Name:        stmt.ColumnText(5),
+				NameSource:  stmt.ColumnText(6),
+				WhenCreated: stmt.ColumnInt64(7),
+			})
+			return nil
+		},
+	}); err != nil {
+		return errors.Wrap(err, "failed to query places")
+	}
+	if err := a.writeJSON("places.json", places); err != nil {
+		return err
+	}
+
+	var visits []archivePlaceVisit
+	if err := sqlitex.Execute(conn, "SELECT id, place_id, device, arrived, departed FROM place_visits ORDER BY id", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			visits = append(visits, archivePlaceVisit{
+				ID:       stmt.ColumnInt64(0),
+				PlaceID:  stmt.ColumnInt64(1),
+				Device:   stmt.ColumnText(2),
+				Arrived:  stmt.ColumnInt64(3),
+				Departed: stmt.ColumnInt64(4),
+			})
+			return nil
+		},
+	}); err != nil {
+		return errors.Wrap(err, "failed to query place visits")
+	}
+	if err := a.writeJSON("place_visits.json", visits); err != nil {
+		return err
+	}
+
+	var feedTokens []archiveFeedToken
+	if err := sqlitex.Execute(conn, "SELECT id, user, device, name, token_hash, when_created, when_used FROM feed_tokens ORDER BY id", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			tok := archiveFeedToken{
+				ID:          stmt.ColumnInt64(0),
+				User:        stmt.ColumnText(1),
+				Device:      stmt.ColumnText(2),
+				Name:        stmt.ColumnText(3),
+				TokenHash:   stmt.ColumnText(4),
+				WhenCreated: stmt.ColumnInt64(5),
+			}
+			if stmt.ColumnType(6) != sqlite.TypeNull {
+				v := stmt.ColumnInt64(6)
+				tok.WhenUsed = &v
+			}
+			feedTokens = append(feedTokens, tok)
+			return nil
+		},
+	}); err != nil {
+		return errors.Wrap(err, "failed to query feed tokens")
+	}
+	if err := a.writeJSON("feed_tokens.json", feedTokens); err != nil {
+		return err
+	}
+
+	var alerts []archiveAlert
+	if err := sqlitex.Execute(conn, "SELECT id, user, device, rule, state, message, fired_at, resolved_at FROM alerts ORDER BY id", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			alert := archiveAlert{
+				ID:      stmt.ColumnInt64(0),
+				User:    stmt.ColumnText(1),
+				Device:  stmt.ColumnText(2),
+				Rule:    stmt.ColumnText(3),
+				State:   stmt.ColumnText(4),
+				Message: stmt.ColumnText(5),
+				FiredAt: stmt.ColumnInt64(6),
+			}
+			if stmt.ColumnType(7) != sqlite.TypeNull {
+				v := stmt.ColumnInt64(7)
+				alert.ResolvedAt = &v
+			}
+			alerts = append(alerts, alert)
+			return nil
+		},
+	}); err != nil {
+		return errors.Wrap(err, "failed to query alerts")
+	}
+	if err := a.writeJSON("alerts.json", alerts); err != nil {
+		return err
+	}
+
+	if err := a.tw.Close(); err != nil {
+		return errors.Wrap(err, "failed to finish tar")
+	}
+	if err := gz.Close(); err != nil {
+		return errors.Wrap(err, "failed to finish gzip")
+	}
+	return nil
+}
+
+// restoreArchive loads an archive written by writeArchive into the database,
+// which must not have any location reports yet.
+func restoreArchive(ctx context.Context, conn *sqlite.Conn, r io.Reader) (_ archiveManifest, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	var existing int
+	if err := sqlitex.Execute(conn, "SELECT COUNT(*) FROM location_reports", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			existing = stmt.ColumnInt(0)
+			return nil
+		},
+	}); err != nil {
+		return archiveManifest{}, errors.Wrap(err, "failed to count location reports")
+	}
+	if existing > 0 {
+		return archiveManifest{}, fmt.Errorf("database already has %d location reports, restore needs an empty database", existing)
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return archiveManifest{}, errors.Wrap(err, "failed to read gzip")
+	}
+	tr := tar.NewReader(gz)
+
+	var manifest archiveManifest
+	userIDs := map[string]int{}
+	userID := func(user string) (int, error) {
+		if id, ok := userIDs[user]; ok {
+			return id, nil
+		}
+		id, err := getUserID(ctx, conn, user)
+		if err != nil {
+			return 0, err
+		}
+		userIDs[user] = id
+		return id, nil
+	}
+	restored := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return archiveManifest{}, errors.Wrap(err, "failed to read tar")
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if hdr.Name != "manifest.json" && manifest.Version == 0 {
+			return archiveManifest{}, fmt.Errorf("archive does not start with a manifest")
+		}
+
+		switch name := hdr.Name; {
+		case name == "manifest.json":
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return archiveManifest{}, errors.Wrap(err, "failed to decode manifest")
+			}
+			if manifest.Version < 1 || manifest.Version > archiveVersion {
+				return archiveManifest{}, fmt.Errorf("unsupported archive version %d", manifest.Version)
+			}
+
+		case name == "users.json":
+			var users []archiveUser
+			if err := json.NewDecoder(tr).Decode(&users); err != nil {
+				return archiveManifest{}, errors.Wrap(err, "failed to decode users")
+			}
+			for _, u := range users {
+				if _, err := userID(u.User); err != nil {
+					return archiveManifest{}, errors.Wrap(err, "failed to restore user")
+				}
+			}
+
+		case strings.HasPrefix(name, "rec/") && path.Ext(name) == ".rec":
+			parts := strings.Split(name, "/")
+			if len(parts) != 4 {
+				return archiveManifest{}, fmt.Errorf("unexpected rec file %s", name)
+			}
+			uid, err := userID(parts[1])
+			if err != nil {
+				return archiveManifest{}, errors.Wrap(err, "failed to restore user")
+			}
+			sc := bufio.NewScanner(tr)
+			sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+			for sc.Scan() {
+				if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+					continue
+				}
+				line, err := parseRecorderLine(sc.Bytes())
+				if err != nil {
+					return archiveManifest{}, errors.Wrapf(err, "invalid line in %s", name)
+				}
+				if err := sqlitex.Execute(conn, "INSERT INTO location_reports (user_id, device, data) VALUES (?, ?, ?)", &sqlitex.ExecOptions{
+					Args: []any{uid, parts[2], string(line.payload)},
+				}); err != nil {
+					return archiveManifest{}, errors.Wrap(err, "failed to restore location report")
+				}
+				restored++
+			}
+			if err := sc.Err(); err != nil {
+				return archiveManifest{}, errors.Wrapf(err, "failed to read %s", name)
+			}
+
+		case name == "cmd_outbox.json":
+			var outbox []archiveOutboxItem
+			if err := json.NewDecoder(tr).Decode(&outbox); err != nil {
+				return archiveManifest{}, errors.Wrap(err, "failed to decode cmd outbox")
+			}
+			for _, item := range outbox {
+				var expires any
+				if item.WhenExpires != nil {
+					expires = *item.WhenExpires
+				}
+				// the archive stores the data indented
+				var data bytes.Buffer
+				if err := json.Compact(&data, item.Data); err != nil {
+					return archiveManifest{}, errors.Wrap(err, "invalid cmd outbox data")
+				}
+				if err := sqlitex.Execute(conn, "INSERT INTO cmd_outbox (id, user, device, data, when_created, when_expires) VALUES (?, ?, ?, ?, ?, ?)", &sqlitex.ExecOptions{
+					Args: []any{item.ID, item.User, item.Device, data.String(), item.WhenCreated, expires},
+				}); err != nil {
+					return archiveManifest{}, errors.Wrap(err, "failed to restore cmd outbox")
+				}
+			}
+
+		case name == "cmd_outbox_consumer_idx.json":
+			var consumerIdx []archiveConsumerIdx
+			if err := json.NewDecoder(tr).Decode(&consumerIdx); err != nil {
+				return archiveManifest{}, errors.Wrap(err, "failed to decode cmd outbox consumer indexes")
+			}
+			for _, idx := range consumerIdx {
+				if err := sqlitex.Execute(conn, "INSERT OR REPLACE INTO cmd_outbox_consumer_idx (user, device, last_outbox_id) VALUES (?, ?, ?)", &sqlitex.ExecOptions{
+					Args: []any{idx.User, idx.Device, idx.LastOutboxID},
+				}); err != nil {
+					return archiveManifest{}, errors.Wrap(err, "failed to restore cmd outbox consumer index")
+				}
+			}
+
+		case name == "retention_policies.json":
+			var policies []retentionPolicy
+			if err := json.NewDecoder(tr).Decode(&policies); err != nil {
+				return archiveManifest{}, errors.Wrap(err, "failed to decode retention policies")
+			}
+			for _, p := range policies {
+				if err := saveRetentionPolicy(conn, p); err != nil {
+					return archiveManifest{}, err
+				}
+			}
+
+		case name == "quarantined_reports.json":
+			var quarantined []archiveQuarantinedReport
+			if err := json.NewDecoder(tr).Decode(&quarantined); err != nil {
+				return archiveManifest{}, errors.Wrap(err, "failed to decode quarantined reports")
+			}
+			for _, q := range quarantined {
+				uid, err := userID(q.User)
+				if err != nil {
+					return archiveManifest{}, errors.Wrap(err, "failed to restore user")
+				}
+				var data bytes.Buffer
+				if err := json.Compact(&data, q.Data); err != nil {
+					return archiveManifest{}, errors.Wrap(err, "invalid quarantined report data")
+				}
+				if err := sqlitex.Execute(conn, "INSERT INTO quarantined_reports (id, user_id, device, data, when_created) VALUES (?, ?, ?, ?, ?)", &sqlitex.ExecOptions{
+					Args: []any{q.ID, uid, q.Device, data.String(), q.WhenCreated},
+				}); err != nil {
+					return archiveManifest{}, errors.Wrap(err, "failed to restore quarantined report")
+				}
+			}
+
+		case name == "places.json":
+			var places []archivePlace
+			if err := json.NewDecoder(tr).Decode(&places); err != nil {
+				return archiveManifest{}, errors.Wrap(err, "failed to decode places")
+			}
+			for _, p := range places {
+				uid, err := userID(p.User)
+				if err != nil {
+					return archiveManifest{}, errors.Wrap(err, "failed to restore user")
+				}
+				// reports refer to their place by id, so ids are kept
+				if err := sqlitex.Execute(conn, "INSERT INTO places (id, user_id, lat, lon, radius, name, name_source, when_created) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", &sqlitex.ExecOptions{
+					Args: []any{p.ID, uid, p.Lat, p.Lon, p.Radius, p.Name, p.NameSource, p.WhenCreated},
+				}); err != nil {
+					return archiveManifest{}, errors.Wrap(err, "failed to restore place")
+				}
+			}
+
+		case name == "place_visits.json":
+			var visits []archivePlaceVisit
+			if err := json.NewDecoder(tr).Decode(&visits); err != nil {
+				return archiveManifest{}, errors.Wrap(err, "failed to decode place visits")
+			}
+			for _, v := range visits {
+				if err := sqlitex.Execute(conn, "INSERT INTO place_visits (id, place_id, device, arrived, departed) VALUES (?, ?, ?, ?, ?)", &sqlitex.ExecOptions{
+					Args: []any{v.ID, v.PlaceID, v.Device, v.Arrived, v.Departed},
+				}); err != nil {
+					return archiveManifest{}, errors.Wrap(err, "failed to restore place visit")
+				}
+			}
+
+		case name == "feed_tokens.json":
+			var feedTokens []archiveFeedToken
+			if err := json.NewDecoder(tr).Decode(&feedTokens); err != nil {
+				return archiveManifest{}, errors.Wrap(err, "failed to decode feed tokens")
+			}
+			for _, tok := range feedTokens {
+				var used any
+				if tok.WhenUsed != nil {
+					used = *tok.WhenUsed
+				}
+				if err := sqlitex.Execute(conn, "INSERT INTO feed_tokens (id, user, device, name, token_hash, when_created, when_used) VALUES (?, ?, ?, ?, ?, ?, ?)", &sqlitex.ExecOptions{
+					Args: []any{tok.ID, tok.User, tok.Device, tok.Name, tok.TokenHash, tok.WhenCreated, used},
+				}); err != nil {
+					return archiveManifest{}, errors.Wrap(err, "failed to restore feed token")
+				}
+			}
+
+		case name == "alerts.json":
+			var alerts []archiveAlert
+			if err := json.NewDecoder(tr).Decode(&alerts); err != nil {
+				return archiveManifest{}, errors.Wrap(err, "failed to decode alerts")
+			}
+			for _, alert := range alerts {
+				var resolved any
+				if alert.ResolvedAt != nil {
+					resolved = *alert.ResolvedAt
+				}
+				if err := sqlitex.Execute(conn, "INSERT INTO alerts (id, user, device, rule, state, message, fired_at, resolved_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", &sqlitex.ExecOptions{
+					Args: []any{alert.ID, alert.User, alert.Device, alert.Rule, alert.State, alert.Message, alert.FiredAt, resolved},
+				}); err != nil {
+					return archiveManifest{}, errors.Wrap(err, "failed to restore alert")
+				}
+			}
+		}
+	}
+	if manifest.Version == 0 {
+		return archiveManifest{}, fmt.Errorf("archive has no manifest")
+	}
+	if restored != manifest.Reports {
+		return archiveManifest{}, fmt.Errorf("archive manifest lists %d location reports but %d were found", manifest.Reports, restored)
+	}
+	return manifest, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// archiveTestTables are the queries whose results must survive an export and
+// restore unchanged.
+var archiveTestTables = map[string]string{
+	"users": "SELECT user FROM users ORDER BY user",
+	"location_reports": `
+		SELECT u.user || '/' || r.device || ' ' || r.data
+		FROM location_reports r
+		JOIN users u ON u.id = r.user_id
+		ORDER BY 1
+	`,
+	"cmd_outbox":              "SELECT id || ' ' || user || '/' || device || ' ' || data || ' ' || when_created || ' ' || IFNULL(when_expires, '-') FROM cmd_outbox ORDER BY id",
+	"cmd_outbox_consumer_idx": "SELECT user || '/' || device || ' ' || last_outbox_id FROM cmd_outbox_consumer_idx ORDER BY 1",
+	"retention_policies": `
+		SELECT user || '/' || device || ' ' || IFNULL(delete_after_days, '-') || ' ' || IFNULL(downsample_after_days, '-') || ' ' ||
+			IFNULL(downsample_interval_secs, '-') || ' ' || IFNULL(max_acc, '-')
+		FROM retention_policies
+		ORDER BY 1
+	`,
+	"quarantined_reports": `
+		SELECT q.id || ' ' || u.user || '/' || q.device || ' ' || q.data || ' ' || q.when_created
+		FROM quarantined_reports q
+		JOIN users u ON u.id = q.user_id
+		ORDER BY q.id
+	`,
+	"places": `
+		SELECT p.id || ' ' || u.user || ' ' || p.lat || ',' || p.lon || ' ' || p.radius || ' ' || p.name || ' ' || p.name_source || ' ' || p.when_created
+		FROM places p
+		JOIN users u ON u.id = p.user_id
+		ORDER BY p.id
+	`,
+	"place_visits": "SELECT id || ' ' || place_id || ' ' || device || ' ' || arrived || '-' || departed FROM place_visits ORDER BY id",
+	"feed_tokens":  "SELECT id || ' ' || user || '/' || device || ' ' || name || ' ' || token_hash || ' ' || when_created || ' ' || IFNULL(when_used, '-') FROM feed_tokens ORDER BY id",
+	"alerts":       "SELECT id || ' ' || user || '/' || device || ' ' || rule || ' ' || state || ' ' || message || ' ' || fired_at || ' ' || IFNULL(resolved_at, '-') FROM alerts ORDER BY id",
+}
+
+// archiveTestData fills a database with a row for every archived table.
+var archiveTestData = []string{
+	"INSERT INTO users (user) VALUES ('alice'), ('bob')",
+	`INSERT INTO location_reports (user_id, device, data) VALUES
+		((SELECT id FROM users WHERE user = 'alice'), 'phone', '{"_type":"location","lat":52.52,"lon":13.405,"tst":1700000000}'),
+		((SELECT id FROM users WHERE user = 'alice'), 'phone', '{"_type":"transition","event":"enter","tst":1700000100}'),
+		((SELECT id FROM users WHERE user = 'bob'), 'tablet', '{"_type":"location","lat":48.85,"lon":2.35,"tst":1700003600}')`,
+	`INSERT INTO cmd_outbox (id, user, device, data, when_created, when_expires) VALUES
+		(3, 'alice', 'phone', '{"_type":"cmd","action":"reportLocation"}', 1700000000, NULL),
+		(4, 'bob', 'tablet', '{"_type":"cmd","action":"dump"}', 1700000000, 1700086400)`,
+	"INSERT INTO cmd_outbox_consumer_idx (user, device, last_outbox_id) VALUES ('alice', 'phone', 3)",
+	`INSERT INTO retention_policies (user, device, delete_after_days, downsample_after_days, downsample_interval_secs, max_acc) VALUES
+		('alice', '', 365, NULL, NULL, NULL),
+		('alice', 'phone', NULL, 30, 300, 100)`,
+	`INSERT INTO quarantined_reports (id, user_id, device, data, when_created) VALUES
+		(7, (SELECT id FROM users WHERE user = 'bob'), 'tablet', '{"_type":"location","lat":-33.86,"lon":151.2,"tst":1700003700}', 1700003701)`,
+	`INSERT INTO places (id, user_id, lat, lon, radius, name, name_source, when_created) VALUES
+		(5, (SELECT id FROM users WHERE user = 'alice'), 52.52, 13.405, 100, 'Home', 'user', 1700000000),
+		(9, (SELECT id FROM users WHERE user = 'alice'), 52.5, 13.3, 100, '', '', 1700000000)`,
+	`INSERT INTO place_visits (id, place_id, device, arrived, departed) VALUES
+		(1, 5, 'phone', 1700000000, 1700003600),
+		(2, 9, 'phone', 1700010000, 1700013600)`,
+	`INSERT INTO feed_tokens (id, user, device, name, token_hash, when_created, when_used) VALUES
+		(1, 'alice', '', 'calendar', 'f2ca1bb6c7e907d06dafe4687e579fce76b37e4e93b7605022da52e6ccc26fd2', 1700000000, 1700050000),
+		(2, 'bob', 'tablet', '', '2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae', 1700000000, NULL)`,
+	`INSERT INTO alerts (id, user, device, rule, state, message, fired_at, resolved_at) VALUES
+		(1, 'alice', 'phone', 'low_battery', 'resolved', 'phone battery is at 9%', 1700000000, 1700007200),
+		(2, 'bob', 'tablet', 'stale', 'firing', 'tablet has not reported for 2h', 1700010000, NULL)`,
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src := testDB(t, testConfig(t))
+	withConn := func(db *sqlitemigration.Pool, f func(conn *sqlite.Conn) error) {
+		t.Helper()
+		conn, err := db.Get(ctx)
+		if err != nil {
+			t.Fatalf("failed to get conn: %v", err)
+		}
+		defer db.Put(conn)
+		if err := f(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	withConn(src, func(conn *sqlite.Conn) error {
+		for _, q := range archiveTestData {
+			if err := sqlitex.ExecuteTransient(conn, q, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	var archive bytes.Buffer
+	withConn(src, func(conn *sqlite.Conn) error {
+		return writeArchive(ctx, conn, &archive)
+	})
+	dst := testDB(t, testConfig(t))
+	withConn(dst, func(conn *sqlite.Conn) error {
+		manifest, err := restoreArchive(ctx, conn, bytes.NewReader(archive.Bytes()))
+		if err == nil && manifest.Reports != 3 {
+			t.Errorf("manifest lists %d reports", manifest.Reports)
+		}
+		return err
+	})
+
+	for table, q := range archiveTestTables {
+		want := testQuery(t, src, q)
+		if len(want) == 0 {
+			t.Errorf("%s: no test data", table)
+		}
+		if got := testQuery(t, dst, q); strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s after restore:\n%s\nwant:\n%s", table, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+
+	// a second restore would duplicate every report
+	withConn(dst, func(conn *sqlite.Conn) error {
+		if _, err := restoreArchive(ctx, conn, bytes.NewReader(archive.Bytes())); err == nil {
+			t.Error("restored into a database that already has reports")
+		}
+		return nil
+	})
+}
+
+func TestRestoreArchiveVersion(t *testing.T) {
+	db := testDB(t, testConfig(t))
+	conn, err := db.Get(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get conn: %v", err)
+	}
+	defer db.Put(conn)
+	// newer and invalid versions are rejected, version 1 archives lack the
+	// files added since but still restore
+	for _, version := range []int{-1, archiveVersion + 1, 1} {
+		var archive bytes.Buffer
+		gw := gzip.NewWriter(&archive)
+		tw := tar.NewWriter(gw)
+		manifest, err := json.Marshal(archiveManifest{Version: version})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0o644, Size: int64(len(manifest))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(manifest); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		_, err = restoreArchive(context.Background(), conn, &archive)
+		if version == 1 && err != nil {
+			t.Errorf("version 1: restore failed: %v", err)
+		} else if version != 1 && (err == nil || !strings.Contains(err.Error(), "unsupported archive version")) {
+			t.Errorf("version %d: restore error = %v", version, err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+type configBackup struct {
+	// Dir is where scheduled snapshots are written. Scheduled snapshots are
+	// disabled when it is empty.
+	Dir      string
+	Interval time.Duration `envDefault:"24h"`
+	// Keep is the number of snapshots kept in Dir, older ones are deleted.
+	Keep int `envDefault:"7"`
+}
+
+const (
+	backupPrefix = "gotracks-"
+	backupSuffix = ".sqlite3"
+)
+
+// snapshotDB writes a consistent copy of the database to dest, which must not
+// exist yet, and checks the integrity of the copy.
+func snapshotDB(conn *sqlite.Conn, dest string) error {
+	if err := sqlitex.Execute(conn, "VACUUM INTO ?", &sqlitex.ExecOptions{
+		Args: []any{dest},
+	}); err != nil {
+		return errors.Wrap(err, "failed to snapshot db")
+	}
+	if err := checkDBIntegrity(dest); err != nil {
+		os.Remove(dest)
+		return err
+	}
+	return nil
+}
+
+func checkDBIntegrity(path string) error {
+	conn, err := sqlite.OpenConn(path, sqlite.OpenReadOnly)
+	if err != nil {
+		return errors.Wrap(err, "failed to open snapshot")
+	}
+	defer conn.Close()
+	var problems []string
+	if err := sqlitex.Execute(conn, "PRAGMA integrity_check", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			if msg := stmt.ColumnText(0); msg != "ok" {
+				problems = append(problems, msg)
+			}
+			return nil
+		},
+	}); err != nil {
+		return errors.Wrap(err, "failed to check snapshot integrity")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("snapshot failed integrity check: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// listBackups returns the snapshots in dir, oldest first.
+func listBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list backup dir")
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), backupPrefix) && strings.HasSuffix(e.Name(), backupSuffix) {
+			names = append(names, e.Name())
+		}
+	}
+	// the names hold a sortable timestamp
+	slices.Sort(names)
+	return names, nil
+}
+
+// runBackup writes a new snapshot into cfg.Dir and deletes the snapshots
+// beyond cfg.Keep.
+func runBackup(ctx context.Context, cfg configBackup, db *sqlitemigration.Pool) (string, error) {
+	conn, err := getConn(ctx, db)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get db conn")
+	}
+	defer db.Put(conn)
+
+	name := filepath.Join(cfg.Dir, backupPrefix+time.Now().UTC().Format("20060102T150405Z")+backupSuffix)
+	// snapshots are written under a temporary name so a half written one is
+	// never mistaken for a complete snapshot
+	tmp := name + ".tmp"
+	os.Remove(tmp)
+	if err := snapshotDB(conn, tmp); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return "", errors.Wrap(err, "failed to rename snapshot")
+	}
+
+	backups, err := listBackups(cfg.Dir)
+	if err != nil {
+		return name, err
+	}
+	for len(backups) > max(cfg.Keep, 1) {
+		if err := os.Remove(filepath.Join(cfg.Dir, backups[0])); err != nil {
+			return name, errors.Wrap(err, "failed to delete old snapshot")
+		}
+		backups = backups[1:]
+	}
+	return name, nil
+}
+
+// startBackups writes a snapshot every cfg.Interval until the returned stop
+// func is called. The first snapshot is due one interval after the newest
+// snapshot already in cfg.Dir so restarts do not postpone backups.
+func startBackups(cfg configBackup, db *sqlitemigration.Pool) (stop func(), err error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, errors.Wrap(err, "failed to create backup dir")
+	}
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("invalid backup interval %s", cfg.Interval)
+	}
+	backups, err := listBackups(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	next := time.Duration(0)
+	if len(backups) > 0 {
+		if fi, err := os.Stat(filepath.Join(cfg.Dir, backups[len(backups)-1])); err == nil {
+			next = max(time.Until(fi.ModTime().Add(cfg.Interval)), 0)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		timer := time.NewTimer(next)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+			name, err := runBackup(ctx, cfg, db)
+			if err != nil {
+				slog.Error("scheduled backup failed", slog.String("err", err.Error()))
+			} else {
+				slog.Info("scheduled backup written", slog.String("file", name))
+			}
+			timer.Reset(cfg.Interval)
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
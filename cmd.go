@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+type command func(args []string) error
+
+type commandSet map[string]command
+
+func (c commandSet) run(what string, args []string) error {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	if len(args) == 0 {
+		return fmt.Errorf("missing %s, expected one of: %s", what, strings.Join(names, ", "))
+	}
+	cmd, ok := c[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown %s %q, expected one of: %s", what, args[0], strings.Join(names, ", "))
+	}
+	return cmd(args[1:])
+}
+
+var commands = commandSet{
+	"export": exportCommand,
+	"geotag": geotagCommand,
+	"import": func(args []string) error {
+		return importCommands.run("import source", args)
+	},
+	"restore": restoreCommand,
+}
+
+var importCommands = commandSet{
+	"recorder": importRecorderCommand,
+	"takeout":  importTakeoutCommand,
+}
+
+func runCommand(name string, args []string) error {
+	return commands.run("command", append([]string{name}, args...))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: gotracks export <archive.tar.gz|->")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected 1 argument, got %d", flags.NArg())
+	}
+
+	cfg, err := loadCommandConfig()
+	if err != nil {
+		return err
+	}
+	dbpool, err := openDB(cfg)
+	if err != nil {
+		return errors.Wrap(err, "failed to open db")
+	}
+	defer dbpool.Close()
+
+	ctx := context.Background()
+	conn, err := dbpool.Get(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get db conn")
+	}
+	defer dbpool.Put(conn)
+
+	var w io.Writer = os.Stdout
+	if flags.Arg(0) != "-" {
+		f, err := os.Create(flags.Arg(0))
+		if err != nil {
+			return errors.Wrap(err, "failed to create archive")
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := writeArchive(ctx, conn, w); err != nil {
+		return errors.WithStack(err)
+	}
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		if err := f.Close(); err != nil {
+			return errors.Wrap(err, "failed to write archive")
+		}
+	}
+	return nil
+}
+
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: gotracks restore <archive.tar.gz|->")
+		fmt.Fprintln(flags.Output(), "restores an archive written by gotracks export into an empty database")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected 1 argument, got %d", flags.NArg())
+	}
+
+	var r io.Reader = os.Stdin
+	if flags.Arg(0) != "-" {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return errors.Wrap(err, "failed to open archive")
+		}
+		defer f.Close()
+		r = f
+	}
+
+	cfg, err := loadCommandConfig()
+	if err != nil {
+		return err
+	}
+	dbpool, err := openDB(cfg)
+	if err != nil {
+		return errors.Wrap(err, "failed to open db")
+	}
+	defer dbpool.Close()
+
+	ctx := context.Background()
+	conn, err := dbpool.Get(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get db conn")
+	}
+	defer dbpool.Put(conn)
+
+	manifest, err := restoreArchive(ctx, conn, r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	fmt.Printf("restored %d location reports from archive created %s\n", manifest.Reports, manifest.Created.Format("2006-01-02 15:04:05Z07:00"))
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"code.nkcmr.net/gotracks/internal/exif"
+
+	"github.com/pkg/errors"
+)
+
+func isJPEGFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg":
+		return true
+	}
+	return false
+}
+
+// writeFileAtomic replaces name with data, keeping the file's mode.
+func writeFileAtomic(name string, data []byte) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.WithStack(err)
+	}
+	if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+		tmp.Close()
+		return errors.WithStack(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp.Name(), name))
+}
+
+func geotagCommand(args []string) error {
+	flags := flag.NewFlagSet("geotag", flag.ContinueOnError)
+	user := flags.String("user", "", "user whose track to use (default: the configured user)")
+	device := flags.String("device", "", "device whose track to use")
+	offset := flags.Duration("offset", 0, "how far the camera clock was ahead of the real time, e.g. 1m30s or -1h")
+	tz := flags.String("tz", "Local", "time zone of the camera clock, used for pictures that do not record their UTC offset")
+	maxGap := flags.Duration("max-gap", time.Hour, "skip pictures when the reports around them are further apart than this")
+	overwrite := flags.Bool("overwrite", false, "replace gps tags that pictures already have")
+	dryRun := flags.Bool("dry-run", false, "list the positions that would be written without changing any files")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: gotracks geotag [flags] <dir>")
+		fmt.Fprintln(flags.Output(), "writes the position of a device at the time each jpeg in dir was taken into its exif gps tags")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected 1 argument, got %d", flags.NArg())
+	}
+	if *device == "" {
+		flags.Usage()
+		return errors.New("-device is required")
+	}
+	loc, err := time.LoadLocation(*tz)
+	if err != nil {
+		return errors.Wrap(err, "invalid -tz")
+	}
+
+	dir := flags.Arg(0)
+	dirents, err := os.ReadDir(dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to read dir")
+	}
+	var names []string
+	for _, d := range dirents {
+		if !d.IsDir() && isJPEGFile(d.Name()) {
+			names = append(names, d.Name())
+		}
+	}
+	slices.Sort(names)
+
+	cfg, err := loadCommandConfig()
+	if err != nil {
+		return err
+	}
+	if *user == "" {
+		*user = cfg.Username
+	}
+	dbpool, err := openDB(cfg)
+	if err != nil {
+		return errors.Wrap(err, "failed to open db")
+	}
+	defer dbpool.Close()
+
+	ctx := context.Background()
+	conn, err := dbpool.Get(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get db conn")
+	}
+	defer dbpool.Put(conn)
+
+	var tagged, skipped int
+	skip := func(name, reason string) {
+		skipped++
+		fmt.Printf("%s\tskipped: %s\n", name, reason)
+	}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", name)
+		}
+		x, err := exif.Read(data)
+		if err != nil {
+			skip(name, err.Error())
+			continue
+		}
+		if x.HasGPS() && !*overwrite {
+			skip(name, "already has gps tags")
+			continue
+		}
+		taken, err := x.DateTimeOriginal(loc)
+		if err != nil {
+			skip(name, err.Error())
+			continue
+		}
+		taken = taken.Add(-*offset)
+
+		maybePos, err := positionAt(conn, *user, *device, taken)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		pos, ok := maybePos.MaybeUnwrap()
+		if !ok {
+			return fmt.Errorf("no location reports for %s/%s", *user, *device)
+		}
+		if gap := time.Duration(pos.Gap) * time.Second; gap > *maxGap {
+			skip(name, fmt.Sprintf("%s gap between reports at %s", gap, taken.UTC().Format(time.RFC3339)))
+			continue
+		}
+
+		fmt.Printf("%s\t%s\t%.6f,%.6f\t%s\t±%.0fm\n", name, taken.UTC().Format(time.RFC3339), pos.Lat, pos.Lon, pos.Method, pos.Acc)
+		tagged++
+		if *dryRun {
+			continue
+		}
+		out, err := exif.SetGPS(data, exif.GPS{Lat: pos.Lat, Lon: pos.Lon, Alt: pos.Alt, Time: taken})
+		if err != nil {
+			return errors.Wrapf(err, "failed to tag %s", name)
+		}
+		if err := writeFileAtomic(path, out); err != nil {
+			return errors.Wrapf(err, "failed to write %s", name)
+		}
+	}
+	verb := "tagged"
+	if *dryRun {
+		verb = "would tag"
+	}
+	fmt.Printf("%s %d pictures, skipped %d\n", verb, tagged, skipped)
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.nkcmr.net/gotracks/internal/exif"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// testPictureJPEG returns a jpeg whose exif data only records when it was
+// taken, in the camera's local time.
+func testPictureJPEG(taken string) []byte {
+	le := binary.LittleEndian
+	tiff := []byte("II")
+	tiff = le.AppendUint16(tiff, 42)
+	tiff = le.AppendUint32(tiff, 8)
+	// IFD0 with a single DateTime entry, its value follows the IFD
+	tiff = le.AppendUint16(tiff, 1)
+	tiff = le.AppendUint16(tiff, 0x0132)
+	tiff = le.AppendUint16(tiff, 2)
+	tiff = le.AppendUint32(tiff, uint32(len(taken)+1))
+	tiff = le.AppendUint32(tiff, 8+2+12+4)
+	tiff = le.AppendUint32(tiff, 0)
+	tiff = append(tiff, taken+"\x00"...)
+
+	jpeg := []byte{0xff, 0xd8, 0xff, 0xe1}
+	jpeg = binary.BigEndian.AppendUint16(jpeg, uint16(2+6+len(tiff)))
+	jpeg = append(jpeg, "Exif\x00\x00"...)
+	jpeg = append(jpeg, tiff...)
+	return append(jpeg, 0xff, 0xd9)
+}
+
+func TestGeotagCommand(t *testing.T) {
+	cfg := testConfig(t)
+	t.Setenv("USERNAME", "alice")
+	t.Setenv("DATABASE_FILE", cfg.DatabaseFile)
+	db := testDB(t, cfg)
+	conn, err := db.Get(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get conn: %v", err)
+	}
+	userID, err := getUserID(context.Background(), conn, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.Execute(conn, `
+		INSERT INTO location_reports (user_id, device, data) VALUES
+			(?1, 'phone', '{"_type":"location","lat":52.5,"lon":13.4,"tst":1714550400}'),
+			(?1, 'phone', '{"_type":"location","lat":52.6,"lon":13.5,"tst":1714550410}')
+	`, &sqlitex.ExecOptions{Args: []any{userID}}); err != nil {
+		t.Fatal(err)
+	}
+	db.Put(conn)
+
+	dir := t.TempDir()
+	untagged := testPictureJPEG("2024:05:01 08:00:05")
+	tagged, err := exif.SetGPS(untagged, exif.GPS{Lat: 1, Lon: 1})
+	if err != nil {
+		t.Fatalf("failed to tag picture: %v", err)
+	}
+	for name, data := range map[string][]byte{"new.jpg": untagged, "old.jpg": tagged} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(name string) []byte {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	if err := geotagCommand([]string{"-device", "phone", "-tz", "UTC", dir}); err != nil {
+		t.Fatalf("geotag failed: %v", err)
+	}
+	x, err := exif.Read(read("new.jpg"))
+	if err != nil || !x.HasGPS() {
+		t.Errorf("picture without gps tags was not tagged: %v", err)
+	}
+	if !bytes.Equal(read("old.jpg"), tagged) {
+		t.Error("picture with gps tags was changed without -overwrite")
+	}
+
+	if err := geotagCommand([]string{"-device", "phone", "-tz", "UTC", "-overwrite", dir}); err != nil {
+		t.Fatalf("geotag failed: %v", err)
+	}
+	if bytes.Equal(read("old.jpg"), tagged) {
+		t.Error("picture with gps tags was not changed with -overwrite")
+	}
+	if x, err := exif.Read(read("old.jpg")); err != nil || !x.HasGPS() {
+		t.Errorf("overwritten picture has no gps tags: %v", err)
+	}
+}
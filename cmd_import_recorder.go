@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// recorderLine is a single line of an owntracks recorder .rec file:
+//
+//	<iso timestamp>\t<type>\t<json payload>
+//
+// where type is "*" for location reports.
+type recorderLine struct {
+	ts      string
+	typ     string
+	payload []byte
+}
+
+func parseRecorderLine(line []byte) (recorderLine, error) {
+	parts := bytes.SplitN(line, []byte("\t"), 3)
+	if len(parts) != 3 {
+		return recorderLine{}, fmt.Errorf("expected 3 tab separated fields, got %d", len(parts))
+	}
+	return recorderLine{
+		ts:      string(parts[0]),
+		typ:     strings.TrimSpace(string(parts[1])),
+		payload: bytes.TrimSpace(parts[2]),
+	}, nil
+}
+
+// recorderStoreRecDir finds the rec directory of a recorder store, dir may
+// either be the store itself or its rec directory.
+func recorderStoreRecDir(dir string) string {
+	if fi, err := os.Stat(filepath.Join(dir, "rec")); err == nil && fi.IsDir() {
+		return filepath.Join(dir, "rec")
+	}
+	return dir
+}
+
+// importRecorderFile imports a store/rec/<user>/<device>/YYYY-MM.rec file.
+func importRecorderFile(ctx context.Context, imp *reportImporter, user, device string, r io.Reader) (importStats, error) {
+	before := imp.stats
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		line, err := parseRecorderLine(sc.Bytes())
+		if err != nil {
+			imp.reject(err)
+			continue
+		}
+		if line.typ != "*" {
+			// not a location report
+			continue
+		}
+		otdata, err := decodeOTJSON(line.payload)
+		if err != nil {
+			imp.reject(err)
+			continue
+		}
+		loc, ok := otdata.(otLocation)
+		if !ok {
+			continue
+		}
+		if err := imp.add(ctx, user, device, loc); err != nil && !isRejected(err) {
+			return importStats{}, errors.WithStack(err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return importStats{}, errors.Wrap(err, "failed to read file")
+	}
+	if err := imp.flush(); err != nil {
+		return importStats{}, errors.WithStack(err)
+	}
+	return importStats{
+		Inserted:   imp.stats.Inserted - before.Inserted,
+		Duplicates: imp.stats.Duplicates - before.Duplicates,
+		Rejected:   imp.stats.Rejected - before.Rejected,
+	}, nil
+}
+
+func importRecorderCommand(args []string) error {
+	flags := flag.NewFlagSet("import recorder", flag.ContinueOnError)
+	batchSize := flags.Int("batch-size", 1000, "number of reports to insert per transaction")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: gotracks import recorder [flags] <store-dir>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected 1 argument, got %d", flags.NArg())
+	}
+
+	cfg, err := loadCommandConfig()
+	if err != nil {
+		return err
+	}
+	dbpool, err := openDB(cfg)
+	if err != nil {
+		return errors.Wrap(err, "failed to open db")
+	}
+	defer dbpool.Close()
+
+	ctx := context.Background()
+	conn, err := dbpool.Get(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get db conn")
+	}
+	defer dbpool.Put(conn)
+
+	imp := newReportImporter(conn, *batchSize)
+	recDir := recorderStoreRecDir(flags.Arg(0))
+	err = filepath.WalkDir(recDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".rec" {
+			return nil
+		}
+		rel, err := filepath.Rel(recDir, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) != 3 {
+			fmt.Fprintf(os.Stderr, "%s: skipped, expected <user>/<device>/YYYY-MM.rec\n", path)
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		stats, err := importRecorderFile(ctx, imp, parts[0], parts[1], f)
+		if err != nil {
+			return errors.Wrapf(err, "failed to import %s", path)
+		}
+		fmt.Printf("%s: %s\n", rel, stats)
+		return nil
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	fmt.Printf("done: %s\n", imp.stats)
+	return nil
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// takeoutSource marks reports imported from google location history.
+const takeoutSource = "google-takeout"
+
+// takeoutRecord is an entry of the "locations" array of a takeout
+// Records.json file.
+type takeoutRecord struct {
+	LatitudeE7       *int64 `json:"latitudeE7"`
+	LongitudeE7      *int64 `json:"longitudeE7"`
+	Accuracy         *int   `json:"accuracy"`
+	Altitude         *int   `json:"altitude"`
+	VerticalAccuracy *int   `json:"verticalAccuracy"`
+	Velocity         *int   `json:"velocity"`
+	Heading          *int   `json:"heading"`
+	Timestamp        string `json:"timestamp"`
+	TimestampMs      string `json:"timestampMs"`
+	Activity         []struct {
+		Activity []struct {
+			Type       string `json:"type"`
+			Confidence int    `json:"confidence"`
+		} `json:"activity"`
+	} `json:"activity"`
+}
+
+func (r takeoutRecord) toOTLocation() (otLocation, error) {
+	if r.LatitudeE7 == nil || r.LongitudeE7 == nil {
+		return nil, fmt.Errorf("missing latitudeE7/longitudeE7")
+	}
+	tst, err := takeoutTimestamp(r.Timestamp, r.TimestampMs)
+	if err != nil {
+		return nil, err
+	}
+	otdata := newImportedOTLocation(float64(*r.LatitudeE7)/1e7, float64(*r.LongitudeE7)/1e7, tst, takeoutSource)
+	if r.Accuracy != nil {
+		otdata["acc"] = float64(*r.Accuracy)
+	}
+	if r.Altitude != nil {
+		otdata["alt"] = float64(*r.Altitude)
+	}
+	if r.VerticalAccuracy != nil {
+		otdata["vac"] = float64(*r.VerticalAccuracy)
+	}
+	if r.Velocity != nil {
+		// takeout reports m/s, owntracks uses km/h
+		otdata["vel"] = float64(int(float64(*r.Velocity) * 3.6))
+	}
+	if r.Heading != nil {
+		otdata["cog"] = float64(*r.Heading)
+	}
+	if len(r.Activity) > 0 && len(r.Activity[0].Activity) > 0 {
+		otdata["motionactivities"] = []string{strings.ToLower(r.Activity[0].Activity[0].Type)}
+	}
+	return otdata, nil
+}
+
+func takeoutTimestamp(ts, tsMs string) (time.Time, error) {
+	if ts != "" {
+		t, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "invalid timestamp")
+		}
+		return t, nil
+	}
+	if tsMs != "" {
+		ms, err := strconv.ParseInt(tsMs, 10, 64)
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "invalid timestampMs")
+		}
+		return time.UnixMilli(ms), nil
+	}
+	return time.Time{}, fmt.Errorf("missing timestamp")
+}
+
+// takeoutLatLng parses the coordinates of the on-device timeline export,
+// which come as "48.1234567°, 11.1234567°" or "geo:48.123457,11.123457".
+func takeoutLatLng(s string) (Point, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "geo:")
+	lat, lon, ok := strings.Cut(strings.ReplaceAll(s, "°", ""), ",")
+	if !ok {
+		return Point{}, fmt.Errorf("invalid lat/lng: %q", s)
+	}
+	latf, err := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	if err != nil {
+		return Point{}, fmt.Errorf("invalid lat/lng: %q", s)
+	}
+	lonf, err := strconv.ParseFloat(strings.TrimSpace(lon), 64)
+	if err != nil {
+		return Point{}, fmt.Errorf("invalid lat/lng: %q", s)
+	}
+	return Point{latf, lonf}, nil
+}
+
+// takeoutLatLngField holds a timeline coordinate, which the android export
+// nests as {"latLng": "..."} and the ios export puts inline.
+type takeoutLatLngField string
+
+func (t *takeoutLatLngField) UnmarshalJSON(d []byte) error {
+	var s string
+	if err := json.Unmarshal(d, &s); err == nil {
+		*t = takeoutLatLngField(s)
+		return nil
+	}
+	var o struct {
+		LatLng string `json:"latLng"`
+	}
+	if err := json.Unmarshal(d, &o); err != nil {
+		return err
+	}
+	*t = takeoutLatLngField(o.LatLng)
+	return nil
+}
+
+// takeoutSegment is an entry of "semanticSegments" in the android on-device
+// timeline export, or of the top level array in the ios export.
+type takeoutSegment struct {
+	StartTime    time.Time `json:"startTime"`
+	EndTime      time.Time `json:"endTime"`
+	TimelinePath []struct {
+		Point      string `json:"point"`
+		Time       string `json:"time"`
+		OffsetMins string `json:"durationMinutesOffsetFromStartTime"`
+	} `json:"timelinePath"`
+	Visit *struct {
+		TopCandidate struct {
+			PlaceLocation takeoutLatLngField `json:"placeLocation"`
+		} `json:"topCandidate"`
+	} `json:"visit"`
+	Activity *struct {
+		Start        takeoutLatLngField `json:"start"`
+		End          takeoutLatLngField `json:"end"`
+		TopCandidate struct {
+			Type string `json:"type"`
+		} `json:"topCandidate"`
+	} `json:"activity"`
+}
+
+func (s takeoutSegment) toOTLocations() ([]otLocation, error) {
+	var out []otLocation
+	add := func(latLng string, tst time.Time, modify func(otLocation)) error {
+		p, err := takeoutLatLng(latLng)
+		if err != nil {
+			return err
+		}
+		otdata := newImportedOTLocation(p.Lat(), p.Lon(), tst, takeoutSource)
+		if modify != nil {
+			modify(otdata)
+		}
+		out = append(out, otdata)
+		return nil
+	}
+	for _, tp := range s.TimelinePath {
+		tst := s.StartTime
+		if tp.Time != "" {
+			t, err := time.Parse(time.RFC3339, tp.Time)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid timeline path time")
+			}
+			tst = t
+		} else if tp.OffsetMins != "" {
+			mins, err := strconv.ParseFloat(tp.OffsetMins, 64)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid timeline path offset")
+			}
+			tst = tst.Add(time.Duration(mins * float64(time.Minute)))
+		}
+		if err := add(tp.Point, tst, nil); err != nil {
+			return nil, err
+		}
+	}
+	if v := s.Visit; v != nil && v.TopCandidate.PlaceLocation != "" {
+		for _, tst := range []time.Time{s.StartTime, s.EndTime} {
+			if err := add(string(v.TopCandidate.PlaceLocation), tst, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if a := s.Activity; a != nil {
+		activity := func(o otLocation) {
+			if a.TopCandidate.Type != "" {
+				o["motionactivities"] = []string{strings.ToLower(a.TopCandidate.Type)}
+			}
+		}
+		if a.Start != "" {
+			if err := add(string(a.Start), s.StartTime, activity); err != nil {
+				return nil, err
+			}
+		}
+		if a.End != "" {
+			if err := add(string(a.End), s.EndTime, activity); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return out, nil
+}
+
+// takeoutRawSignal is an entry of "rawSignals" in the android on-device
+// timeline export, only position signals are of interest.
+type takeoutRawSignal struct {
+	Position *struct {
+		LatLng               string   `json:"LatLng"`
+		AccuracyMeters       *int     `json:"accuracyMeters"`
+		AltitudeMeters       *float64 `json:"altitudeMeters"`
+		SpeedMetersPerSecond *float64 `json:"speedMetersPerSecond"`
+		Timestamp            string   `json:"timestamp"`
+	} `json:"position"`
+}
+
+func (r takeoutRawSignal) toOTLocations() ([]otLocation, error) {
+	p := r.Position
+	if p == nil {
+		return nil, nil
+	}
+	pt, err := takeoutLatLng(p.LatLng)
+	if err != nil {
+		return nil, err
+	}
+	tst, err := takeoutTimestamp(p.Timestamp, "")
+	if err != nil {
+		return nil, err
+	}
+	otdata := newImportedOTLocation(pt.Lat(), pt.Lon(), tst, takeoutSource)
+	if p.AccuracyMeters != nil {
+		otdata["acc"] = float64(*p.AccuracyMeters)
+	}
+	if p.AltitudeMeters != nil {
+		otdata["alt"] = float64(int(*p.AltitudeMeters))
+	}
+	if p.SpeedMetersPerSecond != nil {
+		otdata["vel"] = float64(int(*p.SpeedMetersPerSecond * 3.6))
+	}
+	return []otLocation{otdata}, nil
+}
+
+// decodeTakeoutArray decodes the elements of the json array the decoder is
+// positioned at one at a time, so that the whole array never has to be held
+// in memory.
+func decodeTakeoutArray[E any](dec *json.Decoder, convert func(E) ([]otLocation, error), fn func(otLocation, error) error) error {
+	if err := expectJSONDelim(dec, '['); err != nil {
+		return err
+	}
+	if err := decodeTakeoutElements(dec, convert, fn); err != nil {
+		return err
+	}
+	return expectJSONDelim(dec, ']')
+}
+
+// decodeTakeoutElements decodes the remaining elements of the json array the
+// decoder is in.
+func decodeTakeoutElements[E any](dec *json.Decoder, convert func(E) ([]otLocation, error), fn func(otLocation, error) error) error {
+	for dec.More() {
+		var e E
+		if err := dec.Decode(&e); err != nil {
+			return errors.Wrap(err, "failed to decode array element")
+		}
+		locs, err := convert(e)
+		if err != nil {
+			if err := fn(nil, err); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, loc := range locs {
+			if err := fn(loc, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func expectJSONDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return errors.Wrap(err, "failed to read json")
+	}
+	if d, ok := tok.(json.Delim); !ok || d != want {
+		return fmt.Errorf("expected %q in json, got %v", want, tok)
+	}
+	return nil
+}
+
+// readTakeout streams the location reports out of a google takeout
+// Records.json file or an on-device timeline export. fn is called for each
+// report, or with the error for an entry that could not be converted.
+func readTakeout(r io.Reader, fn func(otLocation, error) error) error {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return errors.Wrap(err, "failed to read json")
+	}
+	switch tok {
+	case json.Delim('['):
+		// ios timeline export: a top level array of segments
+		if err := decodeTakeoutElements(dec, takeoutSegment.toOTLocations, fn); err != nil {
+			return err
+		}
+		return expectJSONDelim(dec, ']')
+	case json.Delim('{'):
+	default:
+		return fmt.Errorf("unexpected json: %v", tok)
+	}
+
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return errors.Wrap(err, "failed to read json")
+		}
+		switch key {
+		case "locations":
+			err = decodeTakeoutArray(dec, func(r takeoutRecord) ([]otLocation, error) {
+				loc, err := r.toOTLocation()
+				if err != nil {
+					return nil, err
+				}
+				return []otLocation{loc}, nil
+			}, fn)
+		case "semanticSegments":
+			err = decodeTakeoutArray(dec, takeoutSegment.toOTLocations, fn)
+		case "rawSignals":
+			err = decodeTakeoutArray(dec, takeoutRawSignal.toOTLocations, fn)
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %q", key)
+		}
+	}
+	return expectJSONDelim(dec, '}')
+}
+
+// importTakeout imports a takeout file into the given user's device.
+func importTakeout(ctx context.Context, imp *reportImporter, user, device string, r io.Reader) error {
+	var addErr error
+	err := readTakeout(r, func(loc otLocation, err error) error {
+		if err != nil {
+			imp.reject(err)
+			return nil
+		}
+		if err := imp.add(ctx, user, device, loc); err != nil && !isRejected(err) {
+			addErr = err
+			return err
+		}
+		return nil
+	})
+	if addErr != nil {
+		return imp.abort(errors.WithStack(addErr))
+	}
+	if err != nil {
+		return imp.abort(badRequest("invalid takeout file: %s", err.Error()))
+	}
+	return imp.flush()
+}
+
+func importTakeoutCommand(args []string) error {
+	flags := flag.NewFlagSet("import takeout", flag.ContinueOnError)
+	user := flags.String("user", "", "user to import the location history for (default $USERNAME)")
+	device := flags.String("device", "google", "device to import the location history into")
+	batchSize := flags.Int("batch-size", 1000, "number of reports to insert per transaction")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: gotracks import takeout [flags] <Records.json|Timeline.json>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected 1 argument, got %d", flags.NArg())
+	}
+
+	cfg, err := loadCommandConfig()
+	if err != nil {
+		return err
+	}
+	if *user == "" {
+		*user = cfg.Username
+	}
+	if *user == "" {
+		return fmt.Errorf("-user or USERNAME is required")
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return errors.Wrap(err, "failed to open takeout file")
+	}
+	defer f.Close()
+
+	dbpool, err := openDB(cfg)
+	if err != nil {
+		return errors.Wrap(err, "failed to open db")
+	}
+	defer dbpool.Close()
+
+	ctx := context.Background()
+	conn, err := dbpool.Get(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get db conn")
+	}
+	defer dbpool.Put(conn)
+
+	imp := newReportImporter(conn, *batchSize)
+	imp.onFlush = func(stats importStats) {
+		fmt.Printf("progress: %s\n", stats)
+	}
+	if err := importTakeout(ctx, imp, *user, *device, f); err != nil {
+		return errors.WithStack(err)
+	}
+	fmt.Printf("done: %s\n", imp.stats)
+	return nil
+}
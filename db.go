@@ -14,6 +14,7 @@ import (
 	"github.com/pkg/errors"
 	"zombiezen.com/go/sqlite"
 	"zombiezen.com/go/sqlite/sqlitemigration"
+	"zombiezen.com/go/sqlite/sqlitex"
 )
 
 //go:embed migrations
@@ -91,3 +92,34 @@ func openDB(cfg config) (*sqlitemigration.Pool, error) {
 	pool.Put(conn)
 	return pool, nil
 }
+
+// closeDB checkpoints the WAL into the database file before closing the pool,
+// so the file is complete on its own once the server stopped.
+func closeDB(pool *sqlitemigration.Pool) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if conn, err := pool.Get(ctx); err != nil {
+		slog.Warn("failed to get db conn for wal checkpoint", slog.String("err", err.Error()))
+	} else {
+		if err := sqlitex.ExecuteTransient(conn, "PRAGMA wal_checkpoint(TRUNCATE)", nil); err != nil {
+			slog.Warn("wal checkpoint failed", slog.String("err", err.Error()))
+		}
+		pool.Put(conn)
+	}
+	if err := pool.Close(); err != nil {
+		slog.Warn("failed to close db", slog.String("err", err.Error()))
+	}
+}
+
+// saveWrite is sqlitex.Save for savepoints that read before they write. On
+// its own it begins an immediate transaction, so it waits for the write lock
+// up front instead of failing with SQLITE_BUSY when a deferred transaction
+// cannot be upgraded, nested it is a plain savepoint of the outer
+// transaction.
+func saveWrite(conn *sqlite.Conn) (func(*error), error) {
+	if !conn.AutocommitEnabled() {
+		return sqlitex.Save(conn), nil
+	}
+	end, err := sqlitex.ImmediateTransaction(conn)
+	return end, errors.Wrap(err, "failed to begin write transaction")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.nkcmr.net/gotracks/internal/ep"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+)
+
+type BackupRequest struct{}
+
+type BackupResponse struct {
+	file *os.File
+}
+
+func AdminBackupEndpoint(r chi.Router, cfg config, db *sqlitemigration.Pool) {
+	r.With(adminOnly(cfg)).Get("/api/0/admin/backup", ep.New(
+		func(ctx context.Context, request BackupRequest) (BackupResponse, error) {
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return BackupResponse{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+
+			dir, err := os.MkdirTemp("", "gotracks-backup")
+			if err != nil {
+				return BackupResponse{}, errors.Wrap(err, "failed to create temp dir")
+			}
+			// the snapshot stays readable through the open file after the dir
+			// is gone
+			defer os.RemoveAll(dir)
+			name := filepath.Join(dir, "snapshot"+backupSuffix)
+			if err := snapshotDB(conn, name); err != nil {
+				return BackupResponse{}, errors.WithStack(err)
+			}
+			f, err := os.Open(name)
+			if err != nil {
+				return BackupResponse{}, errors.Wrap(err, "failed to open snapshot")
+			}
+			return BackupResponse{file: f}, nil
+		},
+		ep.AutoDecode[BackupRequest](),
+		func(ctx context.Context, w http.ResponseWriter, response BackupResponse) error {
+			defer response.file.Close()
+			if fi, err := response.file.Stat(); err == nil {
+				w.Header().Set("Content-Length", fmt.Sprint(fi.Size()))
+			}
+			w.Header().Set("Content-Type", "application/vnd.sqlite3")
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s%s%s"`, backupPrefix, time.Now().UTC().Format("20060102T150405Z"), backupSuffix))
+			if _, err := io.Copy(w, response.file); err != nil {
+				return errors.Wrap(err, "failed to send snapshot")
+			}
+			return nil
+		},
+	).ServeHTTP)
+}
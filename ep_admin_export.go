@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"code.nkcmr.net/gotracks/internal/basicauth"
+	"code.nkcmr.net/gotracks/internal/ep"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+)
+
+// adminOnly only lets the configured USERNAME through.
+func adminOnly(cfg config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if basicauth.VerifiedUsername(r.Context()).UnwrapOrZero() != cfg.Username {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type ExportRequest struct{}
+
+type ExportResponse struct {
+	db *sqlitemigration.Pool
+}
+
+func AdminExportEndpoint(r chi.Router, cfg config, db *sqlitemigration.Pool) {
+	r.With(adminOnly(cfg)).Get("/api/0/admin/export", ep.New(
+		func(ctx context.Context, request ExportRequest) (ExportResponse, error) {
+			return ExportResponse{db: db}, nil
+		},
+		ep.AutoDecode[ExportRequest](),
+		func(ctx context.Context, w http.ResponseWriter, response ExportResponse) error {
+			conn, err := getConn(ctx, response.db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return srvError("failed connect to db")
+			}
+			defer response.db.Put(conn)
+
+			w.Header().Set("Content-Type", "application/gzip")
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="gotracks-%s.tar.gz"`, time.Now().UTC().Format("20060102T150405Z")))
+			// the headers are already sent by the time anything could fail,
+			// a broken archive is all the client gets
+			if err := writeArchive(ctx, conn, w); err != nil {
+				slog.ErrorContext(ctx, "export failed", slog.String("err", err.Error()))
+				return errors.WithStack(err)
+			}
+			return nil
+		},
+	).ServeHTTP)
+}
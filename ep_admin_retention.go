@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"code.nkcmr.net/gotracks/internal/ep"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+)
+
+type RetentionPoliciesRequest struct{}
+
+type RetentionPoliciesResponse struct {
+	Policies []retentionPolicy `json:"policies"`
+}
+
+type DeleteRetentionPolicyRequest struct {
+	User   string `query:"user" validate:"required"`
+	Device string `query:"device"`
+}
+
+type DeleteRetentionPolicyResponse struct {
+	Deleted bool `json:"deleted"`
+}
+
+type RetentionReportRequest struct{}
+
+type RetentionReportResponse struct {
+	Results []retentionResult `json:"results"`
+}
+
+func AdminRetentionEndpoint(r chi.Router, cfg config, db *sqlitemigration.Pool) {
+	r.With(adminOnly(cfg)).Get("/api/0/admin/retention", ep.New(
+		func(ctx context.Context, request RetentionPoliciesRequest) (RetentionPoliciesResponse, error) {
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return RetentionPoliciesResponse{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+			policies, err := listRetentionPolicies(conn)
+			if err != nil {
+				return RetentionPoliciesResponse{}, errors.WithStack(err)
+			}
+			return RetentionPoliciesResponse{Policies: policies}, nil
+		},
+		ep.AutoDecode[RetentionPoliciesRequest](),
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+
+	r.With(adminOnly(cfg)).Put("/api/0/admin/retention", ep.New(
+		func(ctx context.Context, request retentionPolicy) (retentionPolicy, error) {
+			if err := request.validate(); err != nil {
+				return retentionPolicy{}, err
+			}
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return retentionPolicy{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+			if err := saveRetentionPolicy(conn, request); err != nil {
+				return retentionPolicy{}, errors.WithStack(err)
+			}
+			return request, nil
+		},
+		ep.AutoDecode[retentionPolicy](),
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+
+	r.With(adminOnly(cfg)).Delete("/api/0/admin/retention", ep.New(
+		func(ctx context.Context, request DeleteRetentionPolicyRequest) (DeleteRetentionPolicyResponse, error) {
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return DeleteRetentionPolicyResponse{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+			deleted, err := deleteRetentionPolicy(conn, request.User, request.Device)
+			if err != nil {
+				return DeleteRetentionPolicyResponse{}, errors.WithStack(err)
+			}
+			return DeleteRetentionPolicyResponse{Deleted: deleted}, nil
+		},
+		ep.AutoDecode[DeleteRetentionPolicyRequest](),
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+
+	r.With(adminOnly(cfg)).Get("/api/0/admin/retention/report", ep.New(
+		func(ctx context.Context, request RetentionReportRequest) (RetentionReportResponse, error) {
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return RetentionReportResponse{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+			results, err := applyRetention(ctx, conn, time.Now(), true)
+			if err != nil {
+				return RetentionReportResponse{}, errors.WithStack(err)
+			}
+			return RetentionReportResponse{Results: results}, nil
+		},
+		ep.AutoDecode[RetentionReportRequest](),
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"code.nkcmr.net/gotracks/internal/ep"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+)
+
+type AlertsRequest struct {
+	User   string `query:"user" validate:"required"`
+	Device string `query:"device"`
+	// State is "firing" or "resolved", all alerts are listed when empty.
+	State string `query:"state" validate:"enum=firing|resolved"`
+}
+
+type AlertsResponse struct {
+	Alerts []alert `json:"alerts"`
+}
+
+func AlertsEndpoint(r chi.Router, db *sqlitemigration.Pool) {
+	r.Get("/api/0/alerts", ep.New(
+		func(ctx context.Context, request AlertsRequest) (AlertsResponse, error) {
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return AlertsResponse{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+			alerts, err := listAlerts(conn, request.User, request.Device, request.State)
+			if err != nil {
+				return AlertsResponse{}, errors.WithStack(err)
+			}
+			return AlertsResponse{Alerts: alerts}, nil
+		},
+		ep.AutoDecode[AlertsRequest](),
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"code.nkcmr.net/gotracks/internal/ep"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+)
+
+type AtRequest struct {
+	User   string `query:"user" validate:"required"`
+	Device string `query:"device" validate:"required"`
+	T      string `query:"t" validate:"required"`
+}
+
+type AtBatchRequest struct {
+	User   string `json:"user" validate:"required"`
+	Device string `json:"device" validate:"required"`
+	// T holds unix timestamps or time strings, like the t query parameter.
+	T []json.RawMessage `json:"t"`
+}
+
+type AtBatchResponse struct {
+	// Positions has a position, or null when the device has no reports, for
+	// each requested time.
+	Positions []*Position `json:"positions"`
+}
+
+// parseAtTime parses unix seconds, RFC 3339 or the UTC "2006-01-02T15:04:05"
+// format the locations endpoint uses.
+func parseAtTime(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02T15:04:05", s, time.UTC)
+	if err != nil {
+		return time.Time{}, badRequest("invalid time %q, expected unix seconds or RFC 3339", s)
+	}
+	return t, nil
+}
+
+func AtEndpoint(r chi.Router, db *sqlitemigration.Pool) {
+	r.Get("/api/0/at", ep.New(
+		func(ctx context.Context, request AtRequest) (Position, error) {
+			t, err := parseAtTime(request.T)
+			if err != nil {
+				return Position{}, err
+			}
+
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return Position{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+
+			pos, err := positionAt(conn, request.User, request.Device, t)
+			if err != nil {
+				return Position{}, errors.WithStack(err)
+			}
+			p, ok := pos.MaybeUnwrap()
+			if !ok {
+				return Position{}, notFound("no reports for %s/%s", request.User, request.Device)
+			}
+			return p, nil
+		},
+		ep.AutoDecode[AtRequest](),
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+
+	r.Post("/api/0/at", ep.New(
+		func(ctx context.Context, request AtBatchRequest) (AtBatchResponse, error) {
+			times := make([]time.Time, len(request.T))
+			for i, raw := range request.T {
+				var s string
+				if err := json.Unmarshal(raw, &s); err != nil {
+					s = string(raw)
+				}
+				t, err := parseAtTime(s)
+				if err != nil {
+					return AtBatchResponse{}, err
+				}
+				times[i] = t
+			}
+
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return AtBatchResponse{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+
+			resp := AtBatchResponse{Positions: make([]*Position, len(times))}
+			for i, t := range times {
+				pos, err := positionAt(conn, request.User, request.Device, t)
+				if err != nil {
+					return AtBatchResponse{}, errors.WithStack(err)
+				}
+				if p, ok := pos.MaybeUnwrap(); ok {
+					resp.Positions[i] = &p
+				}
+			}
+			return resp, nil
+		},
+		ep.AutoDecode[AtBatchRequest](),
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"code.nkcmr.net/gotracks/internal/ep"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+type FeedsRequest struct {
+	User string `query:"user" validate:"required"`
+}
+
+type FeedsResponse struct {
+	Feeds []feedToken `json:"feeds"`
+}
+
+type CreateFeedRequest struct {
+	User string `json:"user" validate:"required"`
+	// Device limits the feed to one device, all of the user's devices are
+	// included when it is empty.
+	Device string `json:"device"`
+	Name   string `json:"name"`
+}
+
+type CreateFeedResponse struct {
+	feedToken
+	// Path is where calendar apps can subscribe to the feed, it has the
+	// token in it so it has to be kept secret.
+	Path string `json:"path"`
+}
+
+type DeleteFeedRequest struct {
+	ID int64 `route:"id"`
+}
+
+type DeleteFeedResponse struct {
+	Deleted bool `json:"deleted"`
+}
+
+type FeedRequest struct {
+	Token string `route:"token"`
+	// Days is how far back the feed goes, 30 days by default and at most
+	// feedMaxDays.
+	Days  int  `query:"days" validate:"min=1,max=366"`
+	Trips bool `query:"trips"`
+}
+
+type FeedResponse struct {
+	name   string
+	events []calendarEvent
+}
+
+// FeedsEndpoint registers the endpoints to manage feed tokens, they need the
+// same authentication as the rest of the api.
+func FeedsEndpoint(r chi.Router, db *sqlitemigration.Pool) {
+	r.Get("/api/0/feeds", ep.New(
+		func(ctx context.Context, request FeedsRequest) (FeedsResponse, error) {
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return FeedsResponse{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+			tokens, err := listFeedTokens(conn, request.User)
+			if err != nil {
+				return FeedsResponse{}, errors.WithStack(err)
+			}
+			return FeedsResponse{Feeds: tokens}, nil
+		},
+		ep.AutoDecode[FeedsRequest](),
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+
+	r.Post("/api/0/feeds", ep.New(
+		func(ctx context.Context, request CreateFeedRequest) (CreateFeedResponse, error) {
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return CreateFeedResponse{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+			ft, err := createFeedToken(conn, request.User, request.Device, request.Name, time.Now())
+			if err != nil {
+				return CreateFeedResponse{}, errors.WithStack(err)
+			}
+			return CreateFeedResponse{feedToken: ft, Path: ft.path()}, nil
+		},
+		ep.AutoDecode[CreateFeedRequest](),
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+
+	r.Delete("/api/0/feeds/{id}", ep.New(
+		func(ctx context.Context, request DeleteFeedRequest) (DeleteFeedResponse, error) {
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return DeleteFeedResponse{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+			if err := sqlitex.Execute(conn, "DELETE FROM feed_tokens WHERE id = ?1", &sqlitex.ExecOptions{
+				Args: []any{request.ID},
+			}); err != nil {
+				return DeleteFeedResponse{}, errors.Wrap(err, "failed to delete feed token")
+			}
+			return DeleteFeedResponse{Deleted: conn.Changes() > 0}, nil
+		},
+		ep.AutoDecode[DeleteFeedRequest](),
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+}
+
+// FeedEndpoint serves the calendar feeds, it is authenticated by the token in
+// the path alone because calendar apps rarely support basic auth.
+func FeedEndpoint(r chi.Router, db *sqlitemigration.Pool) {
+	r.Get("/api/0/feed/{token}.ics", ep.New(
+		func(ctx context.Context, request FeedRequest) (FeedResponse, error) {
+			if request.Days == 0 {
+				request.Days = feedDefaultDays
+			}
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return FeedResponse{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+
+			now := time.Now()
+			found, err := useFeedToken(conn, request.Token, now)
+			if err != nil {
+				return FeedResponse{}, errors.WithStack(err)
+			}
+			ft, ok := found.MaybeUnwrap()
+			if !ok {
+				return FeedResponse{}, notFound("no such feed")
+			}
+			events, err := feedEvents(conn, ft, now.AddDate(0, 0, -request.Days), now, request.Trips)
+			if err != nil {
+				return FeedResponse{}, errors.WithStack(err)
+			}
+			name := ft.Name
+			if name == "" {
+				name = ft.User
+				if ft.Device != "" {
+					name = fmt.Sprintf("%s/%s", ft.User, ft.Device)
+				}
+			}
+			return FeedResponse{name: name, events: events}, nil
+		},
+		ep.AutoDecode[FeedRequest](),
+		func(ctx context.Context, w http.ResponseWriter, response FeedResponse) error {
+			w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+			w.Header().Set("Cache-Control", "private, max-age=300")
+			return writeCalendar(w, response.name, response.events, time.Now())
+		},
+	).ServeHTTP)
+}
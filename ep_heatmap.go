@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"log/slog"
+	"net/http"
+
+	"code.nkcmr.net/gotracks/internal/ep"
+	"code.nkcmr.net/opt"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+)
+
+type HeatmapRequest struct {
+	User   string `query:"user" validate:"required"`
+	Device string `query:"device"`
+	// From and To take the same formats as the t parameter of /api/0/at.
+	From string `query:"from"`
+	To   string `query:"to"`
+	BBox string `query:"bbox"`
+	// Cell is "geohash" (the default) or "tile".
+	Cell      string `query:"cell" validate:"enum=geohash|tile"`
+	Precision int    `query:"precision" validate:"min=1,max=7"`
+	// Zoom is bounded by maxTileZoom.
+	Zoom int `query:"zoom" validate:"min=0,max=22"`
+}
+
+type HeatmapResponse struct {
+	Cells []heatmapCell `json:"cells"`
+	// Total is the number of reports in all cells, Max the number in the
+	// densest one.
+	Total int `json:"total"`
+	Max   int `json:"max"`
+}
+
+type HeatmapTileRequest struct {
+	User   string `query:"user" validate:"required"`
+	Device string `query:"device"`
+	From   string `query:"from"`
+	To     string `query:"to"`
+	Z      int    `route:"z" validate:"min=0,max=22"`
+	X      int    `route:"x"`
+	Y      int    `route:"y"`
+}
+
+type HeatmapTileResponse struct {
+	png []byte
+}
+
+func parseHeatmapFilter(user, device, from, to string) (heatmapFilter, error) {
+	f := heatmapFilter{
+		user:   user,
+		device: device,
+		from:   opt.None[int64](),
+		to:     opt.None[int64](),
+		bbox:   opt.None[[4]float64](),
+	}
+	if from != "" {
+		t, err := parseAtTime(from)
+		if err != nil {
+			return heatmapFilter{}, err
+		}
+		f.from = opt.Some(t.Unix())
+	}
+	if to != "" {
+		t, err := parseAtTime(to)
+		if err != nil {
+			return heatmapFilter{}, err
+		}
+		f.to = opt.Some(t.Unix())
+	}
+	return f, nil
+}
+
+func encodePNGResponse(ctx context.Context, w http.ResponseWriter, img []byte) error {
+	w.Header().Set("Content-Type", "image/png")
+	if _, err := w.Write(img); err != nil {
+		return errors.Wrap(err, "failed to send image")
+	}
+	return nil
+}
+
+func HeatmapEndpoint(r chi.Router, db *sqlitemigration.Pool) {
+	r.Get("/api/0/heatmap", ep.New(
+		func(ctx context.Context, request HeatmapRequest) (HeatmapResponse, error) {
+			f, err := parseHeatmapFilter(request.User, request.Device, request.From, request.To)
+			if err != nil {
+				return HeatmapResponse{}, err
+			}
+			if request.BBox != "" {
+				bbox, err := parseBBox(request.BBox)
+				if err != nil {
+					return HeatmapResponse{}, err
+				}
+				f.bbox = opt.Some(bbox)
+			}
+			if request.Precision == 0 {
+				request.Precision = 5
+			}
+
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return HeatmapResponse{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+
+			var cells []heatmapCell
+			if request.Cell == "tile" {
+				cells, err = heatmapTileCells(conn, f, request.Zoom)
+			} else {
+				cells, err = heatmapGeohashCells(conn, f, request.Precision)
+			}
+			if err != nil {
+				return HeatmapResponse{}, errors.WithStack(err)
+			}
+			resp := HeatmapResponse{Cells: cells}
+			for _, c := range cells {
+				resp.Total += c.Count
+				resp.Max = max(resp.Max, c.Count)
+			}
+			return resp, nil
+		},
+		ep.AutoDecode[HeatmapRequest](),
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+
+	r.Get("/api/0/heatmap/{z}/{x}/{y}.png", ep.New(
+		func(ctx context.Context, request HeatmapTileRequest) (HeatmapTileResponse, error) {
+			f, err := parseHeatmapFilter(request.User, request.Device, request.From, request.To)
+			if err != nil {
+				return HeatmapTileResponse{}, err
+			}
+			t := tile{z: request.Z, x: request.X, y: request.Y}
+			if !t.valid() {
+				return HeatmapTileResponse{}, badRequest("invalid tile %s", t)
+			}
+			minLat, minLon, maxLat, maxLon := t.bounds(heatRadius)
+			f.bbox = opt.Some([4]float64{minLat, minLon, maxLat, maxLon})
+
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return HeatmapTileResponse{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+
+			layer := newHeatLayer(t)
+			if err := heatmapPoints(conn, f, layer.add); err != nil {
+				return HeatmapTileResponse{}, errors.WithStack(err)
+			}
+			img := image.NewNRGBA(image.Rect(0, 0, tileSize, tileSize))
+			layer.draw(img)
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, img); err != nil {
+				return HeatmapTileResponse{}, errors.Wrap(err, "failed to encode tile")
+			}
+			return HeatmapTileResponse{png: buf.Bytes()}, nil
+		},
+		ep.AutoDecode[HeatmapTileRequest](),
+		func(ctx context.Context, w http.ResponseWriter, response HeatmapTileResponse) error {
+			return encodePNGResponse(ctx, w, response.png)
+		},
+	).ServeHTTP)
+}
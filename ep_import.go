@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+
+	"code.nkcmr.net/gotracks/internal/basicauth"
+	"code.nkcmr.net/gotracks/internal/ep"
+
+	"github.com/go-chi/chi/v5"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+)
+
+type ImportRequest struct {
+	User   string `query:"user"`
+	Device string `query:"device" validate:"required"`
+	// Format defaults to the one of the upload's content type.
+	Format string `query:"format" validate:"enum=gpx|kml|geojson"`
+	DryRun bool   `query:"dry_run"`
+
+	contentType string
+	body        io.ReadCloser
+}
+
+type ImportResponse struct {
+	DryRun bool `json:"dry_run"`
+	importStats
+}
+
+// trackFileContentTypes maps upload content types to a trackFileReaders
+// format, for uploads that do not say so with the format parameter.
+var trackFileContentTypes = map[string]string{
+	"application/gpx+xml":                  "gpx",
+	"application/vnd.google-earth.kml+xml": "kml",
+	"application/geo+json":                 "geojson",
+	"application/json":                     "geojson",
+}
+
+func ImportEndpoint(r chi.Router, db *sqlitemigration.Pool) {
+	decodeQuery := ep.AutoDecode[ImportRequest]()
+	r.Post("/api/0/import", ep.New(
+		func(ctx context.Context, request ImportRequest) (ImportResponse, error) {
+			defer request.body.Close()
+			verified := basicauth.VerifiedUsername(ctx).UnwrapOrZero()
+			if request.User == "" {
+				request.User = verified
+			}
+			if request.User != verified {
+				return ImportResponse{}, badRequest("input data and auth data mismatch")
+			}
+
+			format := request.Format
+			if format == "" {
+				mt, _, _ := mime.ParseMediaType(request.contentType)
+				format = trackFileContentTypes[mt]
+			}
+			read, ok := trackFileReaders[format]
+			if !ok {
+				return ImportResponse{}, badRequest("unknown file format, pass the format or upload with a gpx, kml or geojson content type")
+			}
+
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return ImportResponse{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+
+			imp := newReportImporter(conn, 1000)
+			imp.dryRun = request.DryRun
+			if err := importTrackFile(ctx, imp, read, request.User, request.Device, request.body); err != nil {
+				return ImportResponse{}, err
+			}
+			return ImportResponse{
+				DryRun:      request.DryRun,
+				importStats: imp.stats,
+			}, nil
+		},
+		func(ctx context.Context, r *http.Request) (ImportRequest, error) {
+			req, err := decodeQuery(ctx, r)
+			if err != nil {
+				return ImportRequest{}, err
+			}
+			req.contentType = r.Header.Get("Content-Type")
+			req.body = r.Body
+			return req, nil
+		},
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"code.nkcmr.net/gotracks/internal/basicauth"
+	"code.nkcmr.net/gotracks/internal/ep"
+
+	"github.com/go-chi/chi/v5"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+)
+
+type TakeoutImportRequest struct {
+	Device string `query:"device"`
+
+	// body is streamed straight into the importer as takeout files can be
+	// several gigabytes large
+	body io.ReadCloser
+}
+
+type TakeoutImportResponse struct {
+	importStats
+}
+
+func TakeoutImportEndpoint(r chi.Router, db *sqlitemigration.Pool) {
+	decodeQuery := ep.AutoDecode[TakeoutImportRequest]()
+	r.Post("/api/0/import/takeout", ep.New(
+		func(ctx context.Context, request TakeoutImportRequest) (TakeoutImportResponse, error) {
+			defer request.body.Close()
+			// the route is behind basic auth, so there always is a user
+			user := basicauth.VerifiedUsername(ctx).UnwrapOrZero()
+			if request.Device == "" {
+				request.Device = "google"
+			}
+
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return TakeoutImportResponse{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+
+			imp := newReportImporter(conn, 1000)
+			if err := importTakeout(ctx, imp, user, request.Device, request.body); err != nil {
+				return TakeoutImportResponse{}, err
+			}
+			return TakeoutImportResponse{imp.stats}, nil
+		},
+		func(ctx context.Context, r *http.Request) (TakeoutImportRequest, error) {
+			req, err := decodeQuery(ctx, r)
+			if err != nil {
+				return TakeoutImportRequest{}, err
+			}
+			req.body = r.Body
+			return req, nil
+		},
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+}
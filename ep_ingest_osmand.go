@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.nkcmr.net/gotracks/internal/ep"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+)
+
+// OsmAndRequest is a location report in the OsmAnd protocol spoken by Traccar
+// Client and GPSLogger. Reports are sent either as query strings or as url
+// encoded forms.
+type OsmAndRequest struct {
+	ID        string
+	Token     string
+	Lat       string
+	Lon       string
+	Timestamp string
+	Speed     string
+	Bearing   string
+	Altitude  string
+	Accuracy  string
+	Batt      string
+}
+
+type OsmAndResponse struct{}
+
+func decodeOsmAndRequest(_ context.Context, r *http.Request) (OsmAndRequest, error) {
+	if err := r.ParseForm(); err != nil {
+		return OsmAndRequest{}, badRequest("failed to parse form: %s", err.Error())
+	}
+	first := func(keys ...string) string {
+		for _, k := range keys {
+			if v := r.Form.Get(k); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	return OsmAndRequest{
+		ID:        first("id", "deviceid"),
+		Token:     first("token"),
+		Lat:       first("lat"),
+		Lon:       first("lon"),
+		Timestamp: first("timestamp"),
+		Speed:     first("speed"),
+		Bearing:   first("bearing"),
+		Altitude:  first("altitude"),
+		Accuracy:  first("accuracy"),
+		Batt:      first("batt"),
+	}, nil
+}
+
+// osmAndTimestamp parses the different ways the OsmAnd protocol clients send
+// timestamps: unix seconds, unix milliseconds or a date string.
+func osmAndTimestamp(s string) (time.Time, error) {
+	if s == "" {
+		return time.Now(), nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n > 1e12 {
+			return time.UnixMilli(n), nil
+		}
+		return time.Unix(n, 0), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, badRequest("invalid timestamp: %q", s)
+}
+
+func (o OsmAndRequest) toOTLocation() (otLocation, error) {
+	lat, err := strconv.ParseFloat(o.Lat, 64)
+	if err != nil {
+		return nil, badRequest("invalid lat: %q", o.Lat)
+	}
+	lon, err := strconv.ParseFloat(o.Lon, 64)
+	if err != nil {
+		return nil, badRequest("invalid lon: %q", o.Lon)
+	}
+	tst, err := osmAndTimestamp(o.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	otdata := otLocation{
+		"_type": "location",
+		"lat":   lat,
+		"lon":   lon,
+		"tst":   float64(tst.Unix()),
+	}
+	optional := []struct {
+		key   string
+		value string
+		scale float64
+	}{
+		// the osmand protocol reports speed in knots, owntracks uses km/h
+		{"vel", o.Speed, 1.852},
+		{"cog", o.Bearing, 1},
+		{"alt", o.Altitude, 1},
+		{"acc", o.Accuracy, 1},
+		{"batt", o.Batt, 1},
+	}
+	for _, f := range optional {
+		if f.value == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(f.value, 64)
+		if err != nil {
+			return nil, badRequest("invalid %s: %q", f.key, f.value)
+		}
+		otdata[f.key] = float64(int(v * f.scale))
+	}
+	return otdata, nil
+}
+
+// osmAndDeviceUser returns the user the device with the given id reports for,
+// if token is the one configured for it.
+func osmAndDeviceUser(devices map[string]string, id, token string) (string, bool) {
+	user, want, _ := strings.Cut(devices[id], ":")
+	if user == "" || want == "" || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+		return "", false
+	}
+	return user, true
+}
+
+func OsmAndIngestEndpoint(r chi.Router, cfg config, liveLoc *liveLocations, db *sqlitemigration.Pool) {
+	h := ep.New(
+		func(ctx context.Context, request OsmAndRequest) (OsmAndResponse, error) {
+			if request.ID == "" {
+				return OsmAndResponse{}, badRequest("id input is required")
+			}
+			user, ok := osmAndDeviceUser(cfg.OsmAndDevices, request.ID, request.Token)
+			if !ok {
+				return OsmAndResponse{}, unauthorized("unknown device id or wrong token")
+			}
+
+			otdata, err := request.toOTLocation()
+			if err != nil {
+				return OsmAndResponse{}, err
+			}
+			if err := enrichOTLocationData(ctx, user, request.ID, otdata); err != nil {
+				return OsmAndResponse{}, errors.WithStack(err)
+			}
+			// relayed to the mqtt broker like reports published to /pub
+			otdata["_http"] = true
+
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return OsmAndResponse{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+
+			status, err := recordReport(ctx, conn, cfg.Plausibility, user, request.ID, otdata)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return OsmAndResponse{}, srvError("failed to talk to db")
+			}
+			if status.live() {
+				liveLoc.goBroadcast(ctx, otdata)
+			}
+
+			return OsmAndResponse{}, nil
+		},
+		decodeOsmAndRequest,
+		ep.EncodeJSONResponse,
+	).ServeHTTP
+	r.Get("/api/0/ingest/osmand", h)
+	r.Post("/api/0/ingest/osmand", h)
+}
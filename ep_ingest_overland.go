@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"code.nkcmr.net/gotracks/internal/basicauth"
+	"code.nkcmr.net/gotracks/internal/ep"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+)
+
+type OverlandRequest struct {
+	Locations []overlandFeature `json:"locations"`
+	Device    string            `query:"device"`
+}
+
+type overlandFeature struct {
+	Geometry struct {
+		Type        string    `json:"type"`
+		Coordinates []float64 `json:"coordinates"`
+	} `json:"geometry"`
+	Properties struct {
+		Timestamp          string   `json:"timestamp"`
+		Altitude           *float64 `json:"altitude"`
+		Speed              *float64 `json:"speed"`
+		Course             *float64 `json:"course"`
+		HorizontalAccuracy *float64 `json:"horizontal_accuracy"`
+		VerticalAccuracy   *float64 `json:"vertical_accuracy"`
+		Motion             []string `json:"motion"`
+		BatteryState       string   `json:"battery_state"`
+		BatteryLevel       *float64 `json:"battery_level"`
+		DeviceID           string   `json:"device_id"`
+		WiFi               string   `json:"wifi"`
+	} `json:"properties"`
+}
+
+type OverlandResponse struct {
+	Result string `json:"result"`
+}
+
+// overlandBatteryStatus maps overland battery states to the owntracks "bs"
+// values.
+var overlandBatteryStatus = map[string]int{
+	"unknown":   0,
+	"unplugged": 1,
+	"charging":  2,
+	"full":      3,
+}
+
+// overlandTimestampLayouts are the ISO 8601 variants overland has been seen
+// to send.
+var overlandTimestampLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05Z0700",
+}
+
+// toOTLocation converts an overland GeoJSON feature into the owntracks
+// location shape.
+func (f overlandFeature) toOTLocation() (otLocation, error) {
+	if f.Geometry.Type != "Point" || len(f.Geometry.Coordinates) < 2 {
+		return nil, badRequest("unsupported geometry: %q", f.Geometry.Type)
+	}
+	p := f.Properties
+	var tst time.Time
+	for _, layout := range overlandTimestampLayouts {
+		var err error
+		if tst, err = time.Parse(layout, p.Timestamp); err == nil {
+			break
+		}
+	}
+	if tst.IsZero() {
+		return nil, badRequest("invalid timestamp: %q", p.Timestamp)
+	}
+	otdata := otLocation{
+		"_type": "location",
+		"lat":   f.Geometry.Coordinates[1],
+		"lon":   f.Geometry.Coordinates[0],
+		"tst":   float64(tst.Unix()),
+	}
+	if p.HorizontalAccuracy != nil && *p.HorizontalAccuracy >= 0 {
+		otdata["acc"] = float64(int(*p.HorizontalAccuracy))
+	}
+	if p.VerticalAccuracy != nil && *p.VerticalAccuracy >= 0 {
+		otdata["vac"] = float64(int(*p.VerticalAccuracy))
+	}
+	if p.Altitude != nil {
+		otdata["alt"] = float64(int(*p.Altitude))
+	}
+	if p.Speed != nil && *p.Speed >= 0 {
+		// overland reports m/s, owntracks uses km/h
+		otdata["vel"] = float64(int(*p.Speed * 3.6))
+	}
+	if p.Course != nil && *p.Course >= 0 {
+		otdata["cog"] = float64(int(*p.Course))
+	}
+	if p.BatteryLevel != nil && *p.BatteryLevel >= 0 {
+		otdata["batt"] = float64(int(*p.BatteryLevel * 100))
+	}
+	if bs, ok := overlandBatteryStatus[p.BatteryState]; ok {
+		otdata["bs"] = float64(bs)
+	}
+	if p.WiFi != "" {
+		otdata["SSID"] = p.WiFi
+	}
+	if len(p.Motion) > 0 {
+		otdata["motionactivities"] = p.Motion
+	}
+	return otdata, nil
+}
+
+func OverlandIngestEndpoint(r chi.Router, cfg config, liveLoc *liveLocations, db *sqlitemigration.Pool) {
+	r.
+		With(
+			middleware.AllowContentType("application/json"),
+		).
+		Post("/api/0/ingest/overland", ep.New(
+			func(ctx context.Context, request OverlandRequest) (OverlandResponse, error) {
+				user := basicauth.VerifiedUsername(ctx).UnwrapOrZero()
+				if user == "" {
+					return OverlandResponse{}, badRequest("user is required")
+				}
+
+				type report struct {
+					device string
+					otdata otLocation
+					status reportStatus
+				}
+				reports := make([]report, 0, len(request.Locations))
+				for i, f := range request.Locations {
+					otdata, err := f.toOTLocation()
+					if err != nil {
+						// rejecting the batch would make overland retry it
+						// forever, so bad points are dropped instead
+						slog.WarnContext(ctx, "skipping invalid overland location",
+							slog.Int("idx", i),
+							slog.String("err", err.Error()),
+						)
+						continue
+					}
+					device := f.Properties.DeviceID
+					if device == "" {
+						device = request.Device
+					}
+					if device == "" {
+						return OverlandResponse{}, badRequest("device_id or device input is required")
+					}
+					if err := enrichOTLocationData(ctx, user, device, otdata); err != nil {
+						slog.WarnContext(ctx, "skipping overland location that failed to enrich",
+							slog.Int("idx", i),
+							slog.String("err", err.Error()),
+						)
+						continue
+					}
+					// relayed to the mqtt broker like reports published to /pub
+					otdata["_http"] = true
+					reports = append(reports, report{device: device, otdata: otdata})
+				}
+
+				conn, err := getConn(ctx, db)
+				if err != nil {
+					slog.Error("db error", slog.String("err", err.Error()))
+					return OverlandResponse{}, srvError("failed connect to db")
+				}
+				defer db.Put(conn)
+
+				err = func() (err error) {
+					release, err := saveWrite(conn)
+					if err != nil {
+						return err
+					}
+					defer release(&err)
+					for i, r := range reports {
+						if reports[i].status, err = recordReport(ctx, conn, cfg.Plausibility, user, r.device, r.otdata); err != nil {
+							return errors.WithStack(err)
+						}
+					}
+					return nil
+				}()
+				if err != nil {
+					slog.Error("db error", slog.String("err", err.Error()))
+					return OverlandResponse{}, srvError("failed to talk to db")
+				}
+
+				var live []otLocation
+				for _, r := range reports {
+					if r.status.live() {
+						live = append(live, r.otdata)
+					}
+				}
+				liveLoc.goBroadcast(ctx, live...)
+
+				return OverlandResponse{
+					Result: "ok",
+				}, nil
+			},
+			ep.AutoDecode[OverlandRequest](),
+			ep.EncodeJSONResponse,
+		).ServeHTTP)
+}
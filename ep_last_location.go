@@ -19,6 +19,9 @@ import (
 type LastLocationRequest struct {
 	User   string `query:"user"`
 	Device string `query:"device"`
+
+	// Outliers includes reports that failed the plausibility filter.
+	Outliers bool `query:"outliers"`
 }
 
 type LastLocationResponse struct {
@@ -47,10 +50,10 @@ func mapSlice[S ~[]I, I, O any](s S, mf func(I) O) []O {
 	return out
 }
 
-func LastLocationEndpoint(r *chi.Mux, db *sqlitemigration.Pool) {
+func LastLocationEndpoint(r chi.Router, db *sqlitemigration.Pool) {
 	r.Get("/api/0/last", ep.New(
 		func(ctx context.Context, request LastLocationRequest) (LastLocationResponse, error) {
-			conn, err := db.Get(ctx)
+			conn, err := getConn(ctx, db)
 			if err != nil {
 				return LastLocationResponse{}, errors.Wrap(err, "failed to get db conn")
 			}
@@ -59,6 +62,7 @@ func LastLocationEndpoint(r *chi.Mux, db *sqlitemigration.Pool) {
 			locs, err := lastLocation(
 				ctx, conn,
 				optFromZero(request.User), optFromZero(request.Device),
+				request.Outliers,
 			)
 			if err != nil {
 				return LastLocationResponse{}, errors.WithStack(err)
@@ -77,10 +81,13 @@ func LastLocationEndpoint(r *chi.Mux, db *sqlitemigration.Pool) {
 func lastLocation(
 	_ context.Context, conn *sqlite.Conn,
 	user, device opt.Option[string],
+	includeOutliers bool,
 ) ([]otLocation, error) {
 	const query = `
 		WITH last_location_report AS (
-			SELECT MAX(id) AS id
+			-- the newest report by tst, out of order and imported reports
+			-- may have been inserted after it
+			SELECT id, MAX(json_extract(data, '$.tst'))
 			FROM location_reports
 			WHERE %s
 			GROUP BY user_id, device
@@ -101,6 +108,9 @@ func lastLocation(
 		conds = append(conds, "device = ?2")
 		args = append(args, d)
 	}
+	if !includeOutliers {
+		conds = append(conds, "json_extract(data, '$.outlier') IS NULL")
+	}
 	if len(conds) == 0 {
 		conds = []string{"1 = 1"}
 	}
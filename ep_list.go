@@ -22,10 +22,10 @@ type ListResponse struct {
 	Results []string `json:"results"`
 }
 
-func ListEndpoint(r *chi.Mux, db *sqlitemigration.Pool) {
+func ListEndpoint(r chi.Router, db *sqlitemigration.Pool) {
 	r.Get("/api/0/list", ep.New(
 		func(ctx context.Context, request ListRequest) (ListResponse, error) {
-			conn, err := db.Get(ctx)
+			conn, err := getConn(ctx, db)
 			if err != nil {
 				return ListResponse{}, errors.Wrap(err, "failed to get db conn")
 			}
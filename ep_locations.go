@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"code.nkcmr.net/gotracks/internal/ep"
+	"code.nkcmr.net/opt"
 	"github.com/go-chi/chi/v5"
 	"github.com/pkg/errors"
 	"zombiezen.com/go/sqlite"
@@ -17,11 +18,14 @@ import (
 )
 
 type LocationsRequest struct {
-	From   string `query:"from"`
-	To     string `query:"to"`
-	User   string `query:"user"`
-	Device string `query:"device"`
-	Format string `query:"format"`
+	From   opt.Option[time.Time] `query:"from" layout:"2006-01-02T15:04:05"`
+	To     opt.Option[time.Time] `query:"to" layout:"2006-01-02T15:04:05"`
+	User   string                `query:"user"`
+	Device string                `query:"device"`
+	Format string                `query:"format" validate:"enum=json"`
+
+	// Outliers includes reports that failed the plausibility filter.
+	Outliers bool `query:"outliers"`
 }
 
 type LocationsResponse struct {
@@ -33,15 +37,9 @@ type LocationsResponse struct {
 
 type LocationsResponse_Data map[string]any
 
-func LocationsEndpoint(r *chi.Mux, db *sqlitemigration.Pool) {
+func LocationsEndpoint(r chi.Router, db *sqlitemigration.Pool) {
 	r.Get("/api/0/locations", ep.New(
 		func(ctx context.Context, request LocationsRequest) (LocationsResponse, error) {
-			switch request.Format {
-			case "", "json":
-			default:
-				return LocationsResponse{}, badRequest("unsupported format: %q", request.Format)
-			}
-
 			const query = `
 				SELECT lr.data
 				FROM location_reports AS lr
@@ -54,20 +52,11 @@ func LocationsEndpoint(r *chi.Mux, db *sqlitemigration.Pool) {
 
 			slog.InfoContext(ctx, "locations_query_params", slog.Any("req", request))
 
-			const tsFormat = "2006-01-02T15:04:05"
-			if request.From != "" {
-				from, err := time.ParseInLocation(tsFormat, request.From, time.UTC)
-				if err != nil {
-					return LocationsResponse{}, badRequest(`failed to parse "from": %s`, err.Error())
-				}
+			if from, ok := request.From.MaybeUnwrap(); ok {
 				args = append(args, from.Unix())
 				conds = append(conds, fmt.Sprintf("json_extract(data, '$.tst') >= ?%d", len(args)))
 			}
-			if request.To != "" {
-				to, err := time.ParseInLocation(tsFormat, request.To, time.UTC)
-				if err != nil {
-					return LocationsResponse{}, badRequest(`failed to parse "to": %s`, err.Error())
-				}
+			if to, ok := request.To.MaybeUnwrap(); ok {
 				args = append(args, to.Unix())
 				conds = append(conds, fmt.Sprintf("json_extract(data, '$.tst') <= ?%d", len(args)))
 			}
@@ -80,11 +69,15 @@ func LocationsEndpoint(r *chi.Mux, db *sqlitemigration.Pool) {
 				conds = append(conds, fmt.Sprintf("lr.device = ?%d", len(args)))
 			}
 
+			if !request.Outliers {
+				conds = append(conds, "json_extract(data, '$.outlier') IS NULL")
+			}
+
 			if len(conds) == 0 {
 				conds = []string{"1 = 1"}
 			}
 
-			conn, err := db.Get(ctx)
+			conn, err := getConn(ctx, db)
 			if err != nil {
 				return LocationsResponse{}, errors.Wrap(err, "failed to connect to db")
 			}
@@ -104,6 +97,7 @@ func LocationsEndpoint(r *chi.Mux, db *sqlitemigration.Pool) {
 				},
 			})
 			dur := time.Since(start)
+			dbQueryDuration.WithLabelValues("locations").Observe(dur.Seconds())
 			if err != nil {
 				return LocationsResponse{}, errors.Wrap(err, "query failed")
 			}
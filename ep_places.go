@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"code.nkcmr.net/gotracks/internal/ep"
+	"code.nkcmr.net/opt"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+type PlacesRequest struct {
+	User string `query:"user" validate:"required"`
+}
+
+type PlacesResponse struct {
+	Places []place `json:"places"`
+}
+
+type CreatePlaceRequest struct {
+	User   string  `json:"user" validate:"required"`
+	Name   string  `json:"name"`
+	Lat    float64 `json:"lat" validate:"min=-90,max=90"`
+	Lon    float64 `json:"lon" validate:"min=-180,max=180"`
+	Radius float64 `json:"radius" validate:"min=0"`
+}
+
+type UpdatePlaceRequest struct {
+	ID int64 `route:"id"`
+	// Name renames the place, an empty name lets the geocoder name it.
+	Name   *string  `json:"name"`
+	Radius *float64 `json:"radius" validate:"min=1"`
+}
+
+type DeletePlaceRequest struct {
+	ID int64 `route:"id"`
+}
+
+type DeletePlaceResponse struct {
+	Deleted bool `json:"deleted"`
+}
+
+type PlaceVisitsRequest struct {
+	ID int64 `route:"id"`
+	// From and To take the same formats as the t parameter of /api/0/at.
+	From string `query:"from"`
+	To   string `query:"to"`
+}
+
+type PlaceVisitsResponse struct {
+	Place  place        `json:"place"`
+	Visits []placeVisit `json:"visits"`
+}
+
+type RefreshPlacesRequest struct {
+	User string `query:"user" validate:"required"`
+}
+
+func PlacesEndpoint(r chi.Router, db *sqlitemigration.Pool) {
+	r.Get("/api/0/places", ep.New(
+		func(ctx context.Context, request PlacesRequest) (PlacesResponse, error) {
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return PlacesResponse{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+			places, err := listPlaces(conn, request.User, opt.None[int64]())
+			if err != nil {
+				return PlacesResponse{}, errors.WithStack(err)
+			}
+			return PlacesResponse{Places: places}, nil
+		},
+		ep.AutoDecode[PlacesRequest](),
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+
+	r.Post("/api/0/places", ep.New(
+		func(ctx context.Context, request CreatePlaceRequest) (place, error) {
+			if request.Radius == 0 {
+				request.Radius = placeRadius
+			}
+			source := ""
+			if request.Name != "" {
+				source = "user"
+			}
+
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return place{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+			userID, err := getUserID(ctx, conn, request.User)
+			if err != nil {
+				return place{}, errors.WithStack(err)
+			}
+			var id int64
+			if err := sqlitex.Execute(conn, `
+				INSERT INTO places (user_id, lat, lon, radius, name, name_source, when_created)
+				VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7)
+				RETURNING id
+			`, &sqlitex.ExecOptions{
+				Args: []any{userID, request.Lat, request.Lon, request.Radius, request.Name, source, time.Now().Unix()},
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					id = stmt.ColumnInt64(0)
+					return nil
+				},
+			}); err != nil {
+				return place{}, errors.Wrap(err, "failed to insert place")
+			}
+			p, err := getPlace(conn, id)
+			if err != nil {
+				return place{}, errors.WithStack(err)
+			}
+			return p.UnwrapOrZero(), nil
+		},
+		ep.AutoDecode[CreatePlaceRequest](),
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+
+	r.Put("/api/0/places/{id}", ep.New(
+		func(ctx context.Context, request UpdatePlaceRequest) (place, error) {
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return place{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+			if request.Name != nil {
+				source := "user"
+				if *request.Name == "" {
+					source = ""
+				}
+				if err := sqlitex.Execute(conn, "UPDATE places SET name = ?2, name_source = ?3 WHERE id = ?1", &sqlitex.ExecOptions{
+					Args: []any{request.ID, *request.Name, source},
+				}); err != nil {
+					return place{}, errors.Wrap(err, "failed to rename place")
+				}
+			}
+			if request.Radius != nil {
+				if err := sqlitex.Execute(conn, "UPDATE places SET radius = ?2 WHERE id = ?1", &sqlitex.ExecOptions{
+					Args: []any{request.ID, *request.Radius},
+				}); err != nil {
+					return place{}, errors.Wrap(err, "failed to resize place")
+				}
+			}
+			p, err := getPlace(conn, request.ID)
+			if err != nil {
+				return place{}, errors.WithStack(err)
+			}
+			found, ok := p.MaybeUnwrap()
+			if !ok {
+				return place{}, notFound("no place %d", request.ID)
+			}
+			return found, nil
+		},
+		ep.AutoDecode[UpdatePlaceRequest](),
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+
+	r.Delete("/api/0/places/{id}", ep.New(
+		func(ctx context.Context, request DeletePlaceRequest) (_ DeletePlaceResponse, err error) {
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return DeletePlaceResponse{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+			release := sqlitex.Save(conn)
+			defer release(&err)
+			if err := sqlitex.Execute(conn, "DELETE FROM place_visits WHERE place_id = ?1", &sqlitex.ExecOptions{
+				Args: []any{request.ID},
+			}); err != nil {
+				return DeletePlaceResponse{}, errors.Wrap(err, "failed to delete visits")
+			}
+			if err := sqlitex.Execute(conn, "DELETE FROM places WHERE id = ?1", &sqlitex.ExecOptions{
+				Args: []any{request.ID},
+			}); err != nil {
+				return DeletePlaceResponse{}, errors.Wrap(err, "failed to delete place")
+			}
+			return DeletePlaceResponse{Deleted: conn.Changes() > 0}, nil
+		},
+		ep.AutoDecode[DeletePlaceRequest](),
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+
+	r.Get("/api/0/places/{id}/visits", ep.New(
+		func(ctx context.Context, request PlaceVisitsRequest) (PlaceVisitsResponse, error) {
+			from, to := opt.None[int64](), opt.None[int64]()
+			if request.From != "" {
+				t, err := parseAtTime(request.From)
+				if err != nil {
+					return PlaceVisitsResponse{}, err
+				}
+				from = opt.Some(t.Unix())
+			}
+			if request.To != "" {
+				t, err := parseAtTime(request.To)
+				if err != nil {
+					return PlaceVisitsResponse{}, err
+				}
+				to = opt.Some(t.Unix())
+			}
+
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return PlaceVisitsResponse{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+			p, err := getPlace(conn, request.ID)
+			if err != nil {
+				return PlaceVisitsResponse{}, errors.WithStack(err)
+			}
+			found, ok := p.MaybeUnwrap()
+			if !ok {
+				return PlaceVisitsResponse{}, notFound("no place %d", request.ID)
+			}
+			visits, err := listPlaceVisits(conn, request.ID, from, to)
+			if err != nil {
+				return PlaceVisitsResponse{}, errors.WithStack(err)
+			}
+			return PlaceVisitsResponse{Place: found, Visits: visits}, nil
+		},
+		ep.AutoDecode[PlaceVisitsRequest](),
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+
+	r.Post("/api/0/places/refresh", ep.New(
+		func(ctx context.Context, request RefreshPlacesRequest) (placesResult, error) {
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return placesResult{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+			res, err := refreshPlaces(conn, request.User, time.Now())
+			if err != nil {
+				return placesResult{}, errors.WithStack(err)
+			}
+			return res, nil
+		},
+		ep.AutoDecode[RefreshPlacesRequest](),
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"slices"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -25,33 +29,62 @@ import (
 )
 
 type PubRequest struct {
-	User   string `query:"q" header:"x-limit-u"`
-	Device string `query:"d" header:"x-limit-d"`
+	User   string `query:"q" header:"x-limit-u" validate:"required"`
+	Device string `query:"d" header:"x-limit-d" validate:"required"`
 	Body   []byte
 }
 
 type PubResponse struct {
 	Messages []map[string]any
+
+	// Results is set when a batch of messages was published, it holds the
+	// result of each message in the order they were sent.
+	Results []PubItemResult
+}
+
+type PubItemResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
 }
 
 func (p PubResponse) APIResponse() any {
+	if p.Results != nil {
+		return struct {
+			Results  []PubItemResult  `json:"results"`
+			Messages []map[string]any `json:"messages"`
+		}{p.Results, p.Messages}
+	}
 	return p.Messages
 }
 
-func enrichOTLocationData(ctx context.Context, user, device string, otdata otLocation) error {
+func enrichOTLocationData(ctx context.Context, user, device string, otdata otLocation) (err error) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "enrich location")
+	defer func() {
+		enrichDuration.WithLabelValues("total").Observe(time.Since(start).Seconds())
+		endSpan(span, err)
+	}()
 	p, ok := otdata.LatLng().MaybeUnwrap()
 	if !ok {
 		return badRequest("lat,lon missing")
 	}
+	_, encodeSpan := tracer.Start(ctx, "enrich geohash")
 	otdata["ghash"] = geohash.EncodeWithPrecision(p.Lat(), p.Lon(), 7)
 	otdata["pluscode"] = olc.Encode(p.Lat(), p.Lon(), 12)
+	encodeSpan.End()
+	tzStart := time.Now()
+	_, tzSpan := tracer.Start(ctx, "enrich timezone")
 	tzs, err := tz.GetZone(tz.Point{Lat: p.Lat(), Lon: p.Lon()})
+	endSpan(tzSpan, err)
+	enrichDuration.WithLabelValues("timezone").Observe(time.Since(tzStart).Seconds())
 	if err != nil {
 		return errors.Wrap(err, "failed to determine time zone from location")
 	}
 	if len(tzs) > 0 {
 		otdata["tzname"] = tzs[0]
+		_, locSpan := tracer.Start(ctx, "enrich load location")
 		loc, err := time.LoadLocation(tzs[0])
+		endSpan(locSpan, err)
 		if err != nil {
 			return errors.Wrap(err, "unable to load timezone from stdlib")
 		}
@@ -65,7 +98,6 @@ func enrichOTLocationData(ctx context.Context, user, device string, otdata otLoc
 	}
 	otdata["username"] = user
 	otdata["device"] = device
-	otdata["_http"] = true
 	if t, ok := otdata.Topic().MaybeUnwrap(); ok && t != fmt.Sprintf("owntracks/%s/%s", user, strings.ToUpper(device)) {
 		slog.WarnContext(ctx, "unexpected topic", slog.String("input_topic", t))
 	}
@@ -80,7 +112,7 @@ func checkOutbox(ctx context.Context, conn *sqlite.Conn, user, device string) ([
 		FROM cmd_outbox_consumer_idx
 		WHERE user = ?1 AND device = ?2
 	`
-	err := sqlitex.Execute(conn, lastIdxQuery, &sqlitex.ExecOptions{
+	err := tracedExecute(ctx, conn, "outbox consumer index", lastIdxQuery, &sqlitex.ExecOptions{
 		Args: []any{user, device},
 		ResultFunc: func(stmt *sqlite.Stmt) error {
 			if lastIdxSet.CompareAndSwap(false, true) {
@@ -100,11 +132,11 @@ func checkOutbox(ctx context.Context, conn *sqlite.Conn, user, device string) ([
 		WHERE id > ?1 
 			AND user = ?2 
 			AND device IN (?3, '*') 
-			AND COALESCE(when_expires, (1 << 62)) > strftime('%s', 'now')
+			AND COALESCE(when_expires, (1 << 62)) > CAST(strftime('%s', 'now') AS INTEGER)
 	`
 	var items []map[string]any
-	var maxItem int
-	err = sqlitex.Execute(conn, getOutboxQuery, &sqlitex.ExecOptions{
+	maxItem := int(lastIdx)
+	err = tracedExecute(ctx, conn, "outbox items", getOutboxQuery, &sqlitex.ExecOptions{
 		Args: []any{lastIdx, user, device},
 		ResultFunc: func(stmt *sqlite.Stmt) error {
 			maxItem = max(maxItem, stmt.ColumnInt(0))
@@ -125,7 +157,7 @@ func checkOutbox(ctx context.Context, conn *sqlite.Conn, user, device string) ([
 		`UPDATE cmd_outbox_consumer_idx SET last_outbox_id = :loi WHERE user = :u AND device = :d`,
 	}
 	for _, q := range queries {
-		if err := sqlitex.Execute(conn, q, &sqlitex.ExecOptions{
+		if err := tracedExecute(ctx, conn, "outbox update consumer index", q, &sqlitex.ExecOptions{
 			Named: map[string]any{
 				":u":   user,
 				":d":   device,
@@ -140,9 +172,9 @@ func checkOutbox(ctx context.Context, conn *sqlite.Conn, user, device string) ([
 	return items, nil
 }
 
-func getUserID(_ context.Context, conn *sqlite.Conn, user string) (int, error) {
+func getUserID(ctx context.Context, conn *sqlite.Conn, user string) (int, error) {
 	var xid opt.Option[int]
-	if err := sqlitex.Execute(conn, "SELECT id FROM users WHERE user = ?1", &sqlitex.ExecOptions{
+	if err := tracedExecute(ctx, conn, "user id", "SELECT id FROM users WHERE user = ?1", &sqlitex.ExecOptions{
 		Args: []any{user},
 		ResultFunc: func(stmt *sqlite.Stmt) error {
 			xid = opt.Some(stmt.ColumnInt(0))
@@ -156,7 +188,7 @@ func getUserID(_ context.Context, conn *sqlite.Conn, user string) (int, error) {
 	}
 
 	var createdID opt.Option[int]
-	if err := sqlitex.Execute(conn, "INSERT INTO users (user) VALUES (?1) RETURNING id", &sqlitex.ExecOptions{
+	if err := tracedExecute(ctx, conn, "insert user", "INSERT INTO users (user) VALUES (?1) RETURNING id", &sqlitex.ExecOptions{
 		Args: []any{user},
 		ResultFunc: func(stmt *sqlite.Stmt) error {
 			createdID = opt.Some(stmt.ColumnInt(0))
@@ -168,7 +200,270 @@ func getUserID(_ context.Context, conn *sqlite.Conn, user string) (int, error) {
 	return createdID.Unwrap(), nil
 }
 
-func PubEndpoint(r *chi.Mux, cfg config, liveLoc *liveLocations, db *sqlitemigration.Pool) {
+// reportStatus tells what recordReport did with a report.
+type reportStatus int
+
+const (
+	// reportLive is a report that is now the device's current position.
+	reportLive reportStatus = iota
+	// reportOutOfOrder is a report older than the device's newest report. It
+	// is stored, flagged with "_outoforder", but must not be broadcast as the
+	// live position.
+	reportOutOfOrder
+	// reportDuplicate is a report that was already stored, like a publish
+	// retried by a client on a flaky network. It is not stored again.
+	reportDuplicate
+	// reportOutlier is a report that failed the plausibility filter. It is
+	// stored, flagged with "outlier", but not served by default.
+	reportOutlier
+	// reportQuarantined is a report that failed the plausibility filter and
+	// was stored in quarantined_reports instead of location_reports.
+	reportQuarantined
+)
+
+func (s reportStatus) String() string {
+	switch s {
+	case reportLive:
+		return "ok"
+	case reportOutOfOrder:
+		return "out_of_order"
+	case reportDuplicate:
+		return "duplicate"
+	case reportOutlier:
+		return "outlier"
+	case reportQuarantined:
+		return "quarantined"
+	}
+	return fmt.Sprintf("reportStatus(%d)", int(s))
+}
+
+func (s reportStatus) live() bool {
+	return s == reportLive
+}
+
+// recordReport stores a decoded OwnTracks message as a report from the given
+// user's device.
+func recordReport(ctx context.Context, conn *sqlite.Conn, plausibility configPlausibility, user, device string, otdata otJSON) (reportStatus, error) {
+	start := time.Now()
+	status, err := storeReport(ctx, conn, plausibility, user, device, otdata)
+	dbQueryDuration.WithLabelValues("record_report").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return 0, err
+	}
+	var typ string
+	if loc, ok := otdata.(otLocation); ok {
+		typ = readString(loc, "_type").UnwrapOrZero()
+	}
+	reportsRecorded.WithLabelValues(user, device, typ, status.String()).Inc()
+	return status, nil
+}
+
+// storeReport checks and stores a report in a single write transaction, or a
+// savepoint of the caller's, so a report published twice at once is only
+// stored once.
+func storeReport(ctx context.Context, conn *sqlite.Conn, plausibility configPlausibility, user, device string, otdata otJSON) (_ reportStatus, err error) {
+	release, err := saveWrite(conn)
+	if err != nil {
+		return 0, err
+	}
+	defer release(&err)
+
+	userID, err := getUserID(ctx, conn, user)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get user id")
+	}
+
+	status := reportLive
+	if loc, ok := otdata.(otLocation); ok {
+		if tst, ok := readInt(loc, "tst").MaybeUnwrap(); ok {
+			if status, err = checkReportOrder(ctx, conn, userID, device, tst, readString(loc, "_type").UnwrapOrZero()); err != nil {
+				return 0, err
+			}
+			switch status {
+			case reportDuplicate:
+				return status, nil
+			case reportOutOfOrder:
+				loc["_outoforder"] = true
+			}
+		}
+
+		_, span := tracer.Start(ctx, "plausibility check")
+		outlier, err := isOutlier(conn, plausibility, userID, device, loc)
+		endSpan(span, err)
+		if err != nil {
+			return 0, err
+		}
+		if outlier && plausibility.Quarantine {
+			if err := tracedExecute(ctx, conn, "quarantine report", `
+				INSERT INTO quarantined_reports (user_id, device, data, when_created)
+				VALUES (?1, ?2, ?3, CAST(strftime('%s', 'now') AS INTEGER))
+			`, &sqlitex.ExecOptions{
+				Args: []any{userID, device, string(mustJSONEncode(loc))},
+			}); err != nil {
+				return 0, errors.Wrap(err, "failed to quarantine location report")
+			}
+			return reportQuarantined, nil
+		} else if outlier {
+			loc["outlier"] = true
+			status = reportOutlier
+		}
+
+		if p, ok := loc.LatLng().MaybeUnwrap(); ok && !outlier {
+			_, span := tracer.Start(ctx, "place lookup")
+			placeID, err := placeAt(conn, userID, p)
+			endSpan(span, err)
+			if err != nil {
+				return 0, err
+			}
+			if id, ok := placeID.MaybeUnwrap(); ok {
+				loc["place_id"] = id
+			}
+		}
+	}
+
+	const insertSQL = `
+		INSERT INTO location_reports (user_id, device, data)
+		VALUES (?1, ?2, ?3)
+	`
+	err = tracedExecute(ctx, conn, "insert report", insertSQL, &sqlitex.ExecOptions{
+		Args: []any{
+			userID,
+			device,
+			string(mustJSONEncode(otdata)),
+		},
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to insert location report")
+	}
+	if c := conn.Changes(); c != 1 {
+		slog.WarnContext(ctx, "unexpected number of rows changed, expected 1", slog.Int("got", c))
+	}
+	return status, nil
+}
+
+// checkReportOrder compares a report with the reports already stored for the
+// device, reports are the same when they have the same tst and _type.
+func checkReportOrder(ctx context.Context, conn *sqlite.Conn, userID int, device string, tst int, typ string) (reportStatus, error) {
+	status := reportLive
+	const query = `
+		SELECT
+			EXISTS (
+				SELECT 1
+				FROM location_reports
+				WHERE user_id = ?1
+					AND device = ?2
+					AND json_extract(data, '$.tst') = ?3
+					AND json_extract(data, '$._type') = ?4
+			),
+			COALESCE((
+				SELECT MAX(json_extract(data, '$.tst'))
+				FROM location_reports
+				WHERE user_id = ?1 AND device = ?2
+			), 0)
+	`
+	if err := tracedExecute(ctx, conn, "report order", query, &sqlitex.ExecOptions{
+		Args: []any{userID, device, tst, typ},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			if stmt.ColumnBool(0) {
+				status = reportDuplicate
+			} else if stmt.ColumnInt(1) > tst {
+				status = reportOutOfOrder
+			}
+			return nil
+		},
+	}); err != nil {
+		return 0, errors.Wrap(err, "failed to check for duplicate report")
+	}
+	return status, nil
+}
+
+// decodePubMessage decodes and enriches a message published over http.
+func decodePubMessage(ctx context.Context, user, device string, body []byte) (otJSON, error) {
+	otdata, err := decodeOTJSON(body)
+	if err != nil {
+		return nil, badRequest("failed to decode ot json: %s", err.Error())
+	}
+	switch otdata := otdata.(type) {
+	case otLocation:
+		if err := enrichOTLocationData(ctx, user, device, otdata); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		otdata["_http"] = true
+	}
+	return otdata, nil
+}
+
+// pubRejectReason tells why a message could not be recorded for metrics.
+func pubRejectReason(err error) string {
+	if isHTTPError(err) {
+		return "invalid_message"
+	}
+	return "db_error"
+}
+
+// isJSONArray reports whether the json document in d is an array.
+func isJSONArray(d []byte) bool {
+	d = bytes.TrimLeft(d, " \t\r\n")
+	return len(d) > 0 && d[0] == '['
+}
+
+// pubBatch records a batch of messages in a single transaction, each message
+// in a savepoint of its own so a failing message does not affect the others.
+// The reports that became live are broadcast in tst order once the batch is
+// committed.
+func pubBatch(ctx context.Context, conn *sqlite.Conn, plausibility configPlausibility, liveLoc *liveLocations, user, device string, body []byte) ([]PubItemResult, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, badRequest("failed to decode ot json: %s", err.Error())
+	}
+
+	results := make([]PubItemResult, len(items))
+	var live []otLocation
+	err := func() (err error) {
+		release, err := saveWrite(conn)
+		if err != nil {
+			return err
+		}
+		defer release(&err)
+		for i, item := range items {
+			otdata, status, err := func() (_ otJSON, _ reportStatus, err error) {
+				otdata, err := decodePubMessage(ctx, user, device, item)
+				if err != nil {
+					return nil, 0, err
+				}
+				defer sqlitex.Save(conn)(&err)
+				status, err := recordReport(ctx, conn, plausibility, user, device, otdata)
+				return otdata, status, err
+			}()
+			if err != nil {
+				results[i] = PubItemResult{Status: "error", Error: err.Error()}
+				reportsRejected.WithLabelValues(pubRejectReason(err)).Inc()
+				if !isHTTPError(err) {
+					slog.ErrorContext(ctx, "failed to record batch item", slog.Int("item", i), slog.String("err", err.Error()))
+					results[i].Error = "failed to record message"
+				}
+				continue
+			}
+			results[i] = PubItemResult{Status: status.String()}
+			if loc, ok := otdata.(otLocation); ok && status.live() {
+				live = append(live, loc)
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to commit batch")
+	}
+
+	slices.SortStableFunc(live, func(a, b otLocation) int {
+		return cmp.Compare(readInt(a, "tst").UnwrapOrZero(), readInt(b, "tst").UnwrapOrZero())
+	})
+	liveLoc.goBroadcast(ctx, live...)
+	return results, nil
+}
+
+func PubEndpoint(r chi.Router, cfg config, liveLoc *liveLocations, db *sqlitemigration.Pool) {
+	decodePub := ep.AutoDecode[PubRequest]()
 	r.
 		With(
 			middleware.AllowContentType("application/json"),
@@ -176,71 +471,68 @@ func PubEndpoint(r *chi.Mux, cfg config, liveLoc *liveLocations, db *sqlitemigra
 		Post("/pub", ep.New(
 			func(ctx context.Context, request PubRequest) (PubResponse, error) {
 				if request.User != basicauth.VerifiedUsername(ctx).UnwrapOrZero() {
+					reportsRejected.WithLabelValues("auth_mismatch").Inc()
 					return PubResponse{}, badRequest("input data and auth data mismatch")
 				}
-				if request.User == "" || request.Device == "" {
-					return PubResponse{}, badRequest("user and device input is required")
-				}
 
-				otdata, err := decodeOTJSON(request.Body)
-				if err != nil {
-					return PubResponse{}, badRequest("failed to decode ot json: %s", err.Error())
-				}
-
-				bcast := func() {}
-				switch otdata := otdata.(type) {
-				case otLocation:
-					if err := enrichOTLocationData(ctx, request.User, request.Device, otdata); err != nil {
-						return PubResponse{}, errors.WithStack(err)
-					}
-					bcast = func() {
-						liveLoc.broadcast(otdata)
+				batch := isJSONArray(request.Body)
+				var otdata otJSON
+				if !batch {
+					var err error
+					if otdata, err = decodePubMessage(ctx, request.User, request.Device, request.Body); err != nil {
+						reportsRejected.WithLabelValues(pubRejectReason(err)).Inc()
+						return PubResponse{}, err
 					}
 				}
 
-				conn, err := db.Get(ctx)
+				conn, err := getConn(ctx, db)
 				if err != nil {
+					reportsRejected.WithLabelValues("db_error").Inc()
 					slog.Error("db error", slog.String("err", err.Error()))
 					return PubResponse{}, srvError("failed connect to db")
 				}
 				defer db.Put(conn)
 
-				userID, err := getUserID(ctx, conn, request.User)
-				if err != nil {
-					return PubResponse{}, errors.Wrap(err, "failed to get user id")
-				}
-
-				const insertSQL = `
-					INSERT INTO location_reports (user_id, device, data)
-					VALUES (?1, ?2, ?3)
-				`
-				err = sqlitex.Execute(conn, insertSQL, &sqlitex.ExecOptions{
-					Args: []any{
-						userID,
-						request.Device,
-						string(mustJSONEncode(otdata)),
-					},
-				})
-				if err != nil {
-					slog.Error("db error", slog.String("err", err.Error()))
-					return PubResponse{}, srvError("failed to talk to db")
-				}
-				go bcast()
-				if c := conn.Changes(); c != 1 {
-					slog.WarnContext(ctx, "unexpected number of rows changed, expected 1", slog.Int("got", c))
+				var response PubResponse
+				if batch {
+					response.Results, err = pubBatch(ctx, conn, cfg.Plausibility, liveLoc, request.User, request.Device, request.Body)
+					if err != nil {
+						if isHTTPError(err) {
+							return PubResponse{}, err
+						}
+						slog.Error("db error", slog.String("err", err.Error()))
+						return PubResponse{}, srvError("failed to talk to db")
+					}
+				} else {
+					status, err := recordReport(ctx, conn, cfg.Plausibility, request.User, request.Device, otdata)
+					if err != nil {
+						reportsRejected.WithLabelValues("db_error").Inc()
+						slog.Error("db error", slog.String("err", err.Error()))
+						return PubResponse{}, srvError("failed to talk to db")
+					}
+					if loc, ok := otdata.(otLocation); ok && status.live() {
+						liveLoc.goBroadcast(ctx, loc)
+					}
 				}
 
 				outbox, err := checkOutbox(ctx, conn, request.User, request.Device)
 				if err != nil {
-					outbox = []map[string]any{} // to ensure the json rendered is "[]" not "null"
 					slog.WarnContext(ctx, "failed to check outbox", slog.String("err", err.Error()))
 				}
-
-				return PubResponse{
-					Messages: outbox,
-				}, nil
+				if outbox == nil {
+					outbox = []map[string]any{} // to ensure the json rendered is "[]" not "null"
+				}
+				response.Messages = outbox
+				return response, nil
+			},
+			func(ctx context.Context, r *http.Request) (PubRequest, error) {
+				req, err := decodePub(ctx, r)
+				var verr *ep.ValidationError
+				if errors.As(err, &verr) {
+					reportsRejected.WithLabelValues("missing_user_device").Inc()
+				}
+				return req, err
 			},
-			ep.AutoDecode[PubRequest](),
 			ep.EncodeJSONResponse,
 		).ServeHTTP)
 }
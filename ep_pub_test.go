@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestStoreReportConcurrentDuplicates(t *testing.T) {
+	cfg := testConfig(t)
+	db := testDB(t, cfg)
+	ctx := context.Background()
+
+	// create the user up front so every publish races on the report alone
+	conn, err := db.Get(ctx)
+	if err != nil {
+		t.Fatalf("failed to get conn: %v", err)
+	}
+	if _, err := getUserID(ctx, conn, "alice"); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	db.Put(conn)
+
+	// publish records the same report from each of devices at once
+	publish := func(devices ...string) map[reportStatus]int {
+		t.Helper()
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		statuses := map[reportStatus]int{}
+		for _, device := range devices {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := db.Get(ctx)
+				if err != nil {
+					t.Errorf("failed to get conn: %v", err)
+					return
+				}
+				defer db.Put(conn)
+				status, err := recordReport(ctx, conn, cfg.Plausibility, "alice", device, otLocation{
+					"_type": "location", "lat": 52.52, "lon": 13.405, "tst": float64(1700000000),
+				})
+				if err != nil {
+					t.Errorf("publish from %s failed: %v", device, err)
+					return
+				}
+				mu.Lock()
+				statuses[status]++
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		return statuses
+	}
+
+	// a client retrying a publish on a flaky network can have the same report
+	// in flight several times
+	const publishes = 8
+	same := make([]string, publishes)
+	for i := range same {
+		same[i] = "phone"
+	}
+	if statuses := publish(same...); statuses[reportLive] != 1 || statuses[reportDuplicate] != publishes-1 {
+		t.Errorf("publishes of the same report got statuses %v", statuses)
+	}
+	if got := testQuery(t, db, "SELECT COUNT(*) FROM location_reports"); got[0] != "1" {
+		t.Errorf("stored %s reports", got[0])
+	}
+
+	// publishes from different devices all wait for the write lock, a few
+	// rounds as losing the race to it is not certain in each
+	for round := range 5 {
+		var devices []string
+		for i := range publishes {
+			devices = append(devices, fmt.Sprintf("device-%d-%d", round, i))
+		}
+		if statuses := publish(devices...); statuses[reportLive] != publishes {
+			t.Errorf("publishes from different devices got statuses %v", statuses)
+		}
+	}
+}
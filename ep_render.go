@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"log/slog"
+	"net/http"
+
+	"code.nkcmr.net/gotracks/internal/ep"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+)
+
+const renderMaxSize = 2048
+
+type RenderRequest struct {
+	User   string `query:"user" validate:"required"`
+	Device string `query:"device"`
+	// From and To take the same formats as the t parameter of /api/0/at.
+	From string `query:"from"`
+	To   string `query:"to"`
+	// W and H are the image size, 600x400 by default. They are at least
+	// 2*renderPadding+1 and at most renderMaxSize.
+	W int `query:"w" validate:"min=49,max=2048"`
+	H int `query:"h" validate:"min=49,max=2048"`
+}
+
+type RenderResponse struct {
+	png []byte
+}
+
+func RenderEndpoint(r chi.Router, cfg config, db *sqlitemigration.Pool) {
+	tiles := newTileServer(cfg.Tiles)
+	r.Get("/api/0/render.png", ep.New(
+		func(ctx context.Context, request RenderRequest) (RenderResponse, error) {
+			f, err := parseHeatmapFilter(request.User, request.Device, request.From, request.To)
+			if err != nil {
+				return RenderResponse{}, err
+			}
+			if request.W == 0 {
+				request.W = 600
+			}
+			if request.H == 0 {
+				request.H = 400
+			}
+
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return RenderResponse{}, srvError("failed connect to db")
+			}
+			points, err := renderPoints(conn, f)
+			db.Put(conn)
+			if err != nil {
+				return RenderResponse{}, errors.WithStack(err)
+			}
+			if len(points) == 0 {
+				return RenderResponse{}, notFound("no reports to render")
+			}
+
+			img := renderTrack(ctx, tiles, points, request.W, request.H)
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, img); err != nil {
+				return RenderResponse{}, errors.Wrap(err, "failed to encode image")
+			}
+			return RenderResponse{png: buf.Bytes()}, nil
+		},
+		ep.AutoDecode[RenderRequest](),
+		func(ctx context.Context, w http.ResponseWriter, response RenderResponse) error {
+			return encodePNGResponse(ctx, w, response.png)
+		},
+	).ServeHTTP)
+}
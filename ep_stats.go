@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"code.nkcmr.net/gotracks/internal/ep"
+	"code.nkcmr.net/opt"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+)
+
+type StatsRequest struct {
+	User   string `query:"user" validate:"required"`
+	Device string `query:"device"`
+	Period string `query:"period" validate:"enum=day|month"`
+	// From and To are dates, the periods containing them are included.
+	From opt.Option[time.Time] `query:"from" layout:"2006-01-02"`
+	To   opt.Option[time.Time] `query:"to" layout:"2006-01-02"`
+}
+
+type StatsResponse struct {
+	Period string `json:"period"`
+	// Stats has an entry for each period with reports, oldest first.
+	Stats []periodStats `json:"stats"`
+}
+
+func StatsEndpoint(r chi.Router, db *sqlitemigration.Pool) {
+	r.Get("/api/0/stats", ep.New(
+		func(ctx context.Context, request StatsRequest) (StatsResponse, error) {
+			period := statsPeriod(request.Period)
+			if period == "" {
+				period = statsDay
+			}
+
+			now := time.Now()
+			to := period.next(period.truncate(now))
+			if t, ok := request.To.MaybeUnwrap(); ok {
+				to = period.next(period.truncate(t))
+			}
+			var from time.Time
+			if t, ok := request.From.MaybeUnwrap(); ok {
+				from = period.truncate(t)
+			} else if period == statsMonth {
+				from = to.AddDate(-1, 0, 0)
+			} else {
+				from = to.AddDate(0, 0, -30)
+			}
+			n := 0
+			for t := from; t.Before(to); t = period.next(t) {
+				if n++; n > statsMaxPeriods {
+					return StatsResponse{}, badRequest("too many periods requested, at most %d are allowed", statsMaxPeriods)
+				}
+			}
+
+			conn, err := getConn(ctx, db)
+			if err != nil {
+				slog.Error("db error", slog.String("err", err.Error()))
+				return StatsResponse{}, srvError("failed connect to db")
+			}
+			defer db.Put(conn)
+
+			stats, err := statsFor(conn, request.User, request.Device, period, from, to, now)
+			if err != nil {
+				return StatsResponse{}, errors.WithStack(err)
+			}
+			return StatsResponse{Period: string(period), Stats: stats}, nil
+		},
+		ep.AutoDecode[StatsRequest](),
+		ep.EncodeJSONResponse,
+	).ServeHTTP)
+}
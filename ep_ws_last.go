@@ -2,13 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"log/slog"
 	"maps"
 	"net/http"
 	"slices"
 	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel/attribute"
 	"zombiezen.com/go/sqlite/sqlitemigration"
 
 	"github.com/gorilla/websocket"
@@ -23,17 +26,43 @@ type liveLocations struct {
 	l   sync.RWMutex
 	in  chan otLocation
 	out []chan<- otLocation
+
+	// done is closed when the server shuts down, websocket clients are then
+	// sent a close frame.
+	done      chan struct{}
+	closeOnce sync.Once
+	// pending tracks the broadcasts and websocket connections that have to
+	// finish before shutting down.
+	pending sync.WaitGroup
 }
 
 func newLiveLocations() *liveLocations {
 	return &liveLocations{
-		in: make(chan otLocation, 10),
+		in:   make(chan otLocation, 10),
+		done: make(chan struct{}),
+	}
+}
+
+// goBroadcast broadcasts locs in order in the background.
+func (l *liveLocations) goBroadcast(ctx context.Context, locs ...otLocation) {
+	if len(locs) == 0 {
+		return
 	}
+	l.pending.Add(1)
+	go func() {
+		defer l.pending.Done()
+		for _, loc := range locs {
+			l.broadcast(ctx, loc)
+		}
+	}()
 }
 
-func (l *liveLocations) broadcast(d otLocation) {
+func (l *liveLocations) broadcast(ctx context.Context, d otLocation) {
+	_, span := tracer.Start(ctx, "broadcast location")
+	defer span.End()
 	l.l.RLock()
 	defer l.l.RUnlock()
+	span.SetAttributes(attribute.Int("subscribers", len(l.out)))
 	for _, oc := range l.out {
 		oc <- d
 	}
@@ -43,15 +72,33 @@ func (l *liveLocations) subscribe(c chan<- otLocation) func() {
 	l.l.Lock()
 	defer l.l.Unlock()
 	l.out = append(l.out, c)
-	idx := len(l.out) - 1
 	return func() {
 		l.l.Lock()
 		defer l.l.Unlock()
-		l.out = slices.Delete(l.out, idx, idx+1)
+		// other subscribers may have left since, so the index is looked up
+		if idx := slices.Index(l.out, c); idx >= 0 {
+			l.out = slices.Delete(l.out, idx, idx+1)
+		}
 		close(c)
 	}
 }
 
+// close disconnects websocket clients and waits for them and for pending
+// broadcasts to finish, or for ctx to be done.
+func (l *liveLocations) close(ctx context.Context) {
+	l.closeOnce.Do(func() { close(l.done) })
+	finished := make(chan struct{})
+	go func() {
+		l.pending.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		slog.Warn("gave up waiting for live location subscribers")
+	}
+}
+
 type wsMessage struct {
 	typ int
 	p   []byte
@@ -78,8 +125,12 @@ func toLiveLocMessage(loc otLocation) map[string]any {
 	return copy
 }
 
-func WebsocketLastLocationEndpoint(r *chi.Mux, l *liveLocations, db *sqlitemigration.Pool) {
+func WebsocketLastLocationEndpoint(r chi.Router, l *liveLocations, db *sqlitemigration.Pool) {
 	r.Get("/ws/last", func(w http.ResponseWriter, r *http.Request) {
+		// counted before the upgrade, while http.Server.Shutdown still waits
+		// for the request
+		l.pending.Add(1)
+		defer l.pending.Done()
 		ws, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			slog.ErrorContext(r.Context(), "ws upgrader failed", slog.String("err", err.Error()))
@@ -89,18 +140,35 @@ func WebsocketLastLocationEndpoint(r *chi.Mux, l *liveLocations, db *sqlitemigra
 
 		updates := make(chan otLocation, 5)
 		unsubscribe := l.subscribe(updates)
-		defer unsubscribe()
+		defer func() {
+			// a broadcast may be blocked on sending to updates, which holds
+			// the lock unsubscribe needs
+			go func() {
+				for range updates {
+				}
+			}()
+			unsubscribe()
+		}()
+		wsSubscribers.Inc()
+		defer wsSubscribers.Dec()
 
 		inMessages := wsConsume(ws)
 
 		ready := false
 		for {
 			select {
+			case <-l.done:
+				_ = ws.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+					time.Now().Add(time.Second),
+				)
+				return
 			case l := <-updates:
 				_ = ws.WriteMessage(websocket.TextMessage, mustJSONEncode(toLiveLocMessage(l)))
 			case in, ok := <-inMessages:
 				if !ok {
-					break
+					return
 				}
 				if !ready {
 					if in.typ == websocket.TextMessage && bytes.EqualFold([]byte("LAST"), in.p) {
@@ -59,7 +59,7 @@ func downloadFrontend() (fs.FS, error) {
 	return zipfsDist, nil
 }
 
-func serveFrontend(r *chi.Mux) error {
+func serveFrontend(r chi.Router) error {
 	feFS, err := downloadFrontend()
 	if err != nil {
 		return errors.Wrap(err, "failed to download frontend")
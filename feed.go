@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"code.nkcmr.net/opt"
+
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const (
+	feedDefaultDays = 30
+	feedMaxDays     = 366
+)
+
+type feedToken struct {
+	ID       int64  `json:"id"`
+	User     string `json:"user"`
+	Device   string `json:"device"`
+	Name     string `json:"name"`
+	Created  int64  `json:"created"`
+	LastUsed *int64 `json:"last_used"`
+	// Token is only known when the token is created.
+	Token string `json:"token,omitempty"`
+}
+
+func (ft feedToken) path() string {
+	return "/api/0/feed/" + ft.Token + ".ics"
+}
+
+func hashFeedToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func createFeedToken(conn *sqlite.Conn, user, device, name string, now time.Time) (feedToken, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return feedToken{}, errors.Wrap(err, "failed to generate token")
+	}
+	ft := feedToken{
+		User:    user,
+		Device:  device,
+		Name:    name,
+		Created: now.Unix(),
+		Token:   base64.RawURLEncoding.EncodeToString(b),
+	}
+	if err := sqlitex.Execute(conn, `
+		INSERT INTO feed_tokens (user, device, name, token_hash, when_created)
+		VALUES (?1, ?2, ?3, ?4, ?5)
+		RETURNING id
+	`, &sqlitex.ExecOptions{
+		Args: []any{user, device, name, hashFeedToken(ft.Token), ft.Created},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			ft.ID = stmt.ColumnInt64(0)
+			return nil
+		},
+	}); err != nil {
+		return feedToken{}, errors.Wrap(err, "failed to insert feed token")
+	}
+	return ft, nil
+}
+
+func scanFeedToken(stmt *sqlite.Stmt) feedToken {
+	ft := feedToken{
+		ID:      stmt.ColumnInt64(0),
+		User:    stmt.ColumnText(1),
+		Device:  stmt.ColumnText(2),
+		Name:    stmt.ColumnText(3),
+		Created: stmt.ColumnInt64(4),
+	}
+	if stmt.ColumnType(5) != sqlite.TypeNull {
+		used := stmt.ColumnInt64(5)
+		ft.LastUsed = &used
+	}
+	return ft
+}
+
+func listFeedTokens(conn *sqlite.Conn, user string) ([]feedToken, error) {
+	tokens := []feedToken{}
+	if err := sqlitex.Execute(conn, `
+		SELECT id, user, device, name, when_created, when_used
+		FROM feed_tokens
+		WHERE user = ?1
+		ORDER BY id
+	`, &sqlitex.ExecOptions{
+		Args: []any{user},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			tokens = append(tokens, scanFeedToken(stmt))
+			return nil
+		},
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to query feed tokens")
+	}
+	return tokens, nil
+}
+
+// useFeedToken returns what a token gives access to and records that it was
+// used.
+func useFeedToken(conn *sqlite.Conn, token string, now time.Time) (opt.Option[feedToken], error) {
+	found := opt.None[feedToken]()
+	if err := sqlitex.Execute(conn, `
+		UPDATE feed_tokens SET when_used = ?2
+		WHERE token_hash = ?1
+		RETURNING id, user, device, name, when_created, when_used
+	`, &sqlitex.ExecOptions{
+		Args: []any{hashFeedToken(token), now.Unix()},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			found = opt.Some(scanFeedToken(stmt))
+			return nil
+		},
+	}); err != nil {
+		return opt.None[feedToken](), errors.Wrap(err, "failed to look up feed token")
+	}
+	return found, nil
+}
+
+type calendarEvent struct {
+	uid         string
+	start, end  int64
+	summary     string
+	description string
+	geo         opt.Option[Point]
+}
+
+// feedEvents returns an event for each stay of the feed's devices between
+// from and to, and one for each trip between two stays when trips is set.
+// Event uids are derived from the device and the time the stay or trip
+// started, so calendars update events as they grow. Stays that started
+// before from are left out, their start is not known from the reports in the
+// window.
+func feedEvents(conn *sqlite.Conn, ft feedToken, from, to time.Time, trips bool) ([]calendarEvent, error) {
+	points, err := renderPoints(conn, heatmapFilter{
+		user:   ft.User,
+		device: ft.Device,
+		from:   opt.Some(from.Unix()),
+		to:     opt.Some(to.Unix()),
+		bbox:   opt.None[[4]float64](),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	places, err := listPlaces(conn, ft.User, opt.None[int64]())
+	if err != nil {
+		return nil, err
+	}
+	var areas []placeArea
+	names := map[int64]string{}
+	for _, p := range places {
+		areas = append(areas, placeArea{id: p.ID, p: Point{p.Lat, p.Lon}, radius: p.Radius})
+		names[p.ID] = p.Name
+	}
+	placeName := func(p Point) string {
+		if id, ok := placeContaining(areas, p).MaybeUnwrap(); ok && names[id] != "" {
+			return names[id]
+		}
+		return fmt.Sprintf("%.4f, %.4f", p.Lat(), p.Lon())
+	}
+
+	// a device was already staying when the window starts if its last report
+	// before the window is close to its first one in it
+	ongoing := map[string]int64{}
+	for i, pt := range points {
+		if i > 0 && points[i-1].device == pt.device {
+			continue
+		}
+		fix, err := positionFixAround(conn, ft.User, pt.device, from.Unix()-1, true)
+		if err != nil {
+			return nil, err
+		}
+		if f, ok := fix.MaybeUnwrap(); ok && f.p.DistanceTo(pt.p) <= positionStayRadius {
+			ongoing[pt.device] = pt.tst
+		}
+	}
+
+	var events []calendarEvent
+	stays := findStays(points, placeStayMin)
+	// stays and points are both ordered by device and time, so the points of
+	// each trip are found walking the points once
+	next := 0
+	for i, s := range stays {
+		name := placeName(s.p)
+		if tst, ok := ongoing[s.device]; !ok || tst != s.arrived {
+			events = append(events, calendarEvent{
+				uid:         fmt.Sprintf("stay-%s-%s-%d@gotracks", ft.User, s.device, s.arrived),
+				start:       s.arrived,
+				end:         s.departed,
+				summary:     name,
+				description: fmt.Sprintf("%s stayed at %s", s.device, name),
+				geo:         opt.Some(s.p),
+			})
+		}
+		if !trips || i == 0 || stays[i-1].device != s.device {
+			continue
+		}
+		prev := stays[i-1]
+		for next < len(points) && (points[next].device != s.device || points[next].tst < prev.departed) {
+			next++
+		}
+		var dist float64
+		var last opt.Option[Point]
+		for ; next < len(points) && points[next].device == s.device && points[next].tst <= s.arrived; next++ {
+			pt := points[next]
+			if l, ok := last.MaybeUnwrap(); ok {
+				dist += l.DistanceTo(pt.p)
+			}
+			last = opt.Some(pt.p)
+		}
+		events = append(events, calendarEvent{
+			uid:         fmt.Sprintf("trip-%s-%s-%d@gotracks", ft.User, s.device, prev.departed),
+			start:       prev.departed,
+			end:         s.arrived,
+			summary:     fmt.Sprintf("%s → %s", placeName(prev.p), name),
+			description: fmt.Sprintf("%s travelled %.1f km", s.device, dist/1000),
+		})
+	}
+	return events, nil
+}
+
+// icsWriter writes iCalendar (RFC 5545) content lines.
+type icsWriter struct {
+	w   io.Writer
+	err error
+}
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`, "\r", "")
+
+// line writes a content line, folded to lines of at most 75 octets.
+func (iw *icsWriter) line(name, value string) {
+	if iw.err != nil {
+		return
+	}
+	l := name + ":" + value
+	var b strings.Builder
+	for len(l) > 75 {
+		cut := 75
+		if b.Len() > 0 {
+			// continuation lines start with a space
+			cut = 74
+		}
+		// do not split utf-8 sequences
+		for cut > 0 && l[cut]&0xc0 == 0x80 {
+			cut--
+		}
+		b.WriteString(l[:cut])
+		b.WriteString("\r\n ")
+		l = l[cut:]
+	}
+	b.WriteString(l)
+	b.WriteString("\r\n")
+	_, iw.err = io.WriteString(iw.w, b.String())
+}
+
+func icsTime(tst int64) string {
+	return time.Unix(tst, 0).UTC().Format("20060102T150405Z")
+}
+
+func writeCalendar(w io.Writer, name string, events []calendarEvent, now time.Time) error {
+	iw := &icsWriter{w: w}
+	iw.line("BEGIN", "VCALENDAR")
+	iw.line("VERSION", "2.0")
+	iw.line("PRODID", "-//gotracks//visits//EN")
+	iw.line("CALSCALE", "GREGORIAN")
+	iw.line("METHOD", "PUBLISH")
+	iw.line("X-WR-CALNAME", icsEscaper.Replace(name))
+	iw.line("REFRESH-INTERVAL;VALUE=DURATION", "PT1H")
+	iw.line("X-PUBLISHED-TTL", "PT1H")
+	for _, e := range events {
+		iw.line("BEGIN", "VEVENT")
+		iw.line("UID", e.uid)
+		iw.line("DTSTAMP", icsTime(now.Unix()))
+		iw.line("DTSTART", icsTime(e.start))
+		iw.line("DTEND", icsTime(e.end))
+		iw.line("SUMMARY", icsEscaper.Replace(e.summary))
+		if e.description != "" {
+			iw.line("DESCRIPTION", icsEscaper.Replace(e.description))
+		}
+		if p, ok := e.geo.MaybeUnwrap(); ok {
+			iw.line("GEO", fmt.Sprintf("%.6f;%.6f", p.Lat(), p.Lon()))
+		}
+		iw.line("TRANSP", "TRANSPARENT")
+		iw.line("END", "VEVENT")
+	}
+	iw.line("END", "VCALENDAR")
+	return errors.WithStack(iw.err)
+}
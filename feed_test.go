@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestFeedEvents(t *testing.T) {
+	db := testDB(t, testConfig(t))
+	ctx := context.Background()
+	conn, err := db.Get(ctx)
+	if err != nil {
+		t.Fatalf("failed to get conn: %v", err)
+	}
+	defer db.Put(conn)
+	userID, err := getUserID(ctx, conn, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := func(lat, lon float64, tst int64) {
+		t.Helper()
+		if err := sqlitex.Execute(conn, "INSERT INTO location_reports (user_id, device, data) VALUES (?1, 'phone', ?2)", &sqlitex.ExecOptions{
+			Args: []any{userID, fmt.Sprintf(`{"_type":"location","lat":%v,"lon":%v,"tst":%d}`, lat, lon, tst)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// at home for 3 hours, a trip to work and an hour there
+	const start = 1700000000
+	for tst := int64(start); tst <= start+3*3600; tst += 600 {
+		report(52.52, 13.405, tst)
+	}
+	report(52.51, 13.35, start+3*3600+900)
+	for tst := int64(start + 4*3600); tst <= start+5*3600; tst += 600 {
+		report(52.5, 13.3, tst)
+	}
+
+	uids := func(from int64) string {
+		t.Helper()
+		events, err := feedEvents(conn, feedToken{User: "alice"}, time.Unix(from, 0), time.Unix(start+6*3600, 0), true)
+		if err != nil {
+			t.Fatalf("failed to list events: %v", err)
+		}
+		var out []string
+		for _, e := range events {
+			out = append(out, e.uid)
+		}
+		return strings.Join(out, " ")
+	}
+
+	want := fmt.Sprintf("stay-alice-phone-%d@gotracks stay-alice-phone-%d@gotracks trip-alice-phone-%d@gotracks",
+		start, start+4*3600, start+3*3600)
+	if got := uids(start - 3600); got != want {
+		t.Errorf("events = %s, want %s", got, want)
+	}
+	events, err := feedEvents(conn, feedToken{User: "alice"}, time.Unix(start-3600, 0), time.Unix(start+6*3600, 0), true)
+	if err != nil {
+		t.Fatalf("failed to list events: %v", err)
+	}
+	home, via, work := Point{52.52, 13.405}, Point{52.51, 13.35}, Point{52.5, 13.3}
+	dist := home.DistanceTo(via) + via.DistanceTo(work)
+	if got, want := events[len(events)-1].description, fmt.Sprintf("phone travelled %.1f km", dist/1000); got != want {
+		t.Errorf("trip description = %q, want %q", got, want)
+	}
+	// the stay at home started before these windows, it is left out instead
+	// of starting at the first report in the window
+	want = fmt.Sprintf("stay-alice-phone-%d@gotracks trip-alice-phone-%d@gotracks", start+4*3600, start+3*3600)
+	for _, from := range []int64{start + 1, start + 1800, start + 3600} {
+		if got := uids(from); got != want {
+			t.Errorf("events from %d = %s, want %s", from, got, want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"code.nkcmr.net/opt"
+
+	"github.com/mmcloughlin/geohash"
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// heatmapMaxCells limits how many cells one aggregation may return.
+const heatmapMaxCells = 100_000
+
+// heatmapFilter selects the reports a heatmap is made of. Outliers are
+// always left out.
+type heatmapFilter struct {
+	user   string
+	device string
+	from   opt.Option[int64]
+	to     opt.Option[int64]
+	// bbox is min lat, min lon, max lat, max lon
+	bbox opt.Option[[4]float64]
+}
+
+func (f heatmapFilter) where() (string, []any) {
+	conds := []string{
+		"user_id = (SELECT id FROM users WHERE user = ?1)",
+		"json_extract(data, '$.lat') IS NOT NULL",
+		"json_extract(data, '$.outlier') IS NULL",
+	}
+	args := []any{f.user}
+	if f.device != "" {
+		args = append(args, f.device)
+		conds = append(conds, fmt.Sprintf("device = ?%d", len(args)))
+	}
+	if from, ok := f.from.MaybeUnwrap(); ok {
+		args = append(args, from)
+		conds = append(conds, fmt.Sprintf("json_extract(data, '$.tst') >= ?%d", len(args)))
+	}
+	if to, ok := f.to.MaybeUnwrap(); ok {
+		args = append(args, to)
+		conds = append(conds, fmt.Sprintf("json_extract(data, '$.tst') <= ?%d", len(args)))
+	}
+	if b, ok := f.bbox.MaybeUnwrap(); ok {
+		args = append(args, b[0], b[2])
+		conds = append(conds, fmt.Sprintf("json_extract(data, '$.lat') BETWEEN ?%d AND ?%d", len(args)-1, len(args)))
+		if b[1] <= b[3] {
+			args = append(args, b[1], b[3])
+			conds = append(conds, fmt.Sprintf("json_extract(data, '$.lon') BETWEEN ?%d AND ?%d", len(args)-1, len(args)))
+		} else {
+			// the box crosses the antimeridian
+			args = append(args, b[1], b[3])
+			conds = append(conds, fmt.Sprintf("(json_extract(data, '$.lon') >= ?%d OR json_extract(data, '$.lon') <= ?%d)", len(args)-1, len(args)))
+		}
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// parseBBox parses "min_lon,min_lat,max_lon,max_lat", the order used by
+// GeoJSON and most map libraries.
+func parseBBox(s string) ([4]float64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return [4]float64{}, badRequest("invalid bbox %q, expected min_lon,min_lat,max_lon,max_lat", s)
+	}
+	var v [4]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return [4]float64{}, badRequest("invalid bbox %q, expected min_lon,min_lat,max_lon,max_lat", s)
+		}
+		v[i] = f
+	}
+	if v[1] > v[3] {
+		return [4]float64{}, badRequest("invalid bbox %q, min_lat is above max_lat", s)
+	}
+	return [4]float64{v[1], v[0], v[3], v[2]}, nil
+}
+
+// heatmapPoints calls fn with the position of each report matching f.
+func heatmapPoints(conn *sqlite.Conn, f heatmapFilter, fn func(lat, lon float64)) error {
+	where, args := f.where()
+	query := fmt.Sprintf(`
+		SELECT json_extract(data, '$.lat'), json_extract(data, '$.lon')
+		FROM location_reports
+		WHERE %s
+	`, where)
+	if err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			fn(stmt.ColumnFloat(0), stmt.ColumnFloat(1))
+			return nil
+		},
+	}); err != nil {
+		return errors.Wrap(err, "failed to query reports")
+	}
+	return nil
+}
+
+type heatmapCell struct {
+	// Cell is a geohash or a z/x/y tile.
+	Cell  string  `json:"cell"`
+	Lat   float64 `json:"lat"`
+	Lon   float64 `json:"lon"`
+	Count int     `json:"count"`
+}
+
+var errTooManyCells = badRequest("too many cells, use a coarser precision or zoom, a bbox or a shorter time window")
+
+// heatmapGeohashCells counts reports per geohash prefix of the given
+// precision.
+func heatmapGeohashCells(conn *sqlite.Conn, f heatmapFilter, precision int) ([]heatmapCell, error) {
+	where, args := f.where()
+	args = append(args, precision)
+	query := fmt.Sprintf(`
+		SELECT substr(json_extract(data, '$.ghash'), 1, ?%d) AS cell, COUNT(*)
+		FROM location_reports
+		WHERE %s AND json_extract(data, '$.ghash') IS NOT NULL
+		GROUP BY cell
+		ORDER BY cell
+	`, len(args), where)
+	cells := []heatmapCell{}
+	if err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			if len(cells) >= heatmapMaxCells {
+				return errTooManyCells
+			}
+			c := heatmapCell{Cell: stmt.ColumnText(0), Count: stmt.ColumnInt(1)}
+			c.Lat, c.Lon = geohash.DecodeCenter(c.Cell)
+			cells = append(cells, c)
+			return nil
+		},
+	}); err != nil {
+		if isHTTPError(err) {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "failed to query reports")
+	}
+	return cells, nil
+}
+
+// heatmapTileCells counts reports per slippy map tile at zoom z.
+func heatmapTileCells(conn *sqlite.Conn, f heatmapFilter, z int) ([]heatmapCell, error) {
+	counts := map[tile]int{}
+	tooMany := false
+	if err := heatmapPoints(conn, f, func(lat, lon float64) {
+		t := tileAt(lat, lon, z)
+		if _, ok := counts[t]; !ok && len(counts) >= heatmapMaxCells {
+			tooMany = true
+			return
+		}
+		counts[t]++
+	}); err != nil {
+		return nil, err
+	}
+	if tooMany {
+		return nil, errTooManyCells
+	}
+	tiles := make([]tile, 0, len(counts))
+	for t := range counts {
+		tiles = append(tiles, t)
+	}
+	slices.SortFunc(tiles, func(a, b tile) int {
+		if a.x != b.x {
+			return a.x - b.x
+		}
+		return a.y - b.y
+	})
+	cells := make([]heatmapCell, len(tiles))
+	for i, t := range tiles {
+		cells[i] = heatmapCell{Cell: t.String(), Count: counts[t]}
+		cells[i].Lat, cells[i].Lon = t.center()
+	}
+	return cells, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// newImportedOTLocation creates a location report for a point imported from
+// another source.
+func newImportedOTLocation(lat, lon float64, tst time.Time, source string) otLocation {
+	return otLocation{
+		"_type":   "location",
+		"lat":     lat,
+		"lon":     lon,
+		"tst":     float64(tst.Unix()),
+		"t":       otTriggerImport,
+		"_source": source,
+	}
+}
+
+// importStats counts what happened to the reports handed to a reportImporter.
+type importStats struct {
+	Inserted   int `json:"inserted"`
+	Duplicates int `json:"duplicates"`
+	Rejected   int `json:"rejected"`
+}
+
+func (s importStats) String() string {
+	return fmt.Sprintf("%d inserted, %d duplicates, %d rejected", s.Inserted, s.Duplicates, s.Rejected)
+}
+
+func (s *importStats) add(o importStats) {
+	s.Inserted += o.Inserted
+	s.Duplicates += o.Duplicates
+	s.Rejected += o.Rejected
+}
+
+// reportImporter bulk inserts historical location reports. Reports are
+// written in transactions of batchSize reports and a report is skipped when
+// its device already has a report with the same timestamp.
+//
+// In dryRun mode everything is written in a single transaction which is
+// rolled back on flush, so the stats still tell what an import would do.
+type reportImporter struct {
+	conn      *sqlite.Conn
+	batchSize int
+	dryRun    bool
+	stats     importStats
+	onFlush   func(importStats)
+
+	userIDs map[string]int
+	pending int
+	release func(*error)
+}
+
+func newReportImporter(conn *sqlite.Conn, batchSize int) *reportImporter {
+	return &reportImporter{
+		conn:      conn,
+		batchSize: max(batchSize, 1),
+		userIDs:   map[string]int{},
+	}
+}
+
+// rejectedError is returned for reports that could not be imported. The
+// import can carry on with the next report.
+type rejectedError struct {
+	error
+}
+
+func (r rejectedError) Unwrap() error {
+	return r.error
+}
+
+func isRejected(err error) bool {
+	var r rejectedError
+	return errors.As(err, &r)
+}
+
+// reject records that a report could not be imported because of err.
+func (i *reportImporter) reject(err error) error {
+	i.stats.Rejected++
+	return rejectedError{err}
+}
+
+func (i *reportImporter) add(ctx context.Context, user, device string, otdata otLocation) error {
+	if err := enrichOTLocationData(ctx, user, device, otdata); err != nil {
+		return i.reject(err)
+	}
+	tst, ok := readInt(otdata, "tst").MaybeUnwrap()
+	if !ok {
+		return i.reject(badRequest("missing tst timestamp"))
+	}
+
+	if i.release == nil {
+		i.release = sqlitex.Save(i.conn)
+	}
+
+	userID, ok := i.userIDs[user]
+	if !ok {
+		var err error
+		if userID, err = getUserID(ctx, i.conn, user); err != nil {
+			return i.abort(errors.Wrap(err, "failed to get user id"))
+		}
+		i.userIDs[user] = userID
+	}
+
+	const insertSQL = `
+		INSERT INTO location_reports (user_id, device, data)
+		SELECT ?1, ?2, ?3
+		WHERE NOT EXISTS (
+			SELECT 1
+			FROM location_reports
+			WHERE user_id = ?1
+				AND device = ?2
+				AND json_extract(data, '$.tst') = ?4
+		)
+	`
+	if err := sqlitex.Execute(i.conn, insertSQL, &sqlitex.ExecOptions{
+		Args: []any{
+			userID,
+			device,
+			string(mustJSONEncode(otdata)),
+			tst,
+		},
+	}); err != nil {
+		return i.abort(errors.Wrap(err, "failed to insert location report"))
+	}
+	if i.conn.Changes() == 0 {
+		i.stats.Duplicates++
+	} else {
+		i.stats.Inserted++
+	}
+
+	i.pending++
+	if !i.dryRun && i.pending >= i.batchSize {
+		return i.flush()
+	}
+	return nil
+}
+
+var errDryRun = errors.New("dry run")
+
+// flush commits the current batch, or rolls it back in dryRun mode.
+func (i *reportImporter) flush() (err error) {
+	if i.release == nil {
+		return nil
+	}
+	if i.dryRun {
+		rollback := errDryRun
+		i.release(&rollback)
+		i.release = nil
+		i.pending = 0
+		return nil
+	}
+	i.release(&err)
+	i.release = nil
+	i.pending = 0
+	if err != nil {
+		return errors.Wrap(err, "failed to commit batch")
+	}
+	if i.onFlush != nil {
+		i.onFlush(i.stats)
+	}
+	return nil
+}
+
+// abort rolls back the current batch.
+func (i *reportImporter) abort(err error) error {
+	if i.release != nil {
+		i.release(&err)
+		i.release = nil
+		i.pending = 0
+	}
+	return err
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// trackFileReaders read the track points out of the file formats gps loggers
+// commonly export. fn is called for each point, or with the error for a point
+// that could not be converted.
+var trackFileReaders = map[string]func(r io.Reader, fn func(otLocation, error) error) error{
+	"gpx":     readGPX,
+	"kml":     readKML,
+	"geojson": readGeoJSON,
+}
+
+// importTrackFile imports every point read from r, points that can not be
+// converted are counted as rejected.
+func importTrackFile(ctx context.Context, imp *reportImporter, read func(io.Reader, func(otLocation, error) error) error, user, device string, r io.Reader) error {
+	var addErr error
+	err := read(r, func(loc otLocation, err error) error {
+		if err != nil {
+			imp.reject(err)
+			return nil
+		}
+		if err := imp.add(ctx, user, device, loc); err != nil && !isRejected(err) {
+			addErr = err
+			return err
+		}
+		return nil
+	})
+	if addErr != nil {
+		return imp.abort(errors.WithStack(addErr))
+	}
+	if err != nil {
+		return imp.abort(badRequest("invalid file: %s", err.Error()))
+	}
+	return imp.flush()
+}
+
+func parseTrackTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(s))
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "invalid time")
+	}
+	return t, nil
+}
+
+type gpxPoint struct {
+	Lat   float64  `xml:"lat,attr"`
+	Lon   float64  `xml:"lon,attr"`
+	Ele   *float64 `xml:"ele"`
+	Time  string   `xml:"time"`
+	Speed *float64 `xml:"speed"`
+	Hdop  *float64 `xml:"hdop"`
+}
+
+func (p gpxPoint) toOTLocation() (otLocation, error) {
+	if p.Time == "" {
+		return nil, fmt.Errorf("track point without time")
+	}
+	tst, err := parseTrackTime(p.Time)
+	if err != nil {
+		return nil, err
+	}
+	otdata := newImportedOTLocation(p.Lat, p.Lon, tst, "gpx")
+	if p.Ele != nil {
+		otdata["alt"] = float64(int(*p.Ele))
+	}
+	if p.Speed != nil {
+		// gpx speeds are m/s, owntracks uses km/h
+		otdata["vel"] = float64(int(*p.Speed * 3.6))
+	}
+	if p.Hdop != nil {
+		// rough conversion of the dilution of precision into meters
+		otdata["acc"] = float64(int(*p.Hdop * 5))
+	}
+	return otdata, nil
+}
+
+func readGPX(r io.Reader, fn func(otLocation, error) error) error {
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "failed to read gpx")
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch se.Name.Local {
+		case "trkpt", "rtept", "wpt":
+		default:
+			continue
+		}
+		var p gpxPoint
+		if err := dec.DecodeElement(&p, &se); err != nil {
+			return errors.Wrap(err, "failed to read gpx point")
+		}
+		if err := fn(p.toOTLocation()); err != nil {
+			return err
+		}
+	}
+}
+
+// kmlCoord parses a kml coordinate, which is "lon,lat[,alt]" in a <Point> and
+// "lon lat [alt]" in a <gx:Track>.
+func kmlCoord(s string) (otLocation, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid coordinate: %q", s)
+	}
+	var nums []float64
+	for _, f := range fields {
+		n, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid coordinate: %q", s)
+		}
+		nums = append(nums, n)
+	}
+	otdata := otLocation{"lat": nums[1], "lon": nums[0]}
+	if len(nums) > 2 {
+		otdata["alt"] = float64(int(nums[2]))
+	}
+	return otdata, nil
+}
+
+type kmlTrack struct {
+	When  []string `xml:"when"`
+	Coord []string `xml:"coord"`
+}
+
+type kmlPlacemark struct {
+	TimeStamp struct {
+		When string `xml:"when"`
+	} `xml:"TimeStamp"`
+	Point struct {
+		Coordinates string `xml:"coordinates"`
+	} `xml:"Point"`
+	Tracks      []kmlTrack `xml:"Track"`
+	MultiTracks []struct {
+		Tracks []kmlTrack `xml:"Track"`
+	} `xml:"MultiTrack"`
+}
+
+func kmlPoint(coord, when string) (otLocation, error) {
+	c, err := kmlCoord(coord)
+	if err != nil {
+		return nil, err
+	}
+	tst, err := parseTrackTime(when)
+	if err != nil {
+		return nil, err
+	}
+	otdata := newImportedOTLocation(c["lat"].(float64), c["lon"].(float64), tst, "kml")
+	if alt, ok := c["alt"]; ok {
+		otdata["alt"] = alt
+	}
+	return otdata, nil
+}
+
+func readKML(r io.Reader, fn func(otLocation, error) error) error {
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "failed to read kml")
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != "Placemark" {
+			continue
+		}
+		var pm kmlPlacemark
+		if err := dec.DecodeElement(&pm, &se); err != nil {
+			return errors.Wrap(err, "failed to read kml placemark")
+		}
+
+		if c := strings.TrimSpace(pm.Point.Coordinates); c != "" {
+			if pm.TimeStamp.When == "" {
+				err = fn(nil, fmt.Errorf("placemark without timestamp"))
+			} else {
+				err = fn(kmlPoint(c, pm.TimeStamp.When))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		tracks := pm.Tracks
+		for _, mt := range pm.MultiTracks {
+			tracks = append(tracks, mt.Tracks...)
+		}
+		for _, t := range tracks {
+			if len(t.When) != len(t.Coord) {
+				if err := fn(nil, fmt.Errorf("track has %d times for %d coordinates", len(t.When), len(t.Coord))); err != nil {
+					return err
+				}
+				continue
+			}
+			for i := range t.When {
+				if err := fn(kmlPoint(t.Coord[i], t.When[i])); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+type geoJSONFeature struct {
+	Type     string `json:"type"`
+	Geometry struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	} `json:"geometry"`
+	Properties map[string]any   `json:"properties"`
+	Features   []geoJSONFeature `json:"features"`
+}
+
+// geoJSONPoint converts a [lon, lat, alt?] position.
+func geoJSONPoint(pos []float64, tst time.Time) (otLocation, error) {
+	if len(pos) < 2 {
+		return nil, fmt.Errorf("invalid position")
+	}
+	otdata := newImportedOTLocation(pos[1], pos[0], tst, "geojson")
+	if len(pos) > 2 {
+		otdata["alt"] = float64(int(pos[2]))
+	}
+	return otdata, nil
+}
+
+// times returns the times of a feature, either a single "time" or
+// "timestamp" property or the "coordTimes" list that togeojson writes for
+// lines, which it nests per line for multi lines.
+func (f geoJSONFeature) times() ([]time.Time, error) {
+	for _, key := range []string{"coordTimes", "time", "timestamp"} {
+		if t, ok := f.Properties[key]; ok {
+			return appendGeoJSONTimes(nil, t)
+		}
+	}
+	return nil, nil
+}
+
+// appendGeoJSONTimes appends the time t to out, or all the times in it if it
+// is a list.
+func appendGeoJSONTimes(out []time.Time, t any) ([]time.Time, error) {
+	switch t := t.(type) {
+	case []any:
+		for _, t := range t {
+			var err error
+			if out, err = appendGeoJSONTimes(out, t); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case string:
+		tt, err := parseTrackTime(t)
+		if err != nil {
+			return nil, err
+		}
+		return append(out, tt), nil
+	case float64:
+		return append(out, time.Unix(int64(t), 0)), nil
+	default:
+		return nil, fmt.Errorf("invalid time: %v", t)
+	}
+}
+
+func (f geoJSONFeature) read(fn func(otLocation, error) error) error {
+	switch f.Type {
+	case "FeatureCollection":
+		for _, child := range f.Features {
+			if err := child.read(fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "Feature":
+	default:
+		return fn(nil, fmt.Errorf("unsupported geojson type: %q", f.Type))
+	}
+
+	times, err := f.times()
+	if err != nil {
+		return fn(nil, err)
+	}
+	var lines [][][]float64
+	switch f.Geometry.Type {
+	case "Point":
+		var pos []float64
+		if err := json.Unmarshal(f.Geometry.Coordinates, &pos); err != nil {
+			return fn(nil, errors.Wrap(err, "invalid point"))
+		}
+		lines = [][][]float64{{pos}}
+	case "LineString":
+		var line [][]float64
+		if err := json.Unmarshal(f.Geometry.Coordinates, &line); err != nil {
+			return fn(nil, errors.Wrap(err, "invalid line string"))
+		}
+		lines = [][][]float64{line}
+	case "MultiLineString":
+		if err := json.Unmarshal(f.Geometry.Coordinates, &lines); err != nil {
+			return fn(nil, errors.Wrap(err, "invalid multi line string"))
+		}
+	default:
+		return fn(nil, fmt.Errorf("unsupported geometry: %q", f.Geometry.Type))
+	}
+
+	n := 0
+	for _, line := range lines {
+		n += len(line)
+	}
+	if len(times) != n {
+		return fn(nil, fmt.Errorf("feature has %d times for %d positions", len(times), n))
+	}
+	i := 0
+	for _, line := range lines {
+		for _, pos := range line {
+			if err := fn(geoJSONPoint(pos, times[i])); err != nil {
+				return err
+			}
+			i++
+		}
+	}
+	return nil
+}
+
+func readGeoJSON(r io.Reader, fn func(otLocation, error) error) error {
+	var f geoJSONFeature
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return errors.Wrap(err, "failed to read geojson")
+	}
+	return f.read(fn)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// readTrack reads a track file and returns its positions as "lat,lon@tst",
+// or the errors of positions that could not be read.
+func readTrack(t *testing.T, read func(io.Reader, func(otLocation, error) error) error, doc string) []string {
+	t.Helper()
+	var out []string
+	err := read(strings.NewReader(doc), func(loc otLocation, err error) error {
+		if err != nil {
+			out = append(out, "error: "+err.Error())
+			return nil
+		}
+		out = append(out, fmt.Sprintf("%v,%v@%.0f", loc["lat"], loc["lon"], loc["tst"]))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	return out
+}
+
+func TestReadGeoJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		doc  string
+		want []string
+	}{
+		{
+			name: "togeojson multi line string",
+			// togeojson converts a gpx track with two segments like this,
+			// with the times nested per segment
+			doc: `{"type":"FeatureCollection","features":[{
+				"type":"Feature",
+				"properties":{
+					"name":"Morning run",
+					"time":"2024-05-01T08:00:00Z",
+					"coordTimes":[
+						["2024-05-01T08:00:00Z","2024-05-01T08:00:10Z"],
+						["2024-05-01T08:05:00Z"]
+					]
+				},
+				"geometry":{"type":"MultiLineString","coordinates":[
+					[[13.4,52.5,34],[13.41,52.51,35]],
+					[[13.42,52.52,36]]
+				]}
+			}]}`,
+			want: []string{
+				"52.5,13.4@1714550400",
+				"52.51,13.41@1714550410",
+				"52.52,13.42@1714550700",
+			},
+		},
+		{
+			name: "line string",
+			doc: `{"type":"Feature",
+				"properties":{"coordTimes":["2024-05-01T08:00:00Z",1714550410]},
+				"geometry":{"type":"LineString","coordinates":[[13.4,52.5],[13.41,52.51]]}
+			}`,
+			want: []string{
+				"52.5,13.4@1714550400",
+				"52.51,13.41@1714550410",
+			},
+		},
+		{
+			name: "point",
+			doc: `{"type":"Feature",
+				"properties":{"timestamp":"2024-05-01T08:00:00Z"},
+				"geometry":{"type":"Point","coordinates":[13.4,52.5]}
+			}`,
+			want: []string{"52.5,13.4@1714550400"},
+		},
+		{
+			name: "times missing for a segment",
+			doc: `{"type":"Feature",
+				"properties":{"coordTimes":[["2024-05-01T08:00:00Z"]]},
+				"geometry":{"type":"MultiLineString","coordinates":[[[13.4,52.5]],[[13.41,52.51]]]}
+			}`,
+			want: []string{"error: feature has 1 times for 2 positions"},
+		},
+		{
+			name: "invalid nested time",
+			doc: `{"type":"Feature",
+				"properties":{"coordTimes":[[true]]},
+				"geometry":{"type":"MultiLineString","coordinates":[[[13.4,52.5]]]}
+			}`,
+			want: []string{"error: invalid time: true"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := readTrack(t, readGeoJSON, tc.doc)
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+			}
+		})
+	}
+}
@@ -8,13 +8,19 @@ import (
 	"log/slog"
 	gohttp "net/http"
 	"reflect"
-	"strconv"
+	"slices"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-kit/kit/transport"
 	"github.com/go-kit/kit/transport/http"
 	"github.com/go-kit/log"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Endpoint[Request, Response any] func(ctx context.Context, request Request) (response Response, err error)
@@ -52,21 +58,70 @@ func (slogger) Log(keyvals ...interface{}) error {
 type errorHandler struct {
 }
 
+// Handle logs errors, only those that end in a 5xx response are server
+// errors, the others are the client's and logged at info level.
 func (errorHandler) Handle(ctx context.Context, err error) {
-	slog.Error("server_error", slog.String("error", err.Error()))
+	status, _ := statusCode(err)
+	msg, level := "server_error", slog.LevelError
+	if status < 500 {
+		msg, level = "client_error", slog.LevelInfo
+	}
+	slog.Log(ctx, level, msg,
+		slog.String("error", err.Error()),
+		slog.Int("status", status),
+		slog.String("request_id", requestID(ctx)),
+	)
 }
 
 var _ transport.ErrorHandler = errorHandler{}
 
+var tracer = otel.Tracer("code.nkcmr.net/gotracks/internal/ep")
+
+// startSpan continues the trace of the caller, if the request carries one, in
+// a server span named after the matched route.
+func startSpan(ctx context.Context, r *gohttp.Request) context.Context {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+	route := r.URL.Path
+	if rctx := chi.RouteContext(ctx); rctx != nil && rctx.RoutePattern() != "" {
+		route = rctx.RoutePattern()
+	}
+	ctx, _ = tracer.Start(ctx, r.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+		),
+	)
+	return ctx
+}
+
+func endSpan(ctx context.Context, code int, _ *gohttp.Request) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Int("http.response.status_code", code))
+	if code >= 500 {
+		span.SetStatus(codes.Error, gohttp.StatusText(code))
+	}
+	span.End()
+}
+
 func New[Request, Response any](
 	ep Endpoint[Request, Response],
 	dec DecodeRequestFunc[Request],
 	enc EncodeResponseFunc[Response],
 	options ...Option,
 ) *Server {
+	options = append([]Option{
+		http.ServerBefore(startSpan),
+		http.ServerFinalizer(endSpan),
+		http.ServerErrorEncoder(EncodeProblem),
+	}, options...)
 	return http.NewServer(
 		func(ctx context.Context, request interface{}) (response interface{}, err error) {
-			return ep(ctx, request.(Request))
+			response, err = ep(ctx, request.(Request))
+			if err != nil {
+				trace.SpanFromContext(ctx).RecordError(err)
+			}
+			return response, err
 		},
 		func(ctx context.Context, r *gohttp.Request) (request interface{}, err error) {
 			return dec(ctx, r)
@@ -93,71 +148,174 @@ var unsignedIntBitSizeMap = map[reflect.Kind]int{
 	reflect.Uint64: 64,
 }
 
-func reqValueExtracter[Request any](
-	getvalue func(r *gohttp.Request, key string) []string,
-	keyFields map[string]int,
-) func(ctx context.Context, r *gohttp.Request, request *Request) error {
+// paramSource is a place a field's value is read from, like the "q" query
+// param.
+type paramSource struct {
+	in  string
+	key string
+}
 
-	return func(ctx context.Context, r *gohttp.Request, request *Request) error {
-		rv := reflect.ValueOf(request).Elem()
-		for key, fieldIndex := range keyFields {
-			sf := rv.Type().Field(fieldIndex)
-			values := getvalue(r, key)
-			if len(values) == 0 {
-				continue
+var paramGetters = map[string]func(r *gohttp.Request, key string) []string{
+	"query": func(r *gohttp.Request, key string) []string {
+		return r.URL.Query()[key]
+	},
+	"route": func(r *gohttp.Request, key string) []string {
+		v := chi.URLParam(r, key)
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	},
+	"header": func(r *gohttp.Request, key string) []string {
+		return r.Header.Values(key)
+	},
+}
+
+// values returns the non empty values of the source in r.
+func (s paramSource) values(r *gohttp.Request) []string {
+	return slices.DeleteFunc(slices.Clone(paramGetters[s.in](r, s.key)), func(v string) bool {
+		return v == ""
+	})
+}
+
+// paramField is a field that is set from query params, route params or
+// headers.
+type paramField struct {
+	index   int
+	sources []paramSource
+	set     func(fv reflect.Value, values []string) error
+	validation
+}
+
+// bodyField is a json decoded field that has a validate tag.
+type bodyField struct {
+	index int
+	name  string
+	validation
+}
+
+func decodeParams(r *gohttp.Request, rv reflect.Value, fields []paramField) []InvalidParam {
+	var invalid []InvalidParam
+	for _, f := range fields {
+		src := f.sources[0]
+		var values []string
+		for _, s := range f.sources {
+			// the sources are in query, route, header order and the last
+			// one that is given wins
+			if vs := s.values(r); len(vs) > 0 {
+				src, values = s, vs
 			}
-			switch sf.Type.Kind() {
-			case reflect.String:
-				rv.Field(fieldIndex).Set(reflect.ValueOf(values[0]))
-			case reflect.Bool:
-				b, err := strconv.ParseBool(values[0])
-				if err != nil {
-					return errors.Wrapf(err, `failed to parse "%s" as boolean`, key)
-				}
-				rv.Field(fieldIndex).Set(reflect.ValueOf(b).Convert(sf.Type))
-			default:
-				if bitSize, ok := signedIntBitSizeMap[sf.Type.Kind()]; ok {
-					n, err := strconv.ParseInt(values[0], 10, bitSize)
-					if err != nil {
-						return errors.Wrapf(err, "failed to parse %d bit int", bitSize)
-					}
-					rv.Field(fieldIndex).Set(reflect.ValueOf(n).Convert(sf.Type))
-				} else if bitSize, ok := unsignedIntBitSizeMap[sf.Type.Kind()]; ok {
-					n, err := strconv.ParseUint(values[0], 10, bitSize)
-					if err != nil {
-						return errors.Wrapf(err, "failed to parse %d bit uint", bitSize)
-					}
-					rv.Field(fieldIndex).Set(reflect.ValueOf(n).Convert(sf.Type))
-				} else {
-					return fmt.Errorf("unsupported reflection kind %s", sf.Type.Kind())
-				}
+		}
+		if len(values) == 0 {
+			if f.required {
+				invalid = append(invalid, InvalidParam{Name: src.key, In: src.in, Reason: "is required"})
 			}
+			continue
 		}
+		fv := rv.Field(f.index)
+		if err := f.set(fv, values); err != nil {
+			invalid = append(invalid, InvalidParam{Name: src.key, In: src.in, Reason: err.Error()})
+			continue
+		}
+		for _, reason := range f.check(fv) {
+			invalid = append(invalid, InvalidParam{Name: src.key, In: src.in, Reason: reason})
+		}
+	}
+	return invalid
+}
+
+func validateBody(rv reflect.Value, fields []bodyField) []InvalidParam {
+	var invalid []InvalidParam
+	for _, f := range fields {
+		fv := rv.Field(f.index)
+		given := !fv.IsZero()
+		if ot, ok := optionTypes[fv.Type()]; ok {
+			_, given = ot.get(fv)
+		}
+		if !given {
+			if f.required {
+				invalid = append(invalid, InvalidParam{Name: f.name, In: "body", Reason: "is required"})
+			}
+			continue
+		}
+		for _, reason := range f.check(fv) {
+			invalid = append(invalid, InvalidParam{Name: f.name, In: "body", Reason: reason})
+		}
+	}
+	return invalid
+}
+
+// readBody reads the whole request body, a body the client failed to send is
+// a *ValidationError like any other invalid input.
+func readBody(r *gohttp.Request) ([]byte, error) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, &ValidationError{Params: []InvalidParam{{Name: "body", In: "body", Reason: "could not be read: " + err.Error()}}}
+	}
+	return b, nil
+}
+
+// decodeJSONBody decodes b into request, reporting malformed json and fields
+// of the wrong type as a *ValidationError.
+func decodeJSONBody(b []byte, request any) error {
+	err := json.Unmarshal(b, request)
+	if err == nil {
 		return nil
 	}
+	var ute *json.UnmarshalTypeError
+	if errors.As(err, &ute) && ute.Field != "" {
+		return &ValidationError{Params: []InvalidParam{{Name: ute.Field, In: "body", Reason: "cannot be a json " + ute.Value}}}
+	}
+	return &ValidationError{Params: []InvalidParam{{Name: "body", In: "body", Reason: "is not valid json: " + err.Error()}}}
 }
 
+// AutoDecode decodes requests into the fields of Request by their tags:
+// `query`, `route` and `header` fields are set from the param with that name,
+// `json` fields from the body, and a []byte field named Body gets the raw
+// body. Params can be decoded into strings, bools, numbers, time.Time (RFC
+// 3339, or the layout in a `layout` tag), encoding.TextUnmarshaler types,
+// opt.Option of those and slices of those, which take every value of repeated
+// params. Fields are checked against their `validate` tag, see validation,
+// and every invalid field is listed in a *ValidationError.
+//
+// AutoDecode panics if a field has an unsupported type or validate tag.
 func AutoDecode[Request any]() func(ctx context.Context, r *gohttp.Request) (Request, error) {
 	steps := []func(ctx context.Context, r *gohttp.Request, request *Request) error{}
 	rt := reflect.TypeFor[Request]()
-	queryVars := map[string]int{}
-	routeVars := map[string]int{}
-	headerVars := map[string]int{}
+	params := []paramField{}
+	bodyFields := []bodyField{}
 	doJsonDecode := false
 	doPassDirectBody := int(-1)
 	for i := range rt.NumField() {
 		sf := rt.Field(i)
-		if queryKey := sf.Tag.Get("query"); queryKey != "" {
-			queryVars[queryKey] = i
+		vd, err := parseValidation(sf)
+		if err != nil {
+			panic(fmt.Sprintf("ep: %s.%s: %s", rt.Name(), sf.Name, err.Error()))
 		}
-		if routeKey := sf.Tag.Get("route"); routeKey != "" {
-			routeVars[routeKey] = i
+		var sources []paramSource
+		for _, in := range []string{"query", "route", "header"} {
+			if key := sf.Tag.Get(in); key != "" {
+				sources = append(sources, paramSource{in: in, key: key})
+			}
 		}
-		if headerKey := sf.Tag.Get("header"); headerKey != "" {
-			headerVars[headerKey] = i
+		if len(sources) > 0 {
+			set, err := paramSetter(sf)
+			if err != nil {
+				panic(fmt.Sprintf("ep: %s.%s: %s", rt.Name(), sf.Name, err.Error()))
+			}
+			params = append(params, paramField{index: i, sources: sources, set: set, validation: vd})
 		}
-		if sf.Tag.Get("json") != "" {
+		if jsonTag := sf.Tag.Get("json"); jsonTag != "" {
 			doJsonDecode = true
+			if sf.Tag.Get("validate") != "" {
+				name, _, _ := strings.Cut(jsonTag, ",")
+				if name == "" {
+					name = sf.Name
+				}
+				bodyFields = append(bodyFields, bodyField{index: i, name: name, validation: vd})
+			}
+		} else if len(sources) == 0 && sf.Tag.Get("validate") != "" {
+			panic(fmt.Sprintf("ep: %s.%s: validate tag on a field that is not decoded", rt.Name(), sf.Name))
 		}
 		if sf.Name == "Body" && sf.Type == reflect.TypeFor[[]byte]() {
 			if doPassDirectBody == -1 {
@@ -168,15 +326,14 @@ func AutoDecode[Request any]() func(ctx context.Context, r *gohttp.Request) (Req
 
 	if doJsonDecode && (doPassDirectBody >= 0) {
 		steps = append(steps, func(ctx context.Context, r *gohttp.Request, request *Request) error {
-			defer r.Body.Close()
-			reqbytes, err := io.ReadAll(r.Body)
+			reqbytes, err := readBody(r)
 			if err != nil {
-				return errors.Wrap(err, "failed to read request body")
+				return err
 			}
 
 			// json decode
-			if err := json.Unmarshal(reqbytes, request); err != nil {
-				return errors.Wrap(err, "failed to json decode request body")
+			if err := decodeJSONBody(reqbytes, request); err != nil {
+				return err
 			}
 
 			// assign request bytes to struct
@@ -186,22 +343,17 @@ func AutoDecode[Request any]() func(ctx context.Context, r *gohttp.Request) (Req
 		})
 	} else if doJsonDecode {
 		steps = append(steps, func(ctx context.Context, r *gohttp.Request, request *Request) error {
-			defer r.Body.Close()
-			jbytes, err := io.ReadAll(r.Body)
+			jbytes, err := readBody(r)
 			if err != nil {
-				return errors.Wrap(err, "failed to read request body")
+				return err
 			}
-			if err := json.Unmarshal(jbytes, request); err != nil {
-				return errors.Wrap(err, "failed to json decode request body")
-			}
-			return nil
+			return decodeJSONBody(jbytes, request)
 		})
 	} else if doPassDirectBody >= 0 {
 		steps = append(steps, func(ctx context.Context, r *gohttp.Request, request *Request) error {
-			defer r.Body.Close()
-			reqbytes, err := io.ReadAll(r.Body)
+			reqbytes, err := readBody(r)
 			if err != nil {
-				return errors.Wrap(err, "failed to read request body")
+				return err
 			}
 			rv := reflect.ValueOf(request).Elem()
 			rv.Field(doPassDirectBody).Set(reflect.ValueOf(reqbytes))
@@ -209,33 +361,16 @@ func AutoDecode[Request any]() func(ctx context.Context, r *gohttp.Request) (Req
 		})
 	}
 
-	if len(queryVars) > 0 {
-		steps = append(steps, reqValueExtracter[Request](
-			func(r *gohttp.Request, key string) []string {
-				return r.URL.Query()[key]
-			},
-			queryVars,
-		))
-	}
-	if len(routeVars) > 0 {
-		steps = append(steps, reqValueExtracter[Request](
-			func(r *gohttp.Request, key string) []string {
-				v := chi.URLParam(r, key)
-				if v == "" {
-					return nil
-				}
-				return []string{v}
-			},
-			routeVars,
-		))
-	}
-	if len(headerVars) > 0 {
-		steps = append(steps, reqValueExtracter[Request](
-			func(r *gohttp.Request, key string) []string {
-				return r.Header.Values(key)
-			},
-			headerVars,
-		))
+	if len(params) > 0 || len(bodyFields) > 0 {
+		steps = append(steps, func(ctx context.Context, r *gohttp.Request, request *Request) error {
+			rv := reflect.ValueOf(request).Elem()
+			invalid := decodeParams(r, rv, params)
+			invalid = append(invalid, validateBody(rv, bodyFields)...)
+			if len(invalid) > 0 {
+				return &ValidationError{Params: invalid}
+			}
+			return nil
+		})
 	}
 	return func(ctx context.Context, r *gohttp.Request) (Request, error) {
 		var req Request
@@ -0,0 +1,91 @@
+package ep
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	gohttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestAutoDecodeBody(t *testing.T) {
+	decodeJSON := AutoDecode[struct {
+		Name  string `json:"name" validate:"required"`
+		Count int    `json:"count"`
+	}]()
+	decodeRaw := AutoDecode[struct {
+		Body []byte
+	}]()
+	for _, tc := range []struct {
+		name   string
+		decode func(context.Context, *gohttp.Request) error
+		req    *gohttp.Request
+		param  InvalidParam
+	}{
+		{
+			name:   "malformed json",
+			decode: func(ctx context.Context, r *gohttp.Request) error { _, err := decodeJSON(ctx, r); return err },
+			req:    httptest.NewRequest("POST", "/", strings.NewReader(`{"name":`)),
+			param:  InvalidParam{Name: "body", In: "body"},
+		},
+		{
+			name:   "wrong type",
+			decode: func(ctx context.Context, r *gohttp.Request) error { _, err := decodeJSON(ctx, r); return err },
+			req:    httptest.NewRequest("POST", "/", strings.NewReader(`{"name":"a","count":"1"}`)),
+			param:  InvalidParam{Name: "count", In: "body", Reason: "cannot be a json string"},
+		},
+		{
+			name:   "unreadable body",
+			decode: func(ctx context.Context, r *gohttp.Request) error { _, err := decodeRaw(ctx, r); return err },
+			req:    httptest.NewRequest("POST", "/", iotest.ErrReader(errors.New("connection reset"))),
+			param:  InvalidParam{Name: "body", In: "body", Reason: "could not be read: connection reset"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.decode(context.Background(), tc.req)
+			if err == nil {
+				t.Fatal("no error")
+			}
+			rec := httptest.NewRecorder()
+			EncodeProblem(context.Background(), err, rec)
+			if rec.Code != gohttp.StatusBadRequest {
+				t.Errorf("status = %d", rec.Code)
+			}
+			var p Problem
+			if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+				t.Fatalf("failed to decode problem: %v", err)
+			}
+			if p.Code != "validation_failed" || len(p.InvalidParams) != 1 {
+				t.Fatalf("problem = %+v", p)
+			}
+			got := p.InvalidParams[0]
+			if got.Name != tc.param.Name || got.In != tc.param.In || tc.param.Reason != "" && got.Reason != tc.param.Reason {
+				t.Errorf("invalid param = %+v, want %+v", got, tc.param)
+			}
+		})
+	}
+}
+
+func TestAutoDecodePointerBounds(t *testing.T) {
+	decode := AutoDecode[struct {
+		Radius *float64 `json:"radius" validate:"min=1"`
+	}]()
+	for body, valid := range map[string]bool{
+		`{}`:              true,
+		`{"radius":null}`: true,
+		`{"radius":5}`:    true,
+		`{"radius":0}`:    false,
+		`{"radius":-1}`:   false,
+	} {
+		_, err := decode(context.Background(), httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		var ve *ValidationError
+		if valid && err != nil {
+			t.Errorf("%s: %v", body, err)
+		} else if !valid && !errors.As(err, &ve) {
+			t.Errorf("%s: error = %v, want a *ValidationError", body, err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package ep
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	gohttp "net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-kit/kit/transport/http"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Problem is the body of error responses, following RFC 9457 problem
+// details.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	// Detail is the error message, it is left out of 5xx responses so
+	// internal errors do not leak.
+	Detail string `json:"detail,omitempty"`
+	// Code is a machine readable error code, like "bad_request".
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+	// InvalidParams lists the params of a request that failed validation.
+	InvalidParams []InvalidParam `json:"invalid_params,omitempty"`
+}
+
+// ErrorCoder is implemented by errors that have a more specific code than
+// the one derived from their status code.
+type ErrorCoder interface {
+	ErrorCode() string
+}
+
+// statusCode returns the status code of the first error in err's chain that
+// has one, and that error.
+func statusCode(err error) (int, error) {
+	var sc http.StatusCoder
+	if errors.As(err, &sc) {
+		if e, ok := sc.(error); ok {
+			return sc.StatusCode(), e
+		}
+		return sc.StatusCode(), err
+	}
+	return gohttp.StatusInternalServerError, err
+}
+
+// requestID returns the id chi's RequestID middleware gave the request,
+// or the trace id when there is none.
+func requestID(ctx context.Context) string {
+	if id := middleware.GetReqID(ctx); id != "" {
+		return id
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+func codeFor(status int) string {
+	text := gohttp.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ToLower(strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text))
+}
+
+// EncodeProblem writes err as a problem details response, errors with a
+// StatusCode method anywhere in their chain set the status code, others are
+// internal server errors.
+func EncodeProblem(ctx context.Context, err error, w gohttp.ResponseWriter) {
+	status, coded := statusCode(err)
+	p := Problem{
+		Type:      "about:blank",
+		Title:     gohttp.StatusText(status),
+		Status:    status,
+		Code:      codeFor(status),
+		RequestID: requestID(ctx),
+	}
+	if status < 500 {
+		p.Detail = coded.Error()
+	}
+	var ec ErrorCoder
+	if errors.As(err, &ec) {
+		p.Code = ec.ErrorCode()
+	}
+	var ve *ValidationError
+	if errors.As(err, &ve) {
+		p.InvalidParams = ve.Params
+	}
+
+	var h http.Headerer
+	if errors.As(err, &h) {
+		for k, values := range h.Headers() {
+			for _, v := range values {
+				w.Header().Add(k, v)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	if p.RequestID != "" {
+		w.Header().Set("X-Request-Id", p.RequestID)
+	}
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		slog.Warn("failed to write error response", slog.String("err", err.Error()))
+	}
+}
@@ -0,0 +1,366 @@
+package ep
+
+import (
+	"encoding"
+	"fmt"
+	gohttp "net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"code.nkcmr.net/opt"
+)
+
+// InvalidParam is a request param that could not be decoded or failed its
+// validate tag.
+type InvalidParam struct {
+	Name string `json:"name"`
+	// In is where the param was read from: query, route, header or body.
+	In     string `json:"in"`
+	Reason string `json:"reason"`
+}
+
+// ValidationError lists every invalid param of a request, it is encoded as a
+// 400 problem with the params under "invalid_params".
+type ValidationError struct {
+	Params []InvalidParam
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Params))
+	for _, p := range e.Params {
+		msgs = append(msgs, fmt.Sprintf("%s %q %s", p.In, p.Name, p.Reason))
+	}
+	return "invalid request: " + strings.Join(msgs, "; ")
+}
+
+func (*ValidationError) StatusCode() int { return gohttp.StatusBadRequest }
+
+func (*ValidationError) ErrorCode() string { return "validation_failed" }
+
+var (
+	timeType            = reflect.TypeFor[time.Time]()
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+	textMarshalerType   = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+// optionType is an opt.Option[T] that fields can be decoded into.
+type optionType struct {
+	elem reflect.Type
+	some func(v reflect.Value) reflect.Value
+	get  func(v reflect.Value) (reflect.Value, bool)
+}
+
+// optionTypes holds the opt.Option[T] types AutoDecode supports, reflect
+// cannot instantiate opt.Some for a T only known at runtime so each T has to
+// be registered up front.
+var optionTypes = map[reflect.Type]optionType{}
+
+// RegisterOption makes opt.Option[T] fields decodable by AutoDecode, T has to
+// be decodable itself. Options of strings, bools, ints, floats and time.Time
+// are registered already. It is not safe to call concurrently with
+// AutoDecode, call it from an init func.
+func RegisterOption[T any]() {
+	optionTypes[reflect.TypeFor[opt.Option[T]]()] = optionType{
+		elem: reflect.TypeFor[T](),
+		some: func(v reflect.Value) reflect.Value {
+			return reflect.ValueOf(opt.Some(v.Interface().(T)))
+		},
+		get: func(v reflect.Value) (reflect.Value, bool) {
+			ev, ok := v.Interface().(opt.Option[T]).MaybeUnwrap()
+			return reflect.ValueOf(&ev).Elem(), ok
+		},
+	}
+}
+
+func init() {
+	RegisterOption[string]()
+	RegisterOption[bool]()
+	RegisterOption[int]()
+	RegisterOption[int64]()
+	RegisterOption[uint]()
+	RegisterOption[uint64]()
+	RegisterOption[float64]()
+	RegisterOption[time.Time]()
+}
+
+// isList reports whether fields of type t take every value of a repeated
+// param, slices that unmarshal from text themselves take a single one.
+func isList(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && !reflect.PointerTo(t).Implements(textUnmarshalerType)
+}
+
+// paramParser returns a func that parses a single param value as t, layout
+// is the time.Time layout from the field's layout tag.
+func paramParser(t reflect.Type, layout string) (func(s string) (reflect.Value, error), bool) {
+	if t == timeType && layout != "" {
+		return func(s string) (reflect.Value, error) {
+			tm, err := time.ParseInLocation(layout, s, time.UTC)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("must be a time like %q", layout)
+			}
+			return reflect.ValueOf(tm), nil
+		}, true
+	}
+	if reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		return func(s string) (reflect.Value, error) {
+			v := reflect.New(t)
+			if err := v.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s)); err != nil {
+				return reflect.Value{}, fmt.Errorf("is invalid: %s", err.Error())
+			}
+			return v.Elem(), nil
+		}, true
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return func(s string) (reflect.Value, error) {
+			return reflect.ValueOf(s).Convert(t), nil
+		}, true
+	case reflect.Bool:
+		return func(s string) (reflect.Value, error) {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("must be a boolean")
+			}
+			return reflect.ValueOf(b).Convert(t), nil
+		}, true
+	case reflect.Float32, reflect.Float64:
+		return func(s string) (reflect.Value, error) {
+			f, err := strconv.ParseFloat(s, t.Bits())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("must be a number")
+			}
+			return reflect.ValueOf(f).Convert(t), nil
+		}, true
+	}
+	if bitSize, ok := signedIntBitSizeMap[t.Kind()]; ok {
+		return func(s string) (reflect.Value, error) {
+			n, err := strconv.ParseInt(s, 10, bitSize)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("must be a %d bit integer", bitSize)
+			}
+			return reflect.ValueOf(n).Convert(t), nil
+		}, true
+	}
+	if bitSize, ok := unsignedIntBitSizeMap[t.Kind()]; ok {
+		return func(s string) (reflect.Value, error) {
+			n, err := strconv.ParseUint(s, 10, bitSize)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("must be a %d bit unsigned integer", bitSize)
+			}
+			return reflect.ValueOf(n).Convert(t), nil
+		}, true
+	}
+	return nil, false
+}
+
+// paramSetter returns a func that sets a field from the values of its param,
+// values is never empty.
+func paramSetter(sf reflect.StructField) (func(fv reflect.Value, values []string) error, error) {
+	layout := sf.Tag.Get("layout")
+	if ot, ok := optionTypes[sf.Type]; ok {
+		parse, ok := paramParser(ot.elem, layout)
+		if !ok {
+			return nil, fmt.Errorf("unsupported option type %s", sf.Type)
+		}
+		return func(fv reflect.Value, values []string) error {
+			v, err := parse(values[0])
+			if err != nil {
+				return err
+			}
+			fv.Set(ot.some(v))
+			return nil
+		}, nil
+	}
+	if parse, ok := paramParser(sf.Type, layout); ok {
+		return func(fv reflect.Value, values []string) error {
+			v, err := parse(values[0])
+			if err != nil {
+				return err
+			}
+			fv.Set(v)
+			return nil
+		}, nil
+	}
+	if isList(sf.Type) {
+		parse, ok := paramParser(sf.Type.Elem(), layout)
+		if !ok {
+			return nil, fmt.Errorf("unsupported slice element type %s", sf.Type.Elem())
+		}
+		return func(fv reflect.Value, values []string) error {
+			s := reflect.MakeSlice(sf.Type, 0, len(values))
+			for _, value := range values {
+				v, err := parse(value)
+				if err != nil {
+					return err
+				}
+				s = reflect.Append(s, v)
+			}
+			fv.Set(s)
+			return nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", sf.Type)
+}
+
+// validation holds the rules of a validate tag, a comma separated list of:
+//
+//	required       the param must be given, body fields must not be zero
+//	enum=a|b       the value must be one of the listed ones
+//	min=N, max=N   bounds of numbers, of the length of strings and of the
+//	               number of values of slices
+//	regex=EXPR     the value must match EXPR, it has to be the last rule as
+//	               it takes the rest of the tag
+//
+// The rules other than required are only checked for fields that were given,
+// body fields that are nil pointers were not. Enum and regex rules apply to
+// each value of slices.
+type validation struct {
+	required bool
+	enum     []string
+	min, max opt.Option[float64]
+	regex    *regexp.Regexp
+}
+
+func parseValidation(sf reflect.StructField) (validation, error) {
+	var vd validation
+	tag := sf.Tag.Get("validate")
+	for tag != "" {
+		var rule string
+		if strings.HasPrefix(tag, "regex=") {
+			rule, tag = tag, ""
+		} else {
+			rule, tag, _ = strings.Cut(tag, ",")
+		}
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			vd.required = true
+		case "enum":
+			vd.enum = strings.Split(arg, "|")
+		case "min", "max":
+			n, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return validation{}, fmt.Errorf("invalid %s bound %q", name, arg)
+			}
+			if name == "min" {
+				vd.min = opt.Some(n)
+			} else {
+				vd.max = opt.Some(n)
+			}
+		case "regex":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return validation{}, fmt.Errorf("invalid regex: %s", err.Error())
+			}
+			vd.regex = re
+		default:
+			return validation{}, fmt.Errorf("unknown validate rule %q", name)
+		}
+	}
+
+	_, hasMin := vd.min.MaybeUnwrap()
+	_, hasMax := vd.max.MaybeUnwrap()
+	if hasMin || hasMax {
+		t := sf.Type
+		if ot, ok := optionTypes[t]; ok {
+			t = ot.elem
+		}
+		if t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if !isList(t) && t.Kind() != reflect.String && !isNumber(t.Kind()) {
+			return validation{}, fmt.Errorf("min and max are not supported for %s", sf.Type)
+		}
+	}
+	return vd, nil
+}
+
+func isNumber(k reflect.Kind) bool {
+	switch k {
+	case reflect.Float32, reflect.Float64:
+		return true
+	}
+	_, signed := signedIntBitSizeMap[k]
+	_, unsigned := unsignedIntBitSizeMap[k]
+	return signed || unsigned
+}
+
+// check returns the reasons v breaks the rules, other than required.
+func (vd validation) check(v reflect.Value) []string {
+	if ot, ok := optionTypes[v.Type()]; ok {
+		ev, ok := ot.get(v)
+		if !ok {
+			return nil
+		}
+		v = ev
+	}
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+
+	var reasons []string
+	switch {
+	case isList(v.Type()):
+		reasons = vd.checkBounds(float64(v.Len()), "must have at least %s values", "must have at most %s values")
+		for i := range v.Len() {
+			reasons = append(reasons, vd.checkText(v.Index(i))...)
+		}
+		return reasons
+	case v.Kind() == reflect.String:
+		reasons = vd.checkBounds(float64(utf8.RuneCountInString(v.String())), "must be at least %s characters long", "must be at most %s characters long")
+	case v.CanInt():
+		reasons = vd.checkBounds(float64(v.Int()), "must be at least %s", "must be at most %s")
+	case v.CanUint():
+		reasons = vd.checkBounds(float64(v.Uint()), "must be at least %s", "must be at most %s")
+	case v.CanFloat():
+		reasons = vd.checkBounds(v.Float(), "must be at least %s", "must be at most %s")
+	}
+	return append(reasons, vd.checkText(v)...)
+}
+
+func (vd validation) checkBounds(n float64, minFormat, maxFormat string) []string {
+	var reasons []string
+	if min, ok := vd.min.MaybeUnwrap(); ok && n < min {
+		reasons = append(reasons, fmt.Sprintf(minFormat, strconv.FormatFloat(min, 'f', -1, 64)))
+	}
+	if max, ok := vd.max.MaybeUnwrap(); ok && n > max {
+		reasons = append(reasons, fmt.Sprintf(maxFormat, strconv.FormatFloat(max, 'f', -1, 64)))
+	}
+	return reasons
+}
+
+func (vd validation) checkText(v reflect.Value) []string {
+	if vd.enum == nil && vd.regex == nil {
+		return nil
+	}
+	s := valueText(v)
+	var reasons []string
+	if vd.enum != nil && !slices.Contains(vd.enum, s) {
+		reasons = append(reasons, fmt.Sprintf("must be one of %s, got %q", strings.Join(vd.enum, ", "), s))
+	}
+	if vd.regex != nil && !vd.regex.MatchString(s) {
+		reasons = append(reasons, fmt.Sprintf("must match %s, got %q", vd.regex, s))
+	}
+	return reasons
+}
+
+// valueText is v as the text enum and regex rules are checked against.
+func valueText(v reflect.Value) string {
+	if v.Kind() == reflect.String {
+		return v.String()
+	}
+	if v.Type().Implements(textMarshalerType) {
+		if b, err := v.Interface().(encoding.TextMarshaler).MarshalText(); err == nil {
+			return string(b)
+		}
+	}
+	return fmt.Sprint(v.Interface())
+}
@@ -0,0 +1,428 @@
+// Package exif reads the capture time of a jpeg and writes gps tags into its
+// exif data.
+//
+// Exif data is a tiff structure in the jpeg's APP1 segment. Tags are written
+// without moving any of the existing data, as maker notes and thumbnails hold
+// offsets into it: IFD0 is copied to the end of the tiff structure with a
+// pointer to a new GPS IFD that follows it.
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNotJPEG = errors.New("not a jpeg")
+	ErrNoExif  = errors.New("no exif data")
+)
+
+const (
+	tagExifIFD            = 0x8769
+	tagGPSIFD             = 0x8825
+	tagDateTime           = 0x0132
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTime         = 0x9010
+	tagOffsetTimeOriginal = 0x9011
+
+	tagGPSVersionID    = 0x0000
+	tagGPSLatitudeRef  = 0x0001
+	tagGPSLatitude     = 0x0002
+	tagGPSLongitudeRef = 0x0003
+	tagGPSLongitude    = 0x0004
+	tagGPSAltitudeRef  = 0x0005
+	tagGPSAltitude     = 0x0006
+	tagGPSTimeStamp    = 0x0007
+	tagGPSDateStamp    = 0x001d
+)
+
+const (
+	typeByte      = 1
+	typeASCII     = 2
+	typeShort     = 3
+	typeLong      = 4
+	typeRational  = 5
+	typeUndefined = 7
+	typeSLong     = 9
+	typeSRational = 10
+)
+
+var typeSizes = map[uint16]int{
+	typeByte:      1,
+	typeASCII:     1,
+	typeShort:     2,
+	typeLong:      4,
+	typeRational:  8,
+	typeUndefined: 1,
+	typeSLong:     4,
+	typeSRational: 8,
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+type entry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	// raw is the 4 byte value/offset field as stored
+	raw [4]byte
+}
+
+type ifd struct {
+	entries []entry
+	next    uint32
+}
+
+// Exif is the exif data of a jpeg.
+type Exif struct {
+	order binary.ByteOrder
+	tiff  []byte
+	ifd0  ifd
+	exif  ifd
+}
+
+// segment is an APP1 exif segment in a jpeg, start and end enclose the whole
+// segment including its marker.
+type segment struct {
+	start, end int
+	tiff       []byte
+}
+
+func findExifSegment(jpeg []byte) (segment, error) {
+	if len(jpeg) < 4 || jpeg[0] != 0xff || jpeg[1] != 0xd8 {
+		return segment{}, ErrNotJPEG
+	}
+	for i := 2; i+4 <= len(jpeg); {
+		if jpeg[i] != 0xff {
+			return segment{}, errors.Wrap(ErrNotJPEG, "invalid segment marker")
+		}
+		marker := jpeg[i+1]
+		if marker == 0xda || marker == 0xd9 {
+			// start of scan, no more metadata segments
+			break
+		}
+		size := int(binary.BigEndian.Uint16(jpeg[i+2:]))
+		end := i + 2 + size
+		if size < 2 || end > len(jpeg) {
+			return segment{}, errors.Wrap(ErrNotJPEG, "truncated segment")
+		}
+		payload := jpeg[i+4 : end]
+		if marker == 0xe1 && bytes.HasPrefix(payload, exifHeader) {
+			return segment{start: i, end: end, tiff: payload[len(exifHeader):]}, nil
+		}
+		i = end
+	}
+	return segment{}, ErrNoExif
+}
+
+func (e *Exif) readIFD(offset uint32) (ifd, error) {
+	if int64(offset)+2 > int64(len(e.tiff)) {
+		return ifd{}, fmt.Errorf("ifd offset %d out of range", offset)
+	}
+	n := int(e.order.Uint16(e.tiff[offset:]))
+	end := int(offset) + 2 + n*12 + 4
+	if end > len(e.tiff) {
+		return ifd{}, fmt.Errorf("ifd at %d out of range", offset)
+	}
+	var out ifd
+	for i := range n {
+		b := e.tiff[int(offset)+2+i*12:]
+		ent := entry{
+			tag:   e.order.Uint16(b),
+			typ:   e.order.Uint16(b[2:]),
+			count: e.order.Uint32(b[4:]),
+		}
+		copy(ent.raw[:], b[8:12])
+		out.entries = append(out.entries, ent)
+	}
+	out.next = e.order.Uint32(e.tiff[end-4:])
+	return out, nil
+}
+
+func (i ifd) find(tag uint16) (entry, bool) {
+	for _, e := range i.entries {
+		if e.tag == tag {
+			return e, true
+		}
+	}
+	return entry{}, false
+}
+
+// value returns the bytes of an entry's value.
+func (e *Exif) value(ent entry) ([]byte, error) {
+	size, ok := typeSizes[ent.typ]
+	if !ok {
+		return nil, fmt.Errorf("tag 0x%04x has unknown type %d", ent.tag, ent.typ)
+	}
+	n := int64(size) * int64(ent.count)
+	if n <= 4 {
+		return ent.raw[:n], nil
+	}
+	offset := int64(e.order.Uint32(ent.raw[:]))
+	if offset+n > int64(len(e.tiff)) {
+		return nil, fmt.Errorf("tag 0x%04x value out of range", ent.tag)
+	}
+	return e.tiff[offset : offset+n], nil
+}
+
+func (e *Exif) ascii(i ifd, tag uint16) (string, bool) {
+	ent, ok := i.find(tag)
+	if !ok || ent.typ != typeASCII {
+		return "", false
+	}
+	v, err := e.value(ent)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimRight(string(v), "\x00 "), true
+}
+
+// Read reads the exif data of a jpeg.
+func Read(jpeg []byte) (*Exif, error) {
+	seg, err := findExifSegment(jpeg)
+	if err != nil {
+		return nil, err
+	}
+	return parseTIFF(seg.tiff)
+}
+
+func parseTIFF(tiff []byte) (*Exif, error) {
+	if len(tiff) < 8 {
+		return nil, errors.New("truncated tiff header")
+	}
+	e := &Exif{tiff: tiff}
+	switch string(tiff[:2]) {
+	case "II":
+		e.order = binary.LittleEndian
+	case "MM":
+		e.order = binary.BigEndian
+	default:
+		return nil, errors.New("invalid tiff byte order")
+	}
+	if e.order.Uint16(tiff[2:]) != 42 {
+		return nil, errors.New("invalid tiff magic")
+	}
+	var err error
+	if e.ifd0, err = e.readIFD(e.order.Uint32(tiff[4:])); err != nil {
+		return nil, errors.Wrap(err, "failed to read IFD0")
+	}
+	if ptr, ok := e.ifd0.find(tagExifIFD); ok {
+		if e.exif, err = e.readIFD(e.order.Uint32(ptr.raw[:])); err != nil {
+			return nil, errors.Wrap(err, "failed to read exif IFD")
+		}
+	}
+	return e, nil
+}
+
+// DateTimeOriginal returns when the picture was taken. The camera's
+// OffsetTimeOriginal is used for the time zone when it was recorded, loc
+// otherwise.
+func (e *Exif) DateTimeOriginal(loc *time.Location) (time.Time, error) {
+	s, ok := e.ascii(e.exif, tagDateTimeOriginal)
+	if !ok {
+		if s, ok = e.ascii(e.ifd0, tagDateTime); !ok {
+			return time.Time{}, errors.New("no DateTimeOriginal")
+		}
+	}
+	offset, ok := e.ascii(e.exif, tagOffsetTimeOriginal)
+	if !ok {
+		offset, ok = e.ascii(e.exif, tagOffsetTime)
+	}
+	if ok {
+		t, err := time.Parse("2006:01:02 15:04:05-07:00", s+offset)
+		if err == nil {
+			return t, nil
+		}
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", s, loc)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "invalid DateTimeOriginal")
+	}
+	return t, nil
+}
+
+// HasGPS reports whether the exif data has a GPS IFD.
+func (e *Exif) HasGPS() bool {
+	_, ok := e.ifd0.find(tagGPSIFD)
+	return ok
+}
+
+// GPS is a position to write to the gps tags.
+type GPS struct {
+	Lat, Lon float64
+	// Alt is the altitude in meters, it is not written when nil.
+	Alt *float64
+	// Time is when the position was recorded, it is not written when zero.
+	Time time.Time
+}
+
+type ifdWriter struct {
+	order   binary.ByteOrder
+	entries []entry
+	// data holds values too large for an entry, offsets of entries into it
+	// are fixed up once the position of the IFD is known
+	data    []byte
+	dataRef map[int]int
+}
+
+func (w *ifdWriter) add(tag, typ uint16, count uint32, value []byte) {
+	ent := entry{tag: tag, typ: typ, count: count}
+	if len(value) <= 4 {
+		copy(ent.raw[:], value)
+	} else {
+		if w.dataRef == nil {
+			w.dataRef = map[int]int{}
+		}
+		w.dataRef[len(w.entries)] = len(w.data)
+		w.data = append(w.data, value...)
+		if len(w.data)%2 == 1 {
+			w.data = append(w.data, 0)
+		}
+	}
+	w.entries = append(w.entries, ent)
+}
+
+func (w *ifdWriter) rationals(tag uint16, vals ...[2]uint32) {
+	b := make([]byte, 8*len(vals))
+	for i, v := range vals {
+		w.order.PutUint32(b[i*8:], v[0])
+		w.order.PutUint32(b[i*8+4:], v[1])
+	}
+	w.add(tag, typeRational, uint32(len(vals)), b)
+}
+
+func (w *ifdWriter) ascii(tag uint16, s string) {
+	w.add(tag, typeASCII, uint32(len(s)+1), append([]byte(s), 0))
+}
+
+// bytes serializes the IFD for the given offset in the tiff structure.
+func (w *ifdWriter) bytes(offset uint32, next uint32) []byte {
+	slices.SortStableFunc(w.entries, func(a, b entry) int {
+		return int(a.tag) - int(b.tag)
+	})
+	size := 2 + 12*len(w.entries) + 4
+	b := make([]byte, size, size+len(w.data))
+	w.order.PutUint16(b, uint16(len(w.entries)))
+	for i, ent := range w.entries {
+		p := b[2+i*12:]
+		w.order.PutUint16(p, ent.tag)
+		w.order.PutUint16(p[2:], ent.typ)
+		w.order.PutUint32(p[4:], ent.count)
+		copy(p[8:12], ent.raw[:])
+	}
+	w.order.PutUint32(b[size-4:], next)
+	return append(b, w.data...)
+}
+
+// finish points entries with out of line values at their data once the IFD
+// is known to start at offset. It must be called before bytes, which sorts
+// the entries.
+func (w *ifdWriter) finish(offset uint32) {
+	base := offset + uint32(2+12*len(w.entries)+4)
+	for i, d := range w.dataRef {
+		w.order.PutUint32(w.entries[i].raw[:], base+uint32(d))
+	}
+	w.dataRef = nil
+}
+
+func dms(deg float64) [][2]uint32 {
+	deg = math.Abs(deg)
+	d := math.Floor(deg)
+	m := math.Floor((deg - d) * 60)
+	s := (deg - d - m/60) * 3600
+	return [][2]uint32{
+		{uint32(d), 1},
+		{uint32(m), 1},
+		{uint32(math.Round(s * 10000)), 10000},
+	}
+}
+
+// SetGPS returns the jpeg with its gps tags set to gps, replacing any gps
+// tags it had before.
+func SetGPS(jpeg []byte, gps GPS) ([]byte, error) {
+	seg, err := findExifSegment(jpeg)
+	if err != nil {
+		return nil, err
+	}
+	e, err := parseTIFF(seg.tiff)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &ifdWriter{order: e.order}
+	g.add(tagGPSVersionID, typeByte, 4, []byte{2, 3, 0, 0})
+	latRef, lonRef := "N", "E"
+	if gps.Lat < 0 {
+		latRef = "S"
+	}
+	if gps.Lon < 0 {
+		lonRef = "W"
+	}
+	g.ascii(tagGPSLatitudeRef, latRef)
+	g.rationals(tagGPSLatitude, dms(gps.Lat)...)
+	g.ascii(tagGPSLongitudeRef, lonRef)
+	g.rationals(tagGPSLongitude, dms(gps.Lon)...)
+	if gps.Alt != nil {
+		ref := byte(0)
+		if *gps.Alt < 0 {
+			ref = 1
+		}
+		g.add(tagGPSAltitudeRef, typeByte, 1, []byte{ref})
+		g.rationals(tagGPSAltitude, [2]uint32{uint32(math.Round(math.Abs(*gps.Alt) * 100)), 100})
+	}
+	if !gps.Time.IsZero() {
+		t := gps.Time.UTC()
+		g.rationals(tagGPSTimeStamp,
+			[2]uint32{uint32(t.Hour()), 1},
+			[2]uint32{uint32(t.Minute()), 1},
+			[2]uint32{uint32(t.Second()), 1},
+		)
+		g.ascii(tagGPSDateStamp, t.Format("2006:01:02"))
+	}
+
+	// the new IFD0 has all the old entries, which keep pointing into the
+	// unchanged tiff data, and a pointer to the new GPS IFD
+	ifd0 := &ifdWriter{order: e.order}
+	for _, ent := range e.ifd0.entries {
+		if ent.tag != tagGPSIFD {
+			ifd0.entries = append(ifd0.entries, ent)
+		}
+	}
+	ifd0.add(tagGPSIFD, typeLong, 1, make([]byte, 4))
+
+	tiff := slices.Clone(seg.tiff)
+	if len(tiff)%2 == 1 {
+		tiff = append(tiff, 0)
+	}
+	ifd0Offset := uint32(len(tiff))
+	gpsOffset := ifd0Offset + uint32(2+12*len(ifd0.entries)+4)
+	for i := range ifd0.entries {
+		if ifd0.entries[i].tag == tagGPSIFD {
+			e.order.PutUint32(ifd0.entries[i].raw[:], gpsOffset)
+		}
+	}
+	g.finish(gpsOffset)
+	tiff = append(tiff, ifd0.bytes(ifd0Offset, e.ifd0.next)...)
+	tiff = append(tiff, g.bytes(gpsOffset, 0)...)
+	e.order.PutUint32(tiff[4:], ifd0Offset)
+
+	size := 2 + len(exifHeader) + len(tiff)
+	if size > math.MaxUint16 {
+		return nil, fmt.Errorf("exif data too large: %d bytes", size)
+	}
+	out := make([]byte, 0, len(jpeg)-(seg.end-seg.start)+size+2)
+	out = append(out, jpeg[:seg.start]...)
+	out = append(out, 0xff, 0xe1)
+	out = binary.BigEndian.AppendUint16(out, uint16(size))
+	out = append(out, exifHeader...)
+	out = append(out, tiff...)
+	out = append(out, jpeg[seg.end:]...)
+	return out, nil
+}
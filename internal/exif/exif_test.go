@@ -0,0 +1,302 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+type testOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+type testTag struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+	// ifd makes the tag a pointer to the IFD with this index
+	ifd int
+}
+
+func testASCII(tag uint16, s string) testTag {
+	return testTag{tag: tag, typ: typeASCII, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+}
+
+func testRationals(order testOrder, tag uint16, vals ...uint32) testTag {
+	var b []byte
+	for _, v := range vals {
+		b = order.AppendUint32(b, v)
+		b = order.AppendUint32(b, 1)
+	}
+	return testTag{tag: tag, typ: typeRational, count: uint32(len(vals)), value: b}
+}
+
+// testTIFF lays out the IFDs one after the other, each followed by its out of
+// line values. The first IFD is IFD0.
+func testTIFF(order testOrder, ifds ...[]testTag) []byte {
+	offsets := make([]uint32, len(ifds))
+	offset := uint32(8)
+	for i, tags := range ifds {
+		offsets[i] = offset
+		offset += uint32(2 + 12*len(tags) + 4)
+		for _, t := range tags {
+			if len(t.value) > 4 {
+				offset += uint32(len(t.value)+1) &^ 1
+			}
+		}
+	}
+
+	var tiff []byte
+	if order == binary.LittleEndian {
+		tiff = append(tiff, "II"...)
+	} else {
+		tiff = append(tiff, "MM"...)
+	}
+	tiff = order.AppendUint16(tiff, 42)
+	tiff = order.AppendUint32(tiff, 8)
+	for i, tags := range ifds {
+		data := offsets[i] + uint32(2+12*len(tags)+4)
+		var values []byte
+		tiff = order.AppendUint16(tiff, uint16(len(tags)))
+		for _, t := range tags {
+			tiff = order.AppendUint16(tiff, t.tag)
+			if t.ifd > 0 {
+				tiff = order.AppendUint16(tiff, typeLong)
+				tiff = order.AppendUint32(tiff, 1)
+				tiff = order.AppendUint32(tiff, offsets[t.ifd])
+				continue
+			}
+			tiff = order.AppendUint16(tiff, t.typ)
+			tiff = order.AppendUint32(tiff, t.count)
+			if len(t.value) <= 4 {
+				var raw [4]byte
+				copy(raw[:], t.value)
+				tiff = append(tiff, raw[:]...)
+				continue
+			}
+			tiff = order.AppendUint32(tiff, data+uint32(len(values)))
+			values = append(values, t.value...)
+			if len(values)%2 == 1 {
+				values = append(values, 0)
+			}
+		}
+		tiff = order.AppendUint32(tiff, 0)
+		tiff = append(tiff, values...)
+	}
+	return tiff
+}
+
+// testJPEG wraps tiff in a jpeg with a JFIF segment before the exif one and
+// some scan data after it.
+func testJPEG(tiff []byte) []byte {
+	jpeg := []byte{0xff, 0xd8}
+	jfif := []byte("JFIF\x00\x01\x02\x00\x00\x01\x00\x01\x00\x00")
+	jpeg = append(jpeg, 0xff, 0xe0)
+	jpeg = binary.BigEndian.AppendUint16(jpeg, uint16(2+len(jfif)))
+	jpeg = append(jpeg, jfif...)
+	jpeg = append(jpeg, 0xff, 0xe1)
+	jpeg = binary.BigEndian.AppendUint16(jpeg, uint16(2+len(exifHeader)+len(tiff)))
+	jpeg = append(jpeg, exifHeader...)
+	jpeg = append(jpeg, tiff...)
+	return append(jpeg, testScan...)
+}
+
+var testScan = []byte{0xff, 0xda, 0x00, 0x02, 0x12, 0x34, 0x56, 0xff, 0xd9}
+
+// testCamera returns the exif data of a camera picture, with gps tags if
+// withGPS is set.
+func testCamera(order testOrder, withGPS bool) []byte {
+	ifd0 := []testTag{
+		testASCII(0x010f, "Acme"),
+		testASCII(0x0110, "Acme Shooter 3000"),
+		testASCII(tagDateTime, "2024:05:01 10:15:00"),
+		{tag: tagExifIFD, ifd: 1},
+	}
+	exif := []testTag{
+		testASCII(tagDateTimeOriginal, "2024:05:01 10:00:05"),
+		testASCII(tagOffsetTimeOriginal, "+02:00"),
+	}
+	if !withGPS {
+		return testTIFF(order, ifd0, exif)
+	}
+	ifd0 = append(ifd0, testTag{tag: tagGPSIFD, ifd: 2})
+	gps := []testTag{
+		testASCII(tagGPSLatitudeRef, "N"),
+		testRationals(order, tagGPSLatitude, 1, 2, 3),
+		testASCII(tagGPSLongitudeRef, "E"),
+		testRationals(order, tagGPSLongitude, 4, 5, 6),
+	}
+	return testTIFF(order, ifd0, exif, gps)
+}
+
+// gpsTags reads back the gps tags, rationals as float64s.
+func gpsTags(t *testing.T, e *Exif) map[uint16]any {
+	t.Helper()
+	ptr, ok := e.ifd0.find(tagGPSIFD)
+	if !ok {
+		t.Fatal("no gps ifd")
+	}
+	gps, err := e.readIFD(e.order.Uint32(ptr.raw[:]))
+	if err != nil {
+		t.Fatalf("failed to read gps ifd: %v", err)
+	}
+	out := map[uint16]any{}
+	for _, ent := range gps.entries {
+		v, err := e.value(ent)
+		if err != nil {
+			t.Fatalf("failed to read gps tag: %v", err)
+		}
+		switch ent.typ {
+		case typeASCII:
+			out[ent.tag] = string(bytes.TrimRight(v, "\x00"))
+		case typeRational:
+			var vals []float64
+			for i := 0; i < len(v); i += 8 {
+				vals = append(vals, float64(e.order.Uint32(v[i:]))/float64(e.order.Uint32(v[i+4:])))
+			}
+			out[ent.tag] = vals
+		default:
+			out[ent.tag] = v
+		}
+	}
+	return out
+}
+
+func fromDMS(t *testing.T, v any) float64 {
+	t.Helper()
+	vals, ok := v.([]float64)
+	if !ok || len(vals) != 3 {
+		t.Fatalf("invalid dms: %v", v)
+	}
+	return vals[0] + vals[1]/60 + vals[2]/3600
+}
+
+func TestSetGPS(t *testing.T) {
+	alt := -12.5
+	taken := time.Date(2024, 5, 1, 8, 0, 5, 0, time.UTC)
+	for _, order := range []testOrder{binary.LittleEndian, binary.BigEndian} {
+		for _, withGPS := range []bool{false, true} {
+			name := order.String()
+			if withGPS {
+				name += " with gps"
+			}
+			t.Run(name, func(t *testing.T) {
+				jpeg := testJPEG(testCamera(order, withGPS))
+				before, err := Read(jpeg)
+				if err != nil {
+					t.Fatalf("failed to read: %v", err)
+				}
+				if before.HasGPS() != withGPS {
+					t.Errorf("HasGPS() = %v", before.HasGPS())
+				}
+
+				out, err := SetGPS(jpeg, GPS{Lat: -33.856784, Lon: -151.215297, Alt: &alt, Time: taken})
+				if err != nil {
+					t.Fatalf("failed to set gps: %v", err)
+				}
+				// the segments around the exif data are untouched
+				if !bytes.HasPrefix(out, jpeg[:20]) || !bytes.HasSuffix(out, testScan) {
+					t.Error("segments around the exif data changed")
+				}
+				x, err := Read(out)
+				if err != nil {
+					t.Fatalf("failed to read written exif: %v", err)
+				}
+				if x.order != order {
+					t.Errorf("byte order changed to %v", x.order)
+				}
+				if !x.HasGPS() {
+					t.Fatal("no gps tags after writing them")
+				}
+				if model, _ := x.ascii(x.ifd0, 0x0110); model != "Acme Shooter 3000" {
+					t.Errorf("model = %q", model)
+				}
+				dto, err := x.DateTimeOriginal(time.UTC)
+				if err != nil || !dto.Equal(taken) {
+					t.Errorf("DateTimeOriginal() = %v, %v", dto, err)
+				}
+				n := 0
+				for _, ent := range x.ifd0.entries {
+					if ent.tag == tagGPSIFD {
+						n++
+					}
+				}
+				if n != 1 {
+					t.Errorf("IFD0 has %d gps pointers", n)
+				}
+
+				tags := gpsTags(t, x)
+				if tags[tagGPSLatitudeRef] != "S" || tags[tagGPSLongitudeRef] != "W" {
+					t.Errorf("refs = %v %v", tags[tagGPSLatitudeRef], tags[tagGPSLongitudeRef])
+				}
+				if lat := fromDMS(t, tags[tagGPSLatitude]); math.Abs(lat-33.856784) > 1e-6 {
+					t.Errorf("lat = %v", lat)
+				}
+				if lon := fromDMS(t, tags[tagGPSLongitude]); math.Abs(lon-151.215297) > 1e-6 {
+					t.Errorf("lon = %v", lon)
+				}
+				if ref, _ := tags[tagGPSAltitudeRef].([]byte); !bytes.Equal(ref, []byte{1}) {
+					t.Errorf("altitude ref = %v", tags[tagGPSAltitudeRef])
+				}
+				if a, _ := tags[tagGPSAltitude].([]float64); len(a) != 1 || a[0] != 12.5 {
+					t.Errorf("altitude = %v", tags[tagGPSAltitude])
+				}
+				if ts, _ := tags[tagGPSTimeStamp].([]float64); len(ts) != 3 || ts[0] != 8 || ts[1] != 0 || ts[2] != 5 {
+					t.Errorf("time stamp = %v", tags[tagGPSTimeStamp])
+				}
+				if tags[tagGPSDateStamp] != "2024:05:01" {
+					t.Errorf("date stamp = %v", tags[tagGPSDateStamp])
+				}
+
+				// writing again replaces the tags written before
+				out, err = SetGPS(out, GPS{Lat: 52.52, Lon: 13.405})
+				if err != nil {
+					t.Fatalf("failed to set gps again: %v", err)
+				}
+				if x, err = Read(out); err != nil {
+					t.Fatalf("failed to read rewritten exif: %v", err)
+				}
+				tags = gpsTags(t, x)
+				if tags[tagGPSLatitudeRef] != "N" || tags[tagGPSLongitudeRef] != "E" {
+					t.Errorf("refs = %v %v", tags[tagGPSLatitudeRef], tags[tagGPSLongitudeRef])
+				}
+				if lat := fromDMS(t, tags[tagGPSLatitude]); math.Abs(lat-52.52) > 1e-6 {
+					t.Errorf("lat = %v", lat)
+				}
+				for _, tag := range []uint16{tagGPSAltitude, tagGPSTimeStamp, tagGPSDateStamp} {
+					if _, ok := tags[tag]; ok {
+						t.Errorf("tag 0x%04x was kept", tag)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		jpeg []byte
+		err  error
+	}{
+		{"not a jpeg", []byte("GIF89a"), ErrNotJPEG},
+		{"no exif", append([]byte{0xff, 0xd8}, testScan...), ErrNoExif},
+	} {
+		if _, err := Read(tc.jpeg); err != tc.err {
+			t.Errorf("%s: Read() = %v, want %v", tc.name, err, tc.err)
+		}
+	}
+
+	// without an offset the time is in the camera's zone
+	x, err := Read(testJPEG(testTIFF(binary.BigEndian, []testTag{testASCII(tagDateTime, "2024:05:01 10:00:05")})))
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	berlin := time.FixedZone("CEST", 2*60*60)
+	if got, err := x.DateTimeOriginal(berlin); err != nil || !got.Equal(time.Date(2024, 5, 1, 8, 0, 5, 0, time.UTC)) {
+		t.Errorf("DateTimeOriginal() = %v, %v", got, err)
+	}
+}
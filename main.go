@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime/debug"
+	"strings"
+	"syscall"
 	"time"
 
 	"code.nkcmr.net/gotracks/internal/basicauth"
@@ -22,56 +27,192 @@ import (
 type configServer struct {
 	Address  string `env:"ADDR" envDefault:":8989"`
 	MirrorTo string
+	// ShutdownTimeout is how long in-flight requests and deliveries get to
+	// finish on SIGINT or SIGTERM.
+	ShutdownTimeout time.Duration `envDefault:"15s"`
 }
 
 type config struct {
-	DatabaseFile   string       `envDefault:"./db.sqlite3"`
-	Username       string       `env:"USERNAME,required"`
-	PasswordBcrypt string       `env:"PASSWORD_BCRYPT,required"`
-	Server         configServer `envPrefix:"SERVER_"`
+	DatabaseFile   string             `envDefault:"./db.sqlite3"`
+	Username       string             `env:"USERNAME,required"`
+	PasswordBcrypt string             `env:"PASSWORD_BCRYPT,required"`
+	Server         configServer       `envPrefix:"SERVER_"`
+	MQTT           configMQTT         `envPrefix:"MQTT_"`
+	Backup         configBackup       `envPrefix:"BACKUP_"`
+	Retention      configRetention    `envPrefix:"RETENTION_"`
+	Plausibility   configPlausibility `envPrefix:"PLAUSIBILITY_"`
+	Tiles          configTiles        `envPrefix:"TILES_"`
+	Places         configPlaces       `envPrefix:"PLACES_"`
+	Alerts         configAlerts       `envPrefix:"ALERTS_"`
+	Tracing        configTracing      `envPrefix:"TRACING_"`
+
+	// Friends lists which other users each user may see, e.g.
+	// "alice=bob,carol;bob=alice"
+	Friends map[string]string `envSeparator:";" envKeyValSeparator:"="`
+
+	// OsmAndDevices maps the device ids sent by OsmAnd protocol clients to
+	// the user they report for and the token they authenticate with, e.g.
+	// "123456=alice:9f2c1e7a;654321=bob:4e1ab0d3". The clients cannot send
+	// basic auth credentials, so the token is sent as the "token" query
+	// param of the server url instead.
+	OsmAndDevices map[string]string `envSeparator:";" envKeyValSeparator:"="`
 }
 
-func _main() error {
+func loadConfig() (config, error) {
 	cfg, err := env.ParseAsWithOptions[config](env.Options{
 		UseFieldNameByDefault: true,
 	})
 	if err != nil {
-		return errors.Wrap(err, "invalid config")
+		return config{}, errors.Wrap(err, "invalid config")
+	}
+	return cfg, nil
+}
+
+// commandConfig holds the settings read by commands that work on the db,
+// they run without the settings only the server needs, like credentials.
+type commandConfig struct {
+	DatabaseFile string `envDefault:"./db.sqlite3"`
+	Username     string `env:"USERNAME"`
+}
+
+func loadCommandConfig() (config, error) {
+	ccfg, err := env.ParseAsWithOptions[commandConfig](env.Options{
+		UseFieldNameByDefault: true,
+	})
+	if err != nil {
+		return config{}, errors.Wrap(err, "invalid config")
+	}
+	return config{
+		DatabaseFile: ccfg.DatabaseFile,
+		Username:     ccfg.Username,
+	}, nil
+}
+
+func _main() error {
+	if len(os.Args) > 1 {
+		return runCommand(os.Args[1], os.Args[2:])
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if cfg.Tracing.Endpoint != "" {
+		stopTracing, err := startTracing(cfg.Tracing)
+		if err != nil {
+			return errors.Wrap(err, "failed to start tracing")
+		}
+		defer stopTracing()
 	}
 
 	dbpool, err := openDB(cfg)
 	if err != nil {
 		return errors.Wrap(err, "failed to open db")
 	}
-	defer dbpool.Close()
+	defer closeDB(dbpool)
 
 	if cfg.Username == "" && cfg.PasswordBcrypt == "" {
 		return fmt.Errorf("invalid configuration, must add USERNAME and PASSWORD_BCRYPT")
 	}
 
 	r := chi.NewRouter()
-	mirrorPub(r, cfg)
+	r.Use(middleware.RequestID)
+	r.Use(metricsMiddleware)
+	flushMirror := mirrorPub(r, cfg)
 	r.Use(middleware.Logger)
-	r.Use(
-		basicauth.Middleware("gotracks", basicauth.InMemoryCredStore{
-			cfg.Username: cfg.PasswordBcrypt,
-		}),
-	)
+	creds := basicauth.InMemoryCredStore{
+		cfg.Username: cfg.PasswordBcrypt,
+	}
+	r.Use(middleware.Maybe(
+		basicauth.Middleware("gotracks", creds),
+		func(r *http.Request) bool {
+			// calendar apps can only authenticate feeds with the token in
+			// the url, osmand protocol clients send a per-device token
+			if strings.HasPrefix(r.URL.Path, "/api/0/feed/") {
+				return false
+			}
+			return r.URL.Path != "/api/0/ingest/osmand"
+		},
+	))
 	r.Use(middleware.Heartbeat("/_healthcheck"))
 	r.Use(middleware.Maybe(
 		middleware.Timeout(time.Second*5),
 		func(r *http.Request) bool {
+			if r.URL.Path == "/api/0/import" || strings.HasPrefix(r.URL.Path, "/api/0/import/") {
+				// imports take as long as the upload does
+				return false
+			}
+			switch r.URL.Path {
+			case "/api/0/admin/export", "/api/0/admin/backup":
+				return false
+			}
+			if r.Method == "POST" && r.URL.Path == "/api/0/at" {
+				// a batch looks up a position for every time it is given
+				return false
+			}
 			return r.Method != "GET" || r.URL.Path != "/ws/last"
 		},
 	))
 
 	liveLoc := newLiveLocations()
 
+	if cfg.Backup.Dir != "" {
+		stopBackups, err := startBackups(cfg.Backup, dbpool)
+		if err != nil {
+			return errors.Wrap(err, "failed to start scheduled backups")
+		}
+		defer stopBackups()
+	}
+
+	if cfg.Retention.Interval > 0 {
+		defer startRetention(cfg.Retention, dbpool)()
+	}
+
+	if cfg.Places.Interval > 0 {
+		defer startPlaces(cfg.Places, dbpool)()
+	}
+
+	if cfg.Alerts.enabled() {
+		defer startAlerts(cfg.Alerts, liveLoc, dbpool)()
+	}
+
+	if cfg.MQTT.Broker != "" {
+		mqttClient, err := startMQTTClient(cfg, liveLoc, dbpool)
+		if err != nil {
+			return errors.Wrap(err, "failed to start mqtt client")
+		}
+		defer mqttClient.Disconnect(250)
+	}
+	if cfg.MQTT.Listen != "" {
+		stopBroker, err := startMQTTBroker(cfg, creds, liveLoc, dbpool)
+		if err != nil {
+			return errors.Wrap(err, "failed to start mqtt broker")
+		}
+		defer stopBroker()
+	}
+
 	ListEndpoint(r, dbpool)
 	PubEndpoint(r, cfg, liveLoc, dbpool)
 	LastLocationEndpoint(r, dbpool)
 	LocationsEndpoint(r, dbpool)
+	AtEndpoint(r, dbpool)
+	StatsEndpoint(r, dbpool)
+	HeatmapEndpoint(r, dbpool)
+	RenderEndpoint(r, cfg, dbpool)
+	PlacesEndpoint(r, dbpool)
+	FeedsEndpoint(r, dbpool)
+	FeedEndpoint(r, dbpool)
+	MetricsEndpoint(r, dbpool)
+	AlertsEndpoint(r, dbpool)
 	WebsocketLastLocationEndpoint(r, liveLoc, dbpool)
+	OverlandIngestEndpoint(r, cfg, liveLoc, dbpool)
+	OsmAndIngestEndpoint(r, cfg, liveLoc, dbpool)
+	ImportEndpoint(r, dbpool)
+	TakeoutImportEndpoint(r, dbpool)
+	AdminExportEndpoint(r, cfg, dbpool)
+	AdminBackupEndpoint(r, cfg, dbpool)
+	AdminRetentionEndpoint(r, cfg, dbpool)
 
 	r.Get("/api/0/version", func(w http.ResponseWriter, r *http.Request) {
 		spew.Dump(debug.ReadBuildInfo())
@@ -81,7 +222,6 @@ func _main() error {
 	if err := serveFrontend(r); err != nil {
 		return errors.Wrap(err, "failed to serve frontend")
 	}
-
 	srv := http.Server{
 		Handler: r,
 	}
@@ -93,10 +233,30 @@ func _main() error {
 	defer lis.Close()
 	slog.Info("tcp listener started", slog.String("addr", lis.Addr().String()))
 
-	if err := srv.Serve(lis); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(lis)
+	}()
+	select {
+	case err := <-served:
 		return errors.Wrap(err, "http server failed")
+	case <-ctx.Done():
 	}
+	stop()
+
 	slog.Info("shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	// stops accepting connections and waits for in-flight requests, but not
+	// for websockets
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("http server did not shut down cleanly", slog.String("err", err.Error()))
+	}
+	liveLoc.close(shutdownCtx)
+	flushMirror(shutdownCtx)
+	// the deferred stops flush alert notifications and checkpoint the db
 	return nil
 }
 
@@ -121,6 +281,12 @@ func (h httpError) StatusCode() int {
 	return max(h.statusCode, 400)
 }
 
+// isHTTPError reports whether err carries a message meant for the client.
+func isHTTPError(err error) bool {
+	var h httpError
+	return errors.As(err, &h)
+}
+
 func badRequest(format string, a ...any) error {
 	return httpError{
 		statusCode: http.StatusBadRequest,
@@ -128,6 +294,20 @@ func badRequest(format string, a ...any) error {
 	}
 }
 
+func unauthorized(format string, a ...any) error {
+	return httpError{
+		statusCode: http.StatusUnauthorized,
+		message:    fmt.Sprintf(format, a...),
+	}
+}
+
+func notFound(format string, a ...any) error {
+	return httpError{
+		statusCode: http.StatusNotFound,
+		message:    fmt.Sprintf(format, a...),
+	}
+}
+
 func srvError(format string, a ...any) error {
 	return httpError{
 		statusCode: http.StatusInternalServerError,
@@ -144,6 +324,17 @@ func (p Point) Lon() float64 {
 	return p[1]
 }
 
+// DistanceTo returns the great circle distance to o in meters.
+func (p Point) DistanceTo(o Point) float64 {
+	const earthRadius = 6371008.8
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dlat := rad(o.Lat() - p.Lat())
+	dlon := rad(o.Lon() - p.Lon())
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(rad(p.Lat()))*math.Cos(rad(o.Lat()))*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
 func (p Point) String() string {
 	return fmt.Sprintf("%.04f,%.04f", p.Lat(), p.Lon())
 }
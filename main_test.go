@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/caarlos0/env/v11"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// testConfig returns the default config, with the required settings filled
+// in.
+func testConfig(t *testing.T) config {
+	t.Helper()
+	cfg, err := env.ParseAsWithOptions[config](env.Options{
+		UseFieldNameByDefault: true,
+		Environment: map[string]string{
+			"USERNAME":        "alice",
+			"PASSWORD_BCRYPT": "x",
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	cfg.DatabaseFile = filepath.Join(t.TempDir(), "db.sqlite3")
+	return cfg
+}
+
+// testDB opens a migrated database in a temporary dir.
+func testDB(t *testing.T, cfg config) *sqlitemigration.Pool {
+	t.Helper()
+	db, err := openDB(cfg)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// testQuery runs query and returns the first column of each row as text.
+func testQuery(t *testing.T, db *sqlitemigration.Pool, query string, args ...any) []string {
+	t.Helper()
+	conn, err := db.Get(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get conn: %v", err)
+	}
+	defer db.Put(conn)
+	var out []string
+	if err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			out = append(out, stmt.ColumnText(0))
+			return nil
+		},
+	}); err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	return out
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gotracks_http_requests_total",
+		Help: "HTTP requests handled, by chi route pattern.",
+	}, []string{"method", "route", "code"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gotracks_http_request_duration_seconds",
+		Help:    "Time taken to handle HTTP requests, by chi route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	reportsRecorded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gotracks_reports_total",
+		Help: "OwnTracks messages ingested, by what was done with them.",
+	}, []string{"user", "device", "type", "status"})
+	reportsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gotracks_pub_rejected_total",
+		Help: "Messages published over http that were not recorded, by reason.",
+	}, []string{"reason"})
+
+	enrichDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gotracks_enrich_duration_seconds",
+		Help:    "Time taken to enrich location reports, the timezone step is part of total.",
+		Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1},
+	}, []string{"step"})
+
+	dbWaitDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gotracks_db_pool_wait_seconds",
+		Help:    "Time spent waiting for a connection from the db pool.",
+		Buckets: []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+	})
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gotracks_db_query_duration_seconds",
+		Help:    "Time taken by db queries.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"query"})
+
+	wsSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gotracks_ws_subscribers",
+		Help: "Websocket clients subscribed to live locations.",
+	})
+)
+
+// metricsMiddleware counts requests and their durations by the chi route
+// pattern they matched, it has to be used on the root router so the pattern
+// is complete.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		httpRequestDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// getConn takes a connection from the pool, recording how long it had to wait
+// for one.
+func getConn(ctx context.Context, db *sqlitemigration.Pool) (*sqlite.Conn, error) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "db pool get")
+	conn, err := db.Get(ctx)
+	endSpan(span, err)
+	dbWaitDuration.Observe(time.Since(start).Seconds())
+	return conn, err
+}
+
+// dbCollector collects the metrics that are read from the db when scraped.
+type dbCollector struct {
+	db         *sqlitemigration.Pool
+	lastReport *prometheus.Desc
+	outbox     *prometheus.Desc
+}
+
+func newDBCollector(db *sqlitemigration.Pool) *dbCollector {
+	return &dbCollector{
+		db: db,
+		lastReport: prometheus.NewDesc(
+			"gotracks_device_last_report_age_seconds",
+			"Seconds since the tst of each device's newest report.",
+			[]string{"user", "device"}, nil,
+		),
+		outbox: prometheus.NewDesc(
+			"gotracks_outbox_pending",
+			"Unexpired commands in the outbox that a device has not fetched yet, commands for all devices are counted under device \"*\".",
+			[]string{"user", "device"}, nil,
+		),
+	}
+}
+
+func (c *dbCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.lastReport
+	ch <- c.outbox
+}
+
+func (c *dbCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := getConn(ctx, c.db)
+	if err != nil {
+		slog.Error("db error", slog.String("err", err.Error()))
+		return
+	}
+	defer c.db.Put(conn)
+	if err := c.collect(conn, ch, time.Now()); err != nil {
+		slog.Error("failed to collect db metrics", slog.String("err", err.Error()))
+	}
+}
+
+func (c *dbCollector) collect(conn *sqlite.Conn, ch chan<- prometheus.Metric, now time.Time) error {
+	if err := sqlitex.Execute(conn, `
+		SELECT u.user, r.device, MAX(json_extract(r.data, '$.tst'))
+		FROM location_reports r
+		JOIN users u ON u.id = r.user_id
+		GROUP BY r.user_id, r.device
+	`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			age := now.Sub(time.Unix(stmt.ColumnInt64(2), 0)).Seconds()
+			ch <- prometheus.MustNewConstMetric(c.lastReport, prometheus.GaugeValue, age, stmt.ColumnText(0), stmt.ColumnText(1))
+			return nil
+		},
+	}); err != nil {
+		return errors.Wrap(err, "failed to query last reports")
+	}
+	if err := sqlitex.Execute(conn, `
+		SELECT o.user, o.device, COUNT(*)
+		FROM cmd_outbox o
+		LEFT JOIN cmd_outbox_consumer_idx i ON i.user = o.user AND i.device = o.device
+		WHERE o.id > COALESCE(i.last_outbox_id, 0)
+			AND (o.when_expires IS NULL OR o.when_expires > ?1)
+		GROUP BY o.user, o.device
+	`, &sqlitex.ExecOptions{
+		Args: []any{now.Unix()},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			ch <- prometheus.MustNewConstMetric(c.outbox, prometheus.GaugeValue, stmt.ColumnFloat(2), stmt.ColumnText(0), stmt.ColumnText(1))
+			return nil
+		},
+	}); err != nil {
+		return errors.Wrap(err, "failed to query outbox")
+	}
+	return nil
+}
+
+func MetricsEndpoint(r chi.Router, db *sqlitemigration.Pool) {
+	prometheus.MustRegister(newDBCollector(db))
+	r.Get("/metrics", promhttp.Handler().ServeHTTP)
+}
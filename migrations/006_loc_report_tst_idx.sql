@@ -0,0 +1 @@
+CREATE INDEX idx_loc_report_user_device_tst ON location_reports(user_id, device, json_extract(data, '$.tst'));
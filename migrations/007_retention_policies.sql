@@ -0,0 +1,12 @@
+CREATE TABLE retention_policies (
+  user TEXT NOT NULL,
+  -- empty device is the policy for all devices of the user without a policy
+  -- of their own
+  device TEXT NOT NULL DEFAULT '',
+  delete_after_days INTEGER,
+  downsample_after_days INTEGER,
+  downsample_interval_secs INTEGER,
+  max_acc INTEGER,
+
+  PRIMARY KEY (user, device)
+);
@@ -0,0 +1,8 @@
+CREATE TABLE quarantined_reports (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL,
+  device TEXT NOT NULL,
+  data JSON NOT NULL,
+  when_created INTEGER NOT NULL
+);
+CREATE INDEX idx_quarantined_reports_user_device ON quarantined_reports(user_id, device);
@@ -0,0 +1,10 @@
+CREATE TABLE stats_cache (
+  user TEXT NOT NULL,
+  device TEXT NOT NULL DEFAULT '',
+  period TEXT NOT NULL,
+  start INTEGER NOT NULL,
+  reports INTEGER NOT NULL,
+  max_id INTEGER NOT NULL,
+  data JSON NOT NULL,
+  PRIMARY KEY (user, device, period, start)
+);
@@ -0,0 +1,22 @@
+CREATE TABLE places (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL,
+  lat REAL NOT NULL,
+  lon REAL NOT NULL,
+  radius REAL NOT NULL,
+  name TEXT NOT NULL DEFAULT '',
+  -- name_source is 'user' when the name was given by the user, 'geocoded'
+  -- when it was looked up, and '' when the place has no name yet
+  name_source TEXT NOT NULL DEFAULT '',
+  when_created INTEGER NOT NULL
+);
+CREATE INDEX idx_places_user ON places(user_id);
+
+CREATE TABLE place_visits (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  place_id INTEGER NOT NULL,
+  device TEXT NOT NULL,
+  arrived INTEGER NOT NULL,
+  departed INTEGER NOT NULL
+);
+CREATE INDEX idx_place_visits_place ON place_visits(place_id, arrived);
@@ -0,0 +1,12 @@
+CREATE TABLE feed_tokens (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user TEXT NOT NULL,
+  device TEXT NOT NULL DEFAULT '',
+  name TEXT NOT NULL DEFAULT '',
+  -- token_hash is the hex sha256 of the token, the token itself is only
+  -- shown when it is created
+  token_hash TEXT NOT NULL,
+  when_created INTEGER NOT NULL,
+  when_used INTEGER
+);
+CREATE UNIQUE INDEX idx_feed_tokens_hash ON feed_tokens(token_hash);
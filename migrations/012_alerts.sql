@@ -0,0 +1,15 @@
+CREATE TABLE alerts (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user TEXT NOT NULL,
+  device TEXT NOT NULL,
+  -- rule is one of 'stale', 'low_battery' or 'unplugged'
+  rule TEXT NOT NULL,
+  -- state is 'firing' until the rule no longer matches, then 'resolved'
+  state TEXT NOT NULL DEFAULT 'firing',
+  message TEXT NOT NULL,
+  fired_at INTEGER NOT NULL,
+  resolved_at INTEGER
+);
+-- a rule only has one firing alert per device at a time
+CREATE UNIQUE INDEX idx_alerts_firing ON alerts(user, device, rule) WHERE state = 'firing';
+CREATE INDEX idx_alerts_user_device ON alerts(user, device, fired_at);
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -16,8 +17,10 @@ import (
 
 // mirrorPub is just a crappy hack i have to mirror POST /pub calls to a
 // owntracks/recorder server i have so that i can use real data to reverse
-// engineer some things a bit easier.
-func mirrorPub(r *chi.Mux, cfg config) {
+// engineer some things a bit easier. The returned func waits for mirrored
+// requests that are still in flight, or for ctx to be done.
+func mirrorPub(r *chi.Mux, cfg config) func(ctx context.Context) {
+	var inflight sync.WaitGroup
 	r.Use(
 		middleware.Maybe(
 			func(h http.Handler) http.Handler {
@@ -41,7 +44,9 @@ func mirrorPub(r *chi.Mux, cfg config) {
 					r2 := r.Clone(context.WithoutCancel(r.Context()))
 					r2.Body = io.NopCloser(bytes.NewReader(body))
 
+					inflight.Add(1)
 					go func() {
+						defer inflight.Done()
 						rp.ServeHTTP(noopResponseWriter{}, r2)
 						slog.InfoContext(r.Context(), "mirrored request")
 					}()
@@ -53,6 +58,18 @@ func mirrorPub(r *chi.Mux, cfg config) {
 			},
 		),
 	)
+	return func(ctx context.Context) {
+		finished := make(chan struct{})
+		go func() {
+			inflight.Wait()
+			close(finished)
+		}()
+		select {
+		case <-finished:
+		case <-ctx.Done():
+			slog.Warn("gave up waiting for mirrored requests")
+		}
+	}
 }
 
 type noopResponseWriter struct{}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"code.nkcmr.net/gotracks/internal/basicauth"
+	"code.nkcmr.net/opt"
+	mqttbroker "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+)
+
+// friendsOf returns the users that user is allowed to see the location of.
+func friendsOf(cfg config, user string) []string {
+	var friends []string
+	for _, f := range strings.Split(cfg.Friends[user], ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			friends = append(friends, f)
+		}
+	}
+	return friends
+}
+
+type mqttBrokerHook struct {
+	mqttbroker.HookBase
+	cfg     config
+	creds   basicauth.CredentialStore
+	liveLoc *liveLocations
+	db      *sqlitemigration.Pool
+	server  *mqttbroker.Server
+}
+
+func (h *mqttBrokerHook) ID() string {
+	return "gotracks"
+}
+
+func (h *mqttBrokerHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqttbroker.OnConnectAuthenticate,
+		mqttbroker.OnACLCheck,
+		mqttbroker.OnPublish,
+	}, []byte{b})
+}
+
+func (h *mqttBrokerHook) OnConnectAuthenticate(cl *mqttbroker.Client, pk packets.Packet) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	ok, err := h.creds.Check(ctx, string(pk.Connect.Username), string(pk.Connect.Password))
+	if err != nil {
+		slog.Error("mqtt_cred_store_error", slog.String("err", err.Error()))
+		return false
+	}
+	return ok
+}
+
+// OnACLCheck limits clients to publishing to their own owntracks/<user>/#
+// topics and reading those plus the topics of their friends. Subscriptions
+// with a wildcard user level are allowed because every message delivered
+// through them is checked against its concrete topic as well.
+func (h *mqttBrokerHook) OnACLCheck(cl *mqttbroker.Client, topic string, write bool) bool {
+	user := string(cl.Properties.Username)
+	parts := strings.Split(topic, "/")
+	if len(parts) < 2 || parts[0] != "owntracks" {
+		return false
+	}
+	if write {
+		return len(parts) >= 3 && parts[1] == user
+	}
+	switch parts[1] {
+	case user, "+", "#":
+		return true
+	}
+	return slices.Contains(friendsOf(h.cfg, user), parts[1])
+}
+
+func (h *mqttBrokerHook) OnPublish(cl *mqttbroker.Client, pk packets.Packet) (packets.Packet, error) {
+	if cl.Net.Inline {
+		// published by gotracks itself, it has already been recorded
+		return pk, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	outbox, err := recordMQTTMessage(ctx, h.cfg.Plausibility, h.liveLoc, h.db, pk.TopicName, pk.Payload)
+	if err != nil {
+		slog.ErrorContext(ctx, "mqtt message failed",
+			slog.String("topic", pk.TopicName),
+			slog.String("err", err.Error()),
+		)
+		return pk, nil
+	}
+	for _, cmd := range outbox {
+		if err := h.server.Publish(pk.TopicName+"/cmd", mustJSONEncode(cmd), false, pk.FixedHeader.Qos); err != nil {
+			slog.ErrorContext(ctx, "failed to publish cmd", slog.String("err", err.Error()))
+		}
+	}
+	return pk, nil
+}
+
+// retainLastLocations publishes the last known location of every device as a
+// retained message so that clients see their friends as soon as they
+// connect.
+func retainLastLocations(ctx context.Context, server *mqttbroker.Server, db *sqlitemigration.Pool) error {
+	conn, err := getConn(ctx, db)
+	if err != nil {
+		return errors.Wrap(err, "failed to get db conn")
+	}
+	locs, err := lastLocation(ctx, conn, opt.None[string](), opt.None[string](), false)
+	db.Put(conn)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, loc := range locs {
+		if err := retainLocation(server, loc); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func retainLocation(server *mqttbroker.Server, loc otLocation) error {
+	user, uok := readString(loc, "username").MaybeUnwrap()
+	device, dok := readString(loc, "device").MaybeUnwrap()
+	if !uok || !dok {
+		return nil
+	}
+	topic := fmt.Sprintf("owntracks/%s/%s", user, device)
+	if err := server.Publish(topic, mustJSONEncode(loc), true, 1); err != nil {
+		return errors.Wrapf(err, "failed to publish retained location to %s", topic)
+	}
+	return nil
+}
+
+// startMQTTBroker starts an embedded mqtt broker that records messages
+// published by devices and relays them to friends, so devices in mqtt mode do
+// not need a separate broker. The returned func stops the broker.
+func startMQTTBroker(
+	cfg config,
+	creds basicauth.CredentialStore,
+	liveLoc *liveLocations,
+	db *sqlitemigration.Pool,
+) (func(), error) {
+	server := mqttbroker.New(&mqttbroker.Options{
+		InlineClient: true,
+		Logger:       slog.Default(),
+	})
+	if err := server.AddHook(&mqttBrokerHook{
+		cfg:     cfg,
+		creds:   creds,
+		liveLoc: liveLoc,
+		db:      db,
+		server:  server,
+	}, nil); err != nil {
+		return nil, errors.Wrap(err, "failed to add broker hook")
+	}
+	if err := server.AddListener(listeners.NewTCP(listeners.Config{
+		ID:      "tcp",
+		Address: cfg.MQTT.Listen,
+	})); err != nil {
+		return nil, errors.Wrap(err, "failed to add broker listener")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err := retainLastLocations(ctx, server, db); err != nil {
+		return nil, errors.Wrap(err, "failed to retain last locations")
+	}
+
+	if err := server.Serve(); err != nil {
+		return nil, errors.Wrap(err, "failed to start broker")
+	}
+	slog.Info("mqtt broker started", slog.String("addr", cfg.MQTT.Listen))
+
+	// reports that come in over http are relayed to the broker so that mqtt
+	// clients see them too
+	updates := make(chan otLocation, 5)
+	unsubscribe := liveLoc.subscribe(updates)
+	relayed := make(chan struct{})
+	go func() {
+		defer close(relayed)
+		for loc := range updates {
+			if http, _ := loc["_http"].(bool); !http {
+				continue
+			}
+			if err := retainLocation(server, loc); err != nil {
+				slog.Error("failed to relay location to broker", slog.String("err", err.Error()))
+			}
+		}
+	}()
+
+	return func() {
+		// the relay keeps taking updates until it is unsubscribed, so a
+		// broadcast in progress cannot block on it, and it is done before
+		// the broker it publishes to is closed
+		unsubscribe()
+		<-relayed
+		if err := server.Close(); err != nil {
+			slog.Error("failed to close mqtt broker", slog.String("err", err.Error()))
+		}
+	}, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"code.nkcmr.net/gotracks/internal/basicauth"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mqttbroker "github.com/mochi-mqtt/server/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMQTTBrokerACL(t *testing.T) {
+	h := &mqttBrokerHook{cfg: config{
+		Friends: map[string]string{"alice": "bob, carol"},
+	}}
+	for _, tc := range []struct {
+		user  string
+		topic string
+		write bool
+		want  bool
+	}{
+		{"alice", "owntracks/alice/phone", true, true},
+		{"alice", "owntracks/alice/phone/event", true, true},
+		{"alice", "owntracks/alice", true, false},
+		{"alice", "owntracks/bob/phone", true, false},
+		{"alice", "owntracks/+/phone", true, false},
+		{"alice", "other/alice/phone", true, false},
+
+		{"alice", "owntracks/alice/#", false, true},
+		{"alice", "owntracks/bob/phone", false, true},
+		{"alice", "owntracks/carol/phone", false, true},
+		{"alice", "owntracks/dave/phone", false, false},
+		{"alice", "owntracks/+/+", false, true},
+		{"alice", "owntracks/#", false, true},
+		{"alice", "#", false, false},
+		{"alice", "other/alice", false, false},
+
+		// friendship is one way
+		{"bob", "owntracks/alice/phone", false, false},
+		{"bob", "owntracks/bob/phone", false, true},
+	} {
+		cl := &mqttbroker.Client{Properties: mqttbroker.ClientProperties{Username: []byte(tc.user)}}
+		if got := h.OnACLCheck(cl, tc.topic, tc.write); got != tc.want {
+			t.Errorf("OnACLCheck(%s, %q, write=%v) = %v, want %v", tc.user, tc.topic, tc.write, got, tc.want)
+		}
+	}
+}
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func testMQTTConnect(addr, user, password string, onMessage mqtt.MessageHandler) (mqtt.Client, error) {
+	client := mqtt.NewClient(mqtt.NewClientOptions().
+		AddBroker("tcp://" + addr).
+		SetClientID(user).
+		SetUsername(user).
+		SetPassword(password).
+		SetDefaultPublishHandler(onMessage))
+	tok := client.Connect()
+	tok.WaitTimeout(5 * time.Second)
+	return client, tok.Error()
+}
+
+func TestMQTTBroker(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MQTT.Listen = freeAddr(t)
+	cfg.Friends = map[string]string{"alice": "bob"}
+	db := testDB(t, cfg)
+	creds := basicauth.InMemoryCredStore{}
+	for _, user := range []string{"alice", "bob", "carol"} {
+		hash, err := bcrypt.GenerateFromPassword([]byte(user+"-pw"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		creds[user] = string(hash)
+	}
+	liveLoc := newLiveLocations()
+	stop, err := startMQTTBroker(cfg, creds, liveLoc, db)
+	if err != nil {
+		t.Fatalf("failed to start broker: %v", err)
+	}
+	stopped := false
+	defer func() {
+		if !stopped {
+			stop()
+		}
+	}()
+
+	if _, err := testMQTTConnect(cfg.MQTT.Listen, "alice", "wrong", nil); err == nil {
+		t.Error("connected with a wrong password")
+	}
+
+	received := make(chan mqtt.Message, 10)
+	alice, err := testMQTTConnect(cfg.MQTT.Listen, "alice", "alice-pw", func(_ mqtt.Client, m mqtt.Message) {
+		received <- m
+	})
+	if err != nil {
+		t.Fatalf("alice failed to connect: %v", err)
+	}
+	defer alice.Disconnect(0)
+	if tok := alice.Subscribe("owntracks/#", 1, nil); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("alice failed to subscribe: %v", tok.Error())
+	}
+
+	publish := func(c mqtt.Client, topic, payload string) {
+		t.Helper()
+		if tok := c.Publish(topic, 1, false, payload); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("failed to publish to %s: %v", topic, tok.Error())
+		}
+	}
+	bob, err := testMQTTConnect(cfg.MQTT.Listen, "bob", "bob-pw", nil)
+	if err != nil {
+		t.Fatalf("bob failed to connect: %v", err)
+	}
+	defer bob.Disconnect(0)
+	carol, err := testMQTTConnect(cfg.MQTT.Listen, "carol", "carol-pw", nil)
+	if err != nil {
+		t.Fatalf("carol failed to connect: %v", err)
+	}
+	defer carol.Disconnect(0)
+
+	publish(carol, "owntracks/carol/phone", `{"_type":"location","lat":1,"lon":1,"tst":1700000000}`)
+	publish(bob, "owntracks/bob/phone", `{"_type":"location","lat":2,"lon":2,"tst":1700000000}`)
+	// a denied qos 1 publish gets the client disconnected, the broker drops
+	// qos 0 ones silently
+	carol.Publish("owntracks/bob/spoofed", 0, false, `{"_type":"location","lat":1,"lon":1,"tst":1700000000}`).Wait()
+
+	select {
+	case m := <-received:
+		if m.Topic() != "owntracks/bob/phone" {
+			t.Errorf("alice received %s before bob's report", m.Topic())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("alice did not receive bob's report")
+	}
+
+	// reports that came in over http are relayed to the broker
+	liveLoc.broadcast(context.Background(), otLocation{
+		"_type": "location", "_http": true, "username": "bob", "device": "tablet", "tst": 1700000001,
+	})
+	select {
+	case m := <-received:
+		if m.Topic() != "owntracks/bob/tablet" {
+			t.Errorf("alice received %s instead of the relayed report", m.Topic())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relayed report was not delivered")
+	}
+	select {
+	case m := <-received:
+		t.Errorf("alice received %s", m.Topic())
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	got := testQuery(t, db, `
+		SELECT u.user || '/' || r.device
+		FROM location_reports r
+		JOIN users u ON u.id = r.user_id
+		ORDER BY 1
+	`)
+	if len(got) != 2 || got[0] != "bob/phone" || got[1] != "carol/phone" {
+		t.Errorf("stored reports = %q", got)
+	}
+
+	// stopping unsubscribes the relay, so broadcasts do not block on it
+	stop()
+	stopped = true
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 10 {
+			liveLoc.broadcast(context.Background(), otLocation{"_http": true, "username": "bob", "device": "tablet"})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcast blocked after the broker stopped")
+	}
+}
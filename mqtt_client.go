@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+)
+
+type configMQTT struct {
+	// Broker is the url of the broker to subscribe to (e.g.
+	// tcp://localhost:1883). The mqtt client is disabled when it is empty.
+	Broker   string
+	ClientID string `envDefault:"gotracks"`
+	Username string
+	Password string
+	Topics   []string `envDefault:"owntracks/+/+"`
+	QoS      int      `envDefault:"1"`
+
+	// Listen is the address the embedded broker accepts connections on (e.g.
+	// :1883). The embedded broker is disabled when it is empty.
+	Listen string
+}
+
+// mqttTopicUserDevice derives the user and device from an owntracks base
+// topic (owntracks/<user>/<device>). Subtopics such as .../cmd or .../event
+// are not base topics and are rejected.
+func mqttTopicUserDevice(topic string) (user, device string, ok bool) {
+	parts := strings.Split(topic, "/")
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// startMQTTClient connects to the configured broker and records messages
+// published to the configured topics the same way POST /pub does.
+func startMQTTClient(cfg config, liveLoc *liveLocations, db *sqlitemigration.Pool) (mqtt.Client, error) {
+	qos := byte(cfg.MQTT.QoS)
+	handler := func(client mqtt.Client, msg mqtt.Message) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		if err := handleMQTTMessage(ctx, client, qos, cfg.Plausibility, liveLoc, db, msg.Topic(), msg.Payload()); err != nil {
+			slog.ErrorContext(ctx, "mqtt message failed",
+				slog.String("topic", msg.Topic()),
+				slog.String("err", err.Error()),
+			)
+		}
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.MQTT.Broker).
+		SetClientID(cfg.MQTT.ClientID).
+		SetUsername(cfg.MQTT.Username).
+		SetPassword(cfg.MQTT.Password).
+		SetCleanSession(false).
+		SetOrderMatters(false).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			filters := map[string]byte{}
+			for _, t := range cfg.MQTT.Topics {
+				filters[t] = qos
+			}
+			tok := c.SubscribeMultiple(filters, handler)
+			tok.Wait()
+			if err := tok.Error(); err != nil {
+				slog.Error("mqtt subscribe failed", slog.String("err", err.Error()))
+				return
+			}
+			slog.Info("mqtt subscribed", slog.Any("topics", cfg.MQTT.Topics))
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("mqtt connection lost", slog.String("err", err.Error()))
+		})
+
+	client := mqtt.NewClient(opts)
+	tok := client.Connect()
+	if !tok.WaitTimeout(time.Second * 10) {
+		return nil, fmt.Errorf("timed out connecting to mqtt broker")
+	}
+	if err := tok.Error(); err != nil {
+		return nil, errors.Wrap(err, "failed to connect to mqtt broker")
+	}
+	slog.Info("mqtt client connected", slog.String("broker", cfg.MQTT.Broker))
+	return client, nil
+}
+
+func handleMQTTMessage(
+	ctx context.Context,
+	client mqtt.Client,
+	qos byte,
+	plausibility configPlausibility,
+	liveLoc *liveLocations,
+	db *sqlitemigration.Pool,
+	topic string,
+	payload []byte,
+) error {
+	outbox, err := recordMQTTMessage(ctx, plausibility, liveLoc, db, topic, payload)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, cmd := range outbox {
+		tok := client.Publish(topic+"/cmd", qos, false, mustJSONEncode(cmd))
+		if !tok.WaitTimeout(time.Second * 5) {
+			return fmt.Errorf("timed out publishing cmd")
+		}
+		if err := tok.Error(); err != nil {
+			return errors.Wrap(err, "failed to publish cmd")
+		}
+	}
+	return nil
+}
+
+// recordMQTTMessage records a message published to an owntracks device topic
+// and returns the pending outbox commands for that device, which are to be
+// published to the device's cmd subtopic.
+func recordMQTTMessage(
+	ctx context.Context,
+	plausibility configPlausibility,
+	liveLoc *liveLocations,
+	db *sqlitemigration.Pool,
+	topic string,
+	payload []byte,
+) ([]map[string]any, error) {
+	user, device, ok := mqttTopicUserDevice(topic)
+	if !ok {
+		slog.DebugContext(ctx, "ignoring mqtt message on non-device topic", slog.String("topic", topic))
+		return nil, nil
+	}
+	if len(payload) == 0 {
+		// cleared retained message
+		return nil, nil
+	}
+
+	otdata, err := decodeOTJSON(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode ot json")
+	}
+
+	if loc, ok := otdata.(otLocation); ok {
+		if err := enrichOTLocationData(ctx, user, device, loc); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if _, ok := loc.Topic().MaybeUnwrap(); !ok {
+			loc["topic"] = topic
+		}
+	}
+
+	conn, err := getConn(ctx, db)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get db conn")
+	}
+	defer db.Put(conn)
+
+	status, err := recordReport(ctx, conn, plausibility, user, device, otdata)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if loc, ok := otdata.(otLocation); ok && status.live() {
+		liveLoc.goBroadcast(ctx, loc)
+	}
+
+	outbox, err := checkOutbox(ctx, conn, user, device)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to check outbox", slog.String("err", err.Error()))
+		return nil, nil
+	}
+	return outbox, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	mqttbroker "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// testMQTTServer starts an in-process broker that lets anyone connect, and
+// returns it with the address it listens on.
+func testMQTTServer(t *testing.T) (*mqttbroker.Server, string) {
+	t.Helper()
+	server := mqttbroker.New(&mqttbroker.Options{InlineClient: true})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatalf("failed to add hook: %v", err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "tcp", Address: "127.0.0.1:0"})
+	if err := server.AddListener(tcp); err != nil {
+		t.Fatalf("failed to add listener: %v", err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatalf("failed to serve: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server, tcp.Address()
+}
+
+func addOutboxCmd(t *testing.T, db *sqlitemigration.Pool, user, device string, cmd map[string]any) {
+	t.Helper()
+	conn, err := db.Get(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get conn: %v", err)
+	}
+	defer db.Put(conn)
+	if err := sqlitex.Execute(conn, `
+		INSERT INTO cmd_outbox (user, device, data, when_created)
+		VALUES (?1, ?2, ?3, unixepoch())
+	`, &sqlitex.ExecOptions{
+		Args: []any{user, device, string(mustJSONEncode(cmd))},
+	}); err != nil {
+		t.Fatalf("failed to insert cmd: %v", err)
+	}
+}
+
+func TestMQTTClient(t *testing.T) {
+	cfg := testConfig(t)
+	db := testDB(t, cfg)
+	server, addr := testMQTTServer(t)
+
+	cmds := make(chan packets.Packet, 5)
+	if err := server.Subscribe("owntracks/+/+/cmd", 1, func(_ *mqttbroker.Client, _ packets.Subscription, pk packets.Packet) {
+		cmds <- pk
+	}); err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	addOutboxCmd(t, db, "alice", "phone", map[string]any{"_type": "cmd", "action": "reportLocation"})
+
+	liveLoc := newLiveLocations()
+	updates := make(chan otLocation, 5)
+	defer liveLoc.subscribe(updates)()
+
+	// the report is retained so the client gets it however long subscribing
+	// takes
+	if err := server.Publish("owntracks/alice/phone", []byte(`{"_type":"location","lat":52.52,"lon":13.405,"tst":1700000000,"tid":"ph"}`), true, 1); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	cfg.MQTT.Broker = "tcp://" + addr
+	client, err := startMQTTClient(cfg, liveLoc, db)
+	if err != nil {
+		t.Fatalf("failed to start client: %v", err)
+	}
+	defer client.Disconnect(0)
+
+	select {
+	case loc := <-updates:
+		if loc["username"] != "alice" || loc["device"] != "phone" || loc["topic"] != "owntracks/alice/phone" {
+			t.Errorf("unexpected broadcast: %v", loc)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("report was not broadcast")
+	}
+
+	select {
+	case pk := <-cmds:
+		if pk.TopicName != "owntracks/alice/phone/cmd" {
+			t.Errorf("cmd published to %s", pk.TopicName)
+		}
+		var cmd map[string]any
+		if err := json.Unmarshal(pk.Payload, &cmd); err != nil || cmd["action"] != "reportLocation" {
+			t.Errorf("unexpected cmd %s", pk.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("outbox cmd was not published")
+	}
+
+	got := testQuery(t, db, `
+		SELECT u.user || '/' || r.device || ' ' || json_extract(r.data, '$.lat') || ' ' || json_extract(r.data, '$.tst')
+		FROM location_reports r
+		JOIN users u ON u.id = r.user_id
+	`)
+	if len(got) != 1 || got[0] != "alice/phone 52.52 1700000000" {
+		t.Errorf("stored reports = %q", got)
+	}
+}
+
+func TestMQTTTopicUserDevice(t *testing.T) {
+	for _, tc := range []struct {
+		topic        string
+		user, device string
+		ok           bool
+	}{
+		{"owntracks/alice/phone", "alice", "phone", true},
+		{"owntracks/alice/phone/cmd", "", "", false},
+		{"owntracks/alice/phone/event", "", "", false},
+		{"owntracks/alice", "", "", false},
+		{"owntracks//phone", "", "", false},
+	} {
+		user, device, ok := mqttTopicUserDevice(tc.topic)
+		if user != tc.user || device != tc.device || ok != tc.ok {
+			t.Errorf("mqttTopicUserDevice(%q) = %q, %q, %v", tc.topic, user, device, ok)
+		}
+	}
+}
@@ -99,6 +99,10 @@ func (o otLocation) Timestamp() opt.Option[time.Time] {
 // 	otTriggerSigLoc = "v"
 // )
 
+// otTriggerImport is not an owntracks trigger, gotracks uses it to mark
+// reports that were imported from another source.
+const otTriggerImport = "i"
+
 func (otLocation) isOTJSON() {}
 
 func decodeOTLocationJSON(d []byte) (otLocation, error) {
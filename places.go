@@ -0,0 +1,618 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.nkcmr.net/opt"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+type configPlaces struct {
+	// Interval is how often places are recomputed from the stays in the
+	// location reports, 0 disables recomputing them in the background.
+	Interval time.Duration `envDefault:"1h"`
+	// GeocodeURL names new places by reverse geocoding with a Nominatim
+	// compatible server, e.g.
+	// https://nominatim.openstreetmap.org/reverse?format=jsonv2&lat={lat}&lon={lon}.
+	// Places are left unnamed when it is empty.
+	GeocodeURL string
+	UserAgent  string `envDefault:"gotracks"`
+}
+
+const (
+	// placeStayMin is how long a device has to stay within
+	// positionStayRadius for it to count as a visit.
+	placeStayMin = 15 * time.Minute
+	// placeRadius is the radius of places found from stays.
+	placeRadius = 100
+	// placeMinVisits is how many stays a spot needs to become a place.
+	placeMinVisits = 2
+	// geocodeInterval keeps to Nominatim's limit of one request a second.
+	geocodeInterval = time.Second
+)
+
+type stay struct {
+	device   string
+	p        Point
+	arrived  int64
+	departed int64
+}
+
+// stayFinder finds the spans of at least minDur in which a device stayed
+// within positionStayRadius, from points added in order of device and time.
+type stayFinder struct {
+	minDur      time.Duration
+	first, last renderPoint
+	lat, lon    float64
+	n           int
+	stays       []stay
+}
+
+func (f *stayFinder) add(pt renderPoint) {
+	if f.n > 0 && pt.device == f.first.device && f.first.p.DistanceTo(pt.p) <= positionStayRadius {
+		f.last = pt
+		f.lat += pt.p.Lat()
+		f.lon += pt.p.Lon()
+		f.n++
+		return
+	}
+	f.flush()
+	f.first, f.last = pt, pt
+	f.lat, f.lon, f.n = pt.p.Lat(), pt.p.Lon(), 1
+}
+
+// flush ends the span of the points added so far.
+func (f *stayFinder) flush() {
+	if f.n > 0 && time.Duration(f.last.tst-f.first.tst)*time.Second >= f.minDur {
+		n := float64(f.n)
+		f.stays = append(f.stays, stay{
+			device:   f.first.device,
+			p:        Point{f.lat / n, f.lon / n},
+			arrived:  f.first.tst,
+			departed: f.last.tst,
+		})
+	}
+	f.n = 0
+}
+
+// findStays returns the spans of at least minDur in which a device stayed
+// within positionStayRadius, points must be ordered by device and time.
+func findStays(points []renderPoint, minDur time.Duration) []stay {
+	f := stayFinder{minDur: minDur}
+	for _, pt := range points {
+		f.add(pt)
+	}
+	f.flush()
+	return f.stays
+}
+
+type place struct {
+	ID         int64   `json:"id"`
+	Name       string  `json:"name"`
+	NameSource string  `json:"name_source"`
+	Lat        float64 `json:"lat"`
+	Lon        float64 `json:"lon"`
+	Radius     float64 `json:"radius"`
+	Visits     int     `json:"visits"`
+	// Dwell is the total time spent at the place in seconds.
+	Dwell      int64  `json:"dwell"`
+	FirstVisit *int64 `json:"first_visit"`
+	LastVisit  *int64 `json:"last_visit"`
+}
+
+type placeVisit struct {
+	Device   string `json:"device"`
+	Arrived  int64  `json:"arrived"`
+	Departed int64  `json:"departed"`
+	Dwell    int64  `json:"dwell"`
+}
+
+// listPlaces returns the user's places, or a single place when id is set.
+func listPlaces(conn *sqlite.Conn, user string, id opt.Option[int64]) ([]place, error) {
+	query := `
+		SELECT
+			p.id, p.name, p.name_source, p.lat, p.lon, p.radius,
+			COUNT(v.id),
+			COALESCE(SUM(v.departed - v.arrived), 0),
+			MIN(v.arrived),
+			MAX(v.departed)
+		FROM places AS p
+		LEFT JOIN place_visits AS v ON v.place_id = p.id
+		WHERE %s
+		GROUP BY p.id
+		ORDER BY COUNT(v.id) DESC, p.id
+	`
+	cond, args := "p.user_id = (SELECT id FROM users WHERE user = ?1)", []any{user}
+	if placeID, ok := id.MaybeUnwrap(); ok {
+		cond, args = "p.id = ?1", []any{placeID}
+	}
+	places := []place{}
+	if err := sqlitex.Execute(conn, fmt.Sprintf(query, cond), &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			p := place{
+				ID:         stmt.ColumnInt64(0),
+				Name:       stmt.ColumnText(1),
+				NameSource: stmt.ColumnText(2),
+				Lat:        stmt.ColumnFloat(3),
+				Lon:        stmt.ColumnFloat(4),
+				Radius:     stmt.ColumnFloat(5),
+				Visits:     stmt.ColumnInt(6),
+				Dwell:      stmt.ColumnInt64(7),
+			}
+			if stmt.ColumnType(8) != sqlite.TypeNull {
+				first, last := stmt.ColumnInt64(8), stmt.ColumnInt64(9)
+				p.FirstVisit, p.LastVisit = &first, &last
+			}
+			places = append(places, p)
+			return nil
+		},
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to query places")
+	}
+	return places, nil
+}
+
+func getPlace(conn *sqlite.Conn, id int64) (opt.Option[place], error) {
+	places, err := listPlaces(conn, "", opt.Some(id))
+	if err != nil || len(places) == 0 {
+		return opt.None[place](), err
+	}
+	return opt.Some(places[0]), nil
+}
+
+func listPlaceVisits(conn *sqlite.Conn, id int64, from, to opt.Option[int64]) ([]placeVisit, error) {
+	conds := []string{"place_id = ?1"}
+	args := []any{id}
+	if f, ok := from.MaybeUnwrap(); ok {
+		args = append(args, f)
+		conds = append(conds, fmt.Sprintf("departed >= ?%d", len(args)))
+	}
+	if t, ok := to.MaybeUnwrap(); ok {
+		args = append(args, t)
+		conds = append(conds, fmt.Sprintf("arrived <= ?%d", len(args)))
+	}
+	query := fmt.Sprintf(`
+		SELECT device, arrived, departed
+		FROM place_visits
+		WHERE %s
+		ORDER BY arrived
+	`, strings.Join(conds, " AND "))
+	visits := []placeVisit{}
+	if err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			v := placeVisit{
+				Device:   stmt.ColumnText(0),
+				Arrived:  stmt.ColumnInt64(1),
+				Departed: stmt.ColumnInt64(2),
+			}
+			v.Dwell = v.Departed - v.Arrived
+			visits = append(visits, v)
+			return nil
+		},
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to query visits")
+	}
+	return visits, nil
+}
+
+type placeArea struct {
+	id     int64
+	p      Point
+	radius float64
+	named  bool
+}
+
+func placeAreas(conn *sqlite.Conn, userID int) ([]placeArea, error) {
+	var areas []placeArea
+	if err := sqlitex.Execute(conn, `
+		SELECT id, lat, lon, radius, name_source = 'user'
+		FROM places
+		WHERE user_id = ?1
+		ORDER BY id
+	`, &sqlitex.ExecOptions{
+		Args: []any{userID},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			areas = append(areas, placeArea{
+				id:     stmt.ColumnInt64(0),
+				p:      Point{stmt.ColumnFloat(1), stmt.ColumnFloat(2)},
+				radius: stmt.ColumnFloat(3),
+				named:  stmt.ColumnBool(4),
+			})
+			return nil
+		},
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to query places")
+	}
+	return areas, nil
+}
+
+// placeContaining returns the place p is in, the nearest one when places
+// overlap.
+func placeContaining(areas []placeArea, p Point) opt.Option[int64] {
+	found := opt.None[int64]()
+	best := math.Inf(1)
+	for _, a := range areas {
+		if d := a.p.DistanceTo(p); d <= a.radius && d < best {
+			found, best = opt.Some(a.id), d
+		}
+	}
+	return found
+}
+
+// placeAt returns the user's place that p is in.
+func placeAt(conn *sqlite.Conn, userID int, p Point) (opt.Option[int64], error) {
+	areas, err := placeAreas(conn, userID)
+	if err != nil {
+		return opt.None[int64](), err
+	}
+	return placeContaining(areas, p), nil
+}
+
+type placesResult struct {
+	User   string `json:"user"`
+	Places int    `json:"places"`
+	Visits int    `json:"visits"`
+}
+
+// refreshPlaces recomputes the visits of a user's places from the stays in
+// their location reports. Spots with placeMinVisits stays outside of any
+// place become new places, places that were found this way and no longer
+// have visits are removed unless reports still refer to them.
+//
+// The reports are scanned before anything is written, and only the places
+// and visits that changed are written, so the write lock is held briefly.
+func refreshPlaces(conn *sqlite.Conn, user string, now time.Time) (placesResult, error) {
+	res := placesResult{User: user}
+	var userID opt.Option[int]
+	if err := sqlitex.Execute(conn, "SELECT id FROM users WHERE user = ?1", &sqlitex.ExecOptions{
+		Args: []any{user},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			userID = opt.Some(stmt.ColumnInt(0))
+			return nil
+		},
+	}); err != nil {
+		return placesResult{}, errors.Wrap(err, "failed to look up user")
+	}
+	uid, ok := userID.MaybeUnwrap()
+	if !ok {
+		return res, nil
+	}
+
+	finder := stayFinder{minDur: placeStayMin}
+	if err := eachRenderPoint(conn, heatmapFilter{
+		user: user,
+		from: opt.None[int64](),
+		to:   opt.None[int64](),
+		bbox: opt.None[[4]float64](),
+	}, func(pt renderPoint) error {
+		finder.add(pt)
+		return nil
+	}); err != nil {
+		return placesResult{}, err
+	}
+	finder.flush()
+	areas, err := placeAreas(conn, uid)
+	if err != nil {
+		return placesResult{}, err
+	}
+	type visitKey struct {
+		placeID           int64
+		device            string
+		arrived, departed int64
+	}
+	existing := map[visitKey]int64{}
+	if err := sqlitex.Execute(conn, `
+		SELECT id, place_id, device, arrived, departed
+		FROM place_visits
+		WHERE place_id IN (SELECT id FROM places WHERE user_id = ?1)
+	`, &sqlitex.ExecOptions{
+		Args: []any{uid},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			existing[visitKey{stmt.ColumnInt64(1), stmt.ColumnText(2), stmt.ColumnInt64(3), stmt.ColumnInt64(4)}] = stmt.ColumnInt64(0)
+			return nil
+		},
+	}); err != nil {
+		return placesResult{}, errors.Wrap(err, "failed to query visits")
+	}
+
+	visits := map[int64][]stay{}
+	type cluster struct {
+		lat, lon float64
+		stays    []stay
+	}
+	var clusters []*cluster
+	for _, s := range finder.stays {
+		if id, ok := placeContaining(areas, s.p).MaybeUnwrap(); ok {
+			visits[id] = append(visits[id], s)
+			continue
+		}
+		var joined bool
+		for _, c := range clusters {
+			n := float64(len(c.stays))
+			if (Point{c.lat / n, c.lon / n}).DistanceTo(s.p) <= placeRadius {
+				c.lat += s.p.Lat()
+				c.lon += s.p.Lon()
+				c.stays = append(c.stays, s)
+				joined = true
+				break
+			}
+		}
+		if !joined {
+			clusters = append(clusters, &cluster{lat: s.p.Lat(), lon: s.p.Lon(), stays: []stay{s}})
+		}
+	}
+
+	err = func() (err error) {
+		defer sqlitex.Save(conn)(&err)
+
+		for _, c := range clusters {
+			if len(c.stays) < placeMinVisits {
+				continue
+			}
+			n := float64(len(c.stays))
+			var id int64
+			if err := sqlitex.Execute(conn, `
+				INSERT INTO places (user_id, lat, lon, radius, when_created)
+				VALUES (?1, ?2, ?3, ?4, ?5)
+				RETURNING id
+			`, &sqlitex.ExecOptions{
+				Args: []any{uid, c.lat / n, c.lon / n, placeRadius, now.Unix()},
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					id = stmt.ColumnInt64(0)
+					return nil
+				},
+			}); err != nil {
+				return errors.Wrap(err, "failed to insert place")
+			}
+			areas = append(areas, placeArea{id: id})
+			visits[id] = c.stays
+		}
+
+		for _, a := range areas {
+			if len(visits[a.id]) == 0 && !a.named {
+				// reports are tagged with the place they were sent from, a
+				// place they refer to is kept so the tags stay valid
+				if err := sqlitex.Execute(conn, `
+					DELETE FROM places
+					WHERE id = ?1
+						AND name_source != 'user'
+						AND NOT EXISTS (
+							SELECT 1 FROM location_reports
+							WHERE user_id = ?2 AND json_extract(data, '$.place_id') = ?1
+						)
+				`, &sqlitex.ExecOptions{
+					Args: []any{a.id, uid},
+				}); err != nil {
+					return errors.Wrap(err, "failed to delete place")
+				}
+				if conn.Changes() > 0 {
+					continue
+				}
+			}
+			res.Places++
+			for _, s := range visits[a.id] {
+				key := visitKey{a.id, s.device, s.arrived, s.departed}
+				if _, ok := existing[key]; ok {
+					delete(existing, key)
+					res.Visits++
+					continue
+				}
+				// the place may have been deleted, or the visit added by
+				// another refresh, since they were read
+				if err := sqlitex.Execute(conn, `
+					INSERT INTO place_visits (place_id, device, arrived, departed)
+					SELECT ?1, ?2, ?3, ?4
+					WHERE EXISTS (SELECT 1 FROM places WHERE id = ?1)
+						AND NOT EXISTS (
+							SELECT 1 FROM place_visits
+							WHERE place_id = ?1 AND device = ?2 AND arrived = ?3 AND departed = ?4
+						)
+				`, &sqlitex.ExecOptions{
+					Args: []any{a.id, s.device, s.arrived, s.departed},
+				}); err != nil {
+					return errors.Wrap(err, "failed to insert visit")
+				}
+				res.Visits++
+			}
+		}
+
+		// what is left are visits that are no longer stays, like those of
+		// reports removed by a retention policy
+		for _, id := range existing {
+			if err := sqlitex.Execute(conn, "DELETE FROM place_visits WHERE id = ?1", &sqlitex.ExecOptions{
+				Args: []any{id},
+			}); err != nil {
+				return errors.Wrap(err, "failed to delete visit")
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		return placesResult{}, err
+	}
+	return res, nil
+}
+
+type placeGeocoder struct {
+	cfg    configPlaces
+	client *http.Client
+}
+
+func newPlaceGeocoder(cfg configPlaces) *placeGeocoder {
+	client := cleanhttp.DefaultClient()
+	client.Timeout = 10 * time.Second
+	return &placeGeocoder{cfg: cfg, client: client}
+}
+
+// name looks up the name of the place at p, it is empty when the geocoder
+// has none.
+func (g *placeGeocoder) name(ctx context.Context, p Point) (string, error) {
+	url := strings.NewReplacer(
+		"{lat}", fmt.Sprintf("%f", p.Lat()),
+		"{lon}", fmt.Sprintf("%f", p.Lon()),
+	).Replace(g.cfg.GeocodeURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid geocode url")
+	}
+	req.Header.Set("User-Agent", g.cfg.UserAgent)
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to reverse geocode")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to reverse geocode: %s", resp.Status)
+	}
+	var body struct {
+		Name        string `json:"name"`
+		DisplayName string `json:"display_name"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", errors.Wrap(err, "invalid reverse geocode response")
+	}
+	if body.Name != "" {
+		return body.Name, nil
+	}
+	// the display name goes from the house number to the country, the first
+	// two parts after the house number are usually enough to recognize the
+	// place
+	var parts []string
+	for _, part := range strings.Split(body.DisplayName, ",") {
+		part = strings.TrimSpace(part)
+		if _, err := strconv.Atoi(part); err == nil || part == "" {
+			continue
+		}
+		if parts = append(parts, part); len(parts) == 2 {
+			break
+		}
+	}
+	return strings.Join(parts, ", "), nil
+}
+
+// geocodePlaces names the places without a name.
+func geocodePlaces(ctx context.Context, db *sqlitemigration.Pool, g *placeGeocoder) error {
+	type unnamed struct {
+		id int64
+		p  Point
+	}
+	var places []unnamed
+	conn, err := getConn(ctx, db)
+	if err != nil {
+		return errors.Wrap(err, "failed to get db conn")
+	}
+	err = sqlitex.Execute(conn, "SELECT id, lat, lon FROM places WHERE name_source = '' ORDER BY id", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			places = append(places, unnamed{stmt.ColumnInt64(0), Point{stmt.ColumnFloat(1), stmt.ColumnFloat(2)}})
+			return nil
+		},
+	})
+	db.Put(conn)
+	if err != nil {
+		return errors.Wrap(err, "failed to query unnamed places")
+	}
+
+	for i, pl := range places {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(geocodeInterval):
+			}
+		}
+		name, err := g.name(ctx, pl.p)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+		conn, err := getConn(ctx, db)
+		if err != nil {
+			return errors.Wrap(err, "failed to get db conn")
+		}
+		// the user may have named the place in the meantime
+		err = sqlitex.Execute(conn, `
+			UPDATE places SET name = ?2, name_source = 'geocoded'
+			WHERE id = ?1 AND name_source = ''
+		`, &sqlitex.ExecOptions{Args: []any{pl.id, name}})
+		db.Put(conn)
+		if err != nil {
+			return errors.Wrap(err, "failed to name place")
+		}
+	}
+	return nil
+}
+
+func startPlaces(cfg configPlaces, db *sqlitemigration.Pool) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	geocoder := newPlaceGeocoder(cfg)
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := runPlaces(ctx, db, geocoder); err != nil {
+				slog.Error("updating places failed", slog.String("err", err.Error()))
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func runPlaces(ctx context.Context, db *sqlitemigration.Pool, geocoder *placeGeocoder) error {
+	conn, err := getConn(ctx, db)
+	if err != nil {
+		return errors.Wrap(err, "failed to get db conn")
+	}
+	var users []string
+	err = sqlitex.Execute(conn, "SELECT user FROM users ORDER BY id", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			users = append(users, stmt.ColumnText(0))
+			return nil
+		},
+	})
+	if err != nil {
+		db.Put(conn)
+		return errors.Wrap(err, "failed to list users")
+	}
+	for _, user := range users {
+		res, err := refreshPlaces(conn, user, time.Now())
+		if err != nil {
+			db.Put(conn)
+			return err
+		}
+		slog.Info("places updated", slog.String("user", user), slog.Int("places", res.Places), slog.Int("visits", res.Visits))
+	}
+	db.Put(conn)
+
+	if geocoder.cfg.GeocodeURL == "" {
+		return nil
+	}
+	return geocodePlaces(ctx, db, geocoder)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestRefreshPlaces(t *testing.T) {
+	db := testDB(t, testConfig(t))
+	ctx := context.Background()
+	conn, err := db.Get(ctx)
+	if err != nil {
+		t.Fatalf("failed to get conn: %v", err)
+	}
+	defer db.Put(conn)
+	userID, err := getUserID(ctx, conn, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stay adds reports every 5 minutes for 20 minutes at lat,lon
+	stay := func(lat, lon float64, start int64) {
+		t.Helper()
+		for i := range int64(5) {
+			if err := sqlitex.Execute(conn, "INSERT INTO location_reports (user_id, device, data) VALUES (?1, 'phone', ?2)", &sqlitex.ExecOptions{
+				Args: []any{userID, fmt.Sprintf(`{"_type":"location","lat":%v,"lon":%v,"tst":%d}`, lat, lon, start+i*300)},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	refresh := func() placesResult {
+		t.Helper()
+		res, err := refreshPlaces(conn, "alice", time.Unix(1700100000, 0))
+		if err != nil {
+			t.Fatalf("failed to refresh: %v", err)
+		}
+		return res
+	}
+	query := func(q string) string {
+		t.Helper()
+		var rows []string
+		if err := sqlitex.Execute(conn, q, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				rows = append(rows, stmt.ColumnText(0))
+				return nil
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(rows, "\n")
+	}
+
+	const day = 24 * 60 * 60
+	stay(52.52, 13.405, 1700000000)
+	stay(52.5, 13.3, 1700003600)
+	stay(52.52, 13.405, 1700000000+day)
+	stay(52.5, 13.3, 1700003600+day)
+	if res := refresh(); res.Places != 2 || res.Visits != 4 {
+		t.Errorf("first refresh = %+v", res)
+	}
+	places := query("SELECT id || ' ' || round(lat, 2) || ',' || round(lon, 3) FROM places ORDER BY id")
+	visits := query("SELECT id || ' ' || place_id || ' ' || arrived FROM place_visits ORDER BY id")
+
+	// nothing changed, so nothing is rewritten
+	if res := refresh(); res.Places != 2 || res.Visits != 4 {
+		t.Errorf("second refresh = %+v", res)
+	}
+	if got := query("SELECT id || ' ' || round(lat, 2) || ',' || round(lon, 3) FROM places ORDER BY id"); got != places {
+		t.Errorf("places changed from\n%s\nto\n%s", places, got)
+	}
+	if got := query("SELECT id || ' ' || place_id || ' ' || arrived FROM place_visits ORDER BY id"); got != visits {
+		t.Errorf("visits changed from\n%s\nto\n%s", visits, got)
+	}
+
+	// a new visit is added to the place it is in
+	stay(52.52, 13.405, 1700000000+2*day)
+	if res := refresh(); res.Places != 2 || res.Visits != 5 {
+		t.Errorf("refresh after a visit = %+v", res)
+	}
+	if got := query("SELECT id || ' ' || place_id || ' ' || arrived FROM place_visits ORDER BY id LIMIT 4"); got != visits {
+		t.Errorf("visits changed from\n%s\nto\n%s", visits, got)
+	}
+
+	// places that lost their visits are removed, unless a report was tagged
+	// with them
+	var home, work int64
+	if err := sqlitex.Execute(conn, "SELECT id, lat > 52.51 FROM places", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			if stmt.ColumnBool(1) {
+				home = stmt.ColumnInt64(0)
+			} else {
+				work = stmt.ColumnInt64(0)
+			}
+			return nil
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.Execute(conn, "DELETE FROM location_reports", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.Execute(conn, "INSERT INTO location_reports (user_id, device, data) VALUES (?1, 'phone', ?2)", &sqlitex.ExecOptions{
+		Args: []any{userID, fmt.Sprintf(`{"_type":"location","lat":52.52,"lon":13.405,"tst":1700500000,"place_id":%d}`, home)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if res := refresh(); res.Places != 1 || res.Visits != 0 {
+		t.Errorf("refresh without stays = %+v", res)
+	}
+	if got, want := query("SELECT id FROM places"), fmt.Sprint(home); got != want {
+		t.Errorf("places = %s, want %s (work was %d)", got, want, work)
+	}
+	if got := query("SELECT COUNT(*) FROM place_visits"); got != "0" {
+		t.Errorf("%s visits were kept", got)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+
+	"code.nkcmr.net/opt"
+
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+type configPlausibility struct {
+	// MaxSpeed is the fastest a device is believed to move in km/h. Reports
+	// implying a faster movement since the device's previous report are
+	// outliers. 0 disables the filter.
+	MaxSpeed float64 `envDefault:"1200"`
+	// Quarantine stores outliers in the quarantined_reports table instead of
+	// storing them flagged with "outlier".
+	Quarantine bool
+}
+
+type plausibilityFix struct {
+	p       Point
+	tst     int64
+	acc     float64
+	outlier bool
+}
+
+// speedTo returns the speed in km/h implied by moving from f to o. The
+// accuracy of both fixes is given the benefit of the doubt.
+func (f plausibilityFix) speedTo(o plausibilityFix) float64 {
+	d := f.p.DistanceTo(o.p) - f.acc - o.acc
+	if d <= 0 {
+		return 0
+	}
+	dt := max(math.Abs(float64(o.tst-f.tst)), 1)
+	return d / dt * 3.6
+}
+
+func previousFix(conn *sqlite.Conn, userID int, device string, tst int64, skipOutliers bool) (opt.Option[plausibilityFix], error) {
+	query := `
+		SELECT
+			json_extract(data, '$.lat'),
+			json_extract(data, '$.lon'),
+			json_extract(data, '$.tst'),
+			COALESCE(json_extract(data, '$.acc'), 0),
+			json_extract(data, '$.outlier') IS NOT NULL
+		FROM location_reports
+		WHERE user_id = ?1
+			AND device = ?2
+			AND json_extract(data, '$.tst') < ?3
+			AND json_extract(data, '$.lat') IS NOT NULL
+	`
+	if skipOutliers {
+		query += ` AND json_extract(data, '$.outlier') IS NULL`
+	}
+	query += ` ORDER BY json_extract(data, '$.tst') DESC LIMIT 1`
+
+	fix := opt.None[plausibilityFix]()
+	if err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+		Args: []any{userID, device, tst},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			fix = opt.Some(plausibilityFix{
+				p:       Point{stmt.ColumnFloat(0), stmt.ColumnFloat(1)},
+				tst:     stmt.ColumnInt64(2),
+				acc:     stmt.ColumnFloat(3),
+				outlier: stmt.ColumnBool(4),
+			})
+			return nil
+		},
+	}); err != nil {
+		return opt.None[plausibilityFix](), errors.Wrap(err, "failed to query previous report")
+	}
+	return fix, nil
+}
+
+// isOutlier reports whether loc implies the device moved implausibly fast
+// since its previous report. A report following an outlier is plausible when
+// it is consistent with either the outlier, then the device really did move
+// that far, or with the last plausible report, then the outlier was a single
+// spike.
+func isOutlier(conn *sqlite.Conn, cfg configPlausibility, userID int, device string, loc otLocation) (bool, error) {
+	if cfg.MaxSpeed <= 0 {
+		return false, nil
+	}
+	p, ok := loc.LatLng().MaybeUnwrap()
+	if !ok {
+		return false, nil
+	}
+	tst, ok := readInt(loc, "tst").MaybeUnwrap()
+	if !ok {
+		return false, nil
+	}
+	fix := plausibilityFix{
+		p:   p,
+		tst: int64(tst),
+		acc: float64(loc.Accuracy().UnwrapOrZero()),
+	}
+
+	prev, err := previousFix(conn, userID, device, fix.tst, false)
+	if err != nil {
+		return false, err
+	}
+	last, ok := prev.MaybeUnwrap()
+	if !ok || last.speedTo(fix) <= cfg.MaxSpeed {
+		return false, nil
+	}
+	if !last.outlier {
+		return true, nil
+	}
+	prev, err = previousFix(conn, userID, device, fix.tst, true)
+	if err != nil {
+		return false, err
+	}
+	good, ok := prev.MaybeUnwrap()
+	return ok && good.speedTo(fix) > cfg.MaxSpeed, nil
+}
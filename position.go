@@ -0,0 +1,173 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"code.nkcmr.net/opt"
+
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Position is where a device was at a point in time, estimated from the
+// reports around it.
+type Position struct {
+	T   int64    `json:"t"`
+	Lat float64  `json:"lat"`
+	Lon float64  `json:"lon"`
+	Alt *float64 `json:"alt,omitempty"`
+	// Acc is the estimated accuracy of the position in meters.
+	Acc float64 `json:"acc"`
+	// Method is how the position was found: "exact" when there is a report
+	// at T, "stay" when the device did not move between the reports around
+	// T, "interpolated" when it did, and "nearest" when there are reports on
+	// only one side of T.
+	Method string `json:"method"`
+	// Gap is the time in seconds between the reports used, or between T and
+	// the report used for "nearest".
+	Gap int64 `json:"gap"`
+	// Confidence goes from 0 to 1, it drops with larger gaps and worse
+	// accuracy.
+	Confidence float64 `json:"confidence"`
+}
+
+const (
+	// positionStayRadius is how far apart two reports may be and still be
+	// considered the same stay.
+	positionStayRadius = 100
+	// the gaps after which the confidence of a position has dropped to 1/e,
+	// devices report rarely while stationary so stays decay slowest
+	positionStayDecay         = 6 * time.Hour
+	positionInterpolatedDecay = time.Hour
+	positionNearestDecay      = 15 * time.Minute
+)
+
+type positionFix struct {
+	p   Point
+	tst int64
+	acc float64
+	alt opt.Option[float64]
+}
+
+func positionFixAround(conn *sqlite.Conn, user, device string, t int64, before bool) (opt.Option[positionFix], error) {
+	query := `
+		SELECT
+			json_extract(lr.data, '$.lat'),
+			json_extract(lr.data, '$.lon'),
+			json_extract(lr.data, '$.tst'),
+			COALESCE(json_extract(lr.data, '$.acc'), 0),
+			json_extract(lr.data, '$.alt')
+		FROM location_reports AS lr
+		INNER JOIN users AS u ON lr.user_id = u.id
+		WHERE u.user = ?1
+			AND lr.device = ?2
+			AND json_extract(lr.data, '$.lat') IS NOT NULL
+			AND json_extract(lr.data, '$.outlier') IS NULL
+	`
+	if before {
+		query += ` AND json_extract(lr.data, '$.tst') <= ?3 ORDER BY json_extract(lr.data, '$.tst') DESC LIMIT 1`
+	} else {
+		query += ` AND json_extract(lr.data, '$.tst') >= ?3 ORDER BY json_extract(lr.data, '$.tst') ASC LIMIT 1`
+	}
+	fix := opt.None[positionFix]()
+	if err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+		Args: []any{user, device, t},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			f := positionFix{
+				p:   Point{stmt.ColumnFloat(0), stmt.ColumnFloat(1)},
+				tst: stmt.ColumnInt64(2),
+				acc: stmt.ColumnFloat(3),
+				alt: opt.None[float64](),
+			}
+			if stmt.ColumnType(4) != sqlite.TypeNull {
+				f.alt = opt.Some(stmt.ColumnFloat(4))
+			}
+			fix = opt.Some(f)
+			return nil
+		},
+	}); err != nil {
+		return opt.None[positionFix](), errors.Wrap(err, "failed to query reports")
+	}
+	return fix, nil
+}
+
+func positionConfidence(gap int64, decay time.Duration, acc float64) float64 {
+	c := math.Exp(-float64(gap)/decay.Seconds()) / (1 + acc/100)
+	return math.Round(c*100) / 100
+}
+
+func (f positionFix) position(t int64, method string, gap int64, decay time.Duration) Position {
+	pos := Position{
+		T:          t,
+		Lat:        f.p.Lat(),
+		Lon:        f.p.Lon(),
+		Acc:        f.acc,
+		Method:     method,
+		Gap:        gap,
+		Confidence: positionConfidence(gap, decay, f.acc),
+	}
+	if alt, ok := f.alt.MaybeUnwrap(); ok {
+		pos.Alt = &alt
+	}
+	return pos
+}
+
+// positionAt estimates where the device was at t. It returns none when the
+// device has no reports at all.
+func positionAt(conn *sqlite.Conn, user, device string, t time.Time) (opt.Option[Position], error) {
+	ts := t.Unix()
+	before, err := positionFixAround(conn, user, device, ts, true)
+	if err != nil {
+		return opt.None[Position](), err
+	}
+	after, err := positionFixAround(conn, user, device, ts, false)
+	if err != nil {
+		return opt.None[Position](), err
+	}
+
+	prev, hasPrev := before.MaybeUnwrap()
+	next, hasNext := after.MaybeUnwrap()
+	switch {
+	case !hasPrev && !hasNext:
+		return opt.None[Position](), nil
+	case !hasPrev:
+		return opt.Some(next.position(ts, "nearest", next.tst-ts, positionNearestDecay)), nil
+	case !hasNext:
+		return opt.Some(prev.position(ts, "nearest", ts-prev.tst, positionNearestDecay)), nil
+	case prev.tst == ts:
+		return opt.Some(prev.position(ts, "exact", 0, positionInterpolatedDecay)), nil
+	}
+
+	gap := next.tst - prev.tst
+	if prev.p.DistanceTo(next.p) <= max(positionStayRadius, prev.acc+next.acc) {
+		// the device stayed put, the more accurate report is the better guess
+		best := prev
+		if next.acc < prev.acc {
+			best = next
+		}
+		return opt.Some(best.position(ts, "stay", gap, positionStayDecay)), nil
+	}
+
+	f := float64(ts-prev.tst) / float64(gap)
+	lerp := func(a, b float64) float64 {
+		return a + (b-a)*f
+	}
+	pos := Position{
+		T:      ts,
+		Lat:    lerp(prev.p.Lat(), next.p.Lat()),
+		Lon:    lerp(prev.p.Lon(), next.p.Lon()),
+		Acc:    math.Round(lerp(prev.acc, next.acc)),
+		Method: "interpolated",
+		Gap:    gap,
+	}
+	if a, ok := prev.alt.MaybeUnwrap(); ok {
+		if b, ok := next.alt.MaybeUnwrap(); ok {
+			alt := math.Round(lerp(a, b))
+			pos.Alt = &alt
+		}
+	}
+	pos.Confidence = positionConfidence(gap, positionInterpolatedDecay, pos.Acc)
+	return opt.Some(pos), nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const (
+	// renderPadding keeps tracks this many pixels away from the edges of
+	// the image.
+	renderPadding = 24
+	renderMaxZoom = 17
+	// renderStayMin is how long a device has to stay within
+	// positionStayRadius for the place to get a stay marker.
+	renderStayMin = 15 * time.Minute
+	// renderLineWidth and renderMarkerRadius are in pixels.
+	renderLineWidth    = 4
+	renderMarkerRadius = 6
+)
+
+// renderBackground is the color maps without a tile server are drawn on.
+var renderBackground = color.NRGBA{242, 239, 233, 255}
+
+// renderColors are the colors the tracks of each device are drawn in.
+var renderColors = []color.NRGBA{
+	{37, 99, 235, 255},
+	{220, 38, 38, 255},
+	{22, 163, 74, 255},
+	{147, 51, 234, 255},
+	{234, 88, 12, 255},
+}
+
+type renderPoint struct {
+	device string
+	p      Point
+	tst    int64
+}
+
+// renderPoints returns the reports matching f ordered by device and time.
+func renderPoints(conn *sqlite.Conn, f heatmapFilter) ([]renderPoint, error) {
+	var points []renderPoint
+	if err := eachRenderPoint(conn, f, func(pt renderPoint) error {
+		points = append(points, pt)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// eachRenderPoint calls fn with each report matching f, ordered by device and
+// time, without holding them all in memory.
+func eachRenderPoint(conn *sqlite.Conn, f heatmapFilter, fn func(renderPoint) error) error {
+	where, args := f.where()
+	query := fmt.Sprintf(`
+		SELECT device, json_extract(data, '$.lat'), json_extract(data, '$.lon'), json_extract(data, '$.tst')
+		FROM location_reports
+		WHERE %s
+		ORDER BY device, json_extract(data, '$.tst')
+	`, where)
+	if err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			return fn(renderPoint{
+				device: stmt.ColumnText(0),
+				p:      Point{stmt.ColumnFloat(1), stmt.ColumnFloat(2)},
+				tst:    stmt.ColumnInt64(3),
+			})
+		},
+	}); err != nil {
+		return errors.Wrap(err, "failed to query reports")
+	}
+	return nil
+}
+
+// renderZoom returns the largest zoom at which all points fit in a w by h
+// image.
+func renderZoom(points []renderPoint, w, h int) int {
+	for z := renderMaxZoom; z > 0; z-- {
+		minX, minY := math.Inf(1), math.Inf(1)
+		maxX, maxY := math.Inf(-1), math.Inf(-1)
+		for _, pt := range points {
+			x, y := worldPixel(pt.p.Lat(), pt.p.Lon(), z)
+			minX, maxX = min(minX, x), max(maxX, x)
+			minY, maxY = min(minY, y), max(maxY, y)
+		}
+		if maxX-minX <= float64(w-2*renderPadding) && maxY-minY <= float64(h-2*renderPadding) {
+			return z
+		}
+	}
+	return 0
+}
+
+// mask holds the coverage of each pixel of a shape, so overlapping parts of
+// the shape are not painted twice.
+type mask struct {
+	w, h int
+	cov  []float32
+}
+
+func newMask(w, h int) *mask {
+	return &mask{w: w, h: h, cov: make([]float32, w*h)}
+}
+
+// stroke adds a line of the given width from a to b with round ends.
+func (m *mask) stroke(ax, ay, bx, by, width float64) {
+	r := width / 2
+	x0 := max(0, int(math.Floor(min(ax, bx)-r-1)))
+	x1 := min(m.w-1, int(math.Ceil(max(ax, bx)+r+1)))
+	y0 := max(0, int(math.Floor(min(ay, by)-r-1)))
+	y1 := min(m.h-1, int(math.Ceil(max(ay, by)+r+1)))
+	dx, dy := bx-ax, by-ay
+	l2 := dx*dx + dy*dy
+	for y := y0; y <= y1; y++ {
+		for x := x0; x <= x1; x++ {
+			px, py := float64(x)+0.5, float64(y)+0.5
+			f := 0.0
+			if l2 > 0 {
+				f = max(0, min(1, ((px-ax)*dx+(py-ay)*dy)/l2))
+			}
+			d := math.Hypot(px-(ax+f*dx), py-(ay+f*dy))
+			if c := float32(max(0, min(1, r+0.5-d))); c > m.cov[y*m.w+x] {
+				m.cov[y*m.w+x] = c
+			}
+		}
+	}
+}
+
+func (m *mask) paint(img *image.NRGBA, c color.NRGBA) {
+	for i, cov := range m.cov {
+		if cov == 0 {
+			continue
+		}
+		x, y := i%m.w, i/m.w
+		src := c
+		src.A = uint8(math.Round(float64(c.A) * float64(cov)))
+		img.SetNRGBA(x, y, blendNRGBA(img.NRGBAAt(x, y), src))
+	}
+}
+
+// drawTiles composites the tiles under the image whose top left corner is
+// at ox, oy in world pixels. Tiles that cannot be loaded are left blank.
+func drawTiles(ctx context.Context, tiles *tileServer, img *image.NRGBA, z int, ox, oy float64) {
+	n := 1 << z
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	tx0, tx1 := int(math.Floor(ox/tileSize)), int(math.Floor((ox+float64(w)-1)/tileSize))
+	ty0, ty1 := max(0, int(math.Floor(oy/tileSize))), min(n-1, int(math.Floor((oy+float64(h)-1)/tileSize)))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 4)
+	for ty := ty0; ty <= ty1; ty++ {
+		for tx := tx0; tx <= tx1; tx++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				// tiles repeat east and west of the antimeridian
+				t := tile{z: z, x: ((tx % n) + n) % n, y: ty}
+				timg, err := tiles.get(ctx, t)
+				if err != nil {
+					slog.WarnContext(ctx, "failed to load map tile", slog.String("tile", t.String()), slog.String("err", err.Error()))
+					return
+				}
+				at := image.Pt(int(math.Round(float64(tx*tileSize)-ox)), int(math.Round(float64(ty*tileSize)-oy)))
+				mu.Lock()
+				defer mu.Unlock()
+				draw.Draw(img, image.Rectangle{Min: at, Max: at.Add(image.Pt(tileSize, tileSize))}, timg, timg.Bounds().Min, draw.Src)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// renderTrack draws the tracks of points, which must not be empty, on a w
+// by h map fit to them.
+func renderTrack(ctx context.Context, tiles *tileServer, points []renderPoint, w, h int) *image.NRGBA {
+	z := renderZoom(points, w, h)
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, pt := range points {
+		x, y := worldPixel(pt.p.Lat(), pt.p.Lon(), z)
+		minX, maxX = min(minX, x), max(maxX, x)
+		minY, maxY = min(minY, y), max(maxY, y)
+	}
+	ox := math.Round((minX+maxX)/2 - float64(w)/2)
+	oy := math.Round((minY+maxY)/2 - float64(h)/2)
+	project := func(p Point) (float64, float64) {
+		x, y := worldPixel(p.Lat(), p.Lon(), z)
+		return x - ox, y - oy
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(renderBackground), image.Point{}, draw.Src)
+	if tiles.enabled() {
+		drawTiles(ctx, tiles, img, z, ox, oy)
+	}
+
+	halo := color.NRGBA{255, 255, 255, 200}
+	var stays []Point
+	for start, i, device := 0, 0, 0; start < len(points); start, device = i, device+1 {
+		for i < len(points) && points[i].device == points[start].device {
+			i++
+		}
+		track := points[start:i]
+		c := renderColors[device%len(renderColors)]
+
+		line, outline := newMask(w, h), newMask(w, h)
+		px, py := project(track[0].p)
+		line.stroke(px, py, px, py, renderLineWidth)
+		outline.stroke(px, py, px, py, renderLineWidth+3)
+		for _, pt := range track[1:] {
+			x, y := project(pt.p)
+			if math.Hypot(x-px, y-py) < 1 {
+				continue
+			}
+			line.stroke(px, py, x, y, renderLineWidth)
+			outline.stroke(px, py, x, y, renderLineWidth+3)
+			px, py = x, y
+		}
+		outline.paint(img, halo)
+		line.paint(img, c)
+		for _, s := range findStays(track, renderStayMin) {
+			stays = append(stays, s.p)
+		}
+	}
+
+	markers, borders := newMask(w, h), newMask(w, h)
+	for _, s := range stays {
+		x, y := project(s)
+		borders.stroke(x, y, x, y, 2*renderMarkerRadius+4)
+		markers.stroke(x, y, x, y, 2*renderMarkerRadius)
+	}
+	borders.paint(img, color.NRGBA{255, 255, 255, 255})
+	markers.paint(img, color.NRGBA{17, 24, 39, 255})
+	return img
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+type configRetention struct {
+	// Interval is how often retention policies are enforced, 0 disables
+	// enforcement.
+	Interval time.Duration `envDefault:"24h"`
+}
+
+// retentionPolicy limits how much history is kept for a user's device, or for
+// all devices of the user without a policy of their own when Device is empty.
+type retentionPolicy struct {
+	User   string `json:"user"`
+	Device string `json:"device"`
+
+	// DeleteAfterDays deletes reports older than this many days.
+	DeleteAfterDays *int `json:"delete_after_days,omitempty"`
+	// DownsampleAfterDays thins out reports older than this many days to one
+	// report per DownsampleIntervalSecs, keeping transitions and trip
+	// endpoints.
+	DownsampleAfterDays    *int `json:"downsample_after_days,omitempty"`
+	DownsampleIntervalSecs *int `json:"downsample_interval_secs,omitempty"`
+	// MaxAcc deletes reports with an accuracy worse than this many meters.
+	MaxAcc *int `json:"max_acc,omitempty"`
+}
+
+func (p retentionPolicy) validate() error {
+	if p.User == "" {
+		return badRequest("user is required")
+	}
+	for name, v := range map[string]*int{
+		"delete_after_days":        p.DeleteAfterDays,
+		"downsample_after_days":    p.DownsampleAfterDays,
+		"downsample_interval_secs": p.DownsampleIntervalSecs,
+		"max_acc":                  p.MaxAcc,
+	} {
+		if v != nil && *v <= 0 {
+			return badRequest("%s must be positive", name)
+		}
+	}
+	if (p.DownsampleAfterDays == nil) != (p.DownsampleIntervalSecs == nil) {
+		return badRequest("downsample_after_days and downsample_interval_secs must be set together")
+	}
+	return nil
+}
+
+func nullableInt(v *int) any {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+func columnNullableInt(stmt *sqlite.Stmt, col int) *int {
+	if stmt.ColumnType(col) == sqlite.TypeNull {
+		return nil
+	}
+	v := stmt.ColumnInt(col)
+	return &v
+}
+
+const retentionPolicyColumns = `user, device, delete_after_days, downsample_after_days, downsample_interval_secs, max_acc`
+
+func scanRetentionPolicy(stmt *sqlite.Stmt, col int) retentionPolicy {
+	return retentionPolicy{
+		User:                   stmt.ColumnText(col),
+		Device:                 stmt.ColumnText(col + 1),
+		DeleteAfterDays:        columnNullableInt(stmt, col+2),
+		DownsampleAfterDays:    columnNullableInt(stmt, col+3),
+		DownsampleIntervalSecs: columnNullableInt(stmt, col+4),
+		MaxAcc:                 columnNullableInt(stmt, col+5),
+	}
+}
+
+func listRetentionPolicies(conn *sqlite.Conn) ([]retentionPolicy, error) {
+	policies := []retentionPolicy{}
+	if err := sqlitex.Execute(conn, "SELECT "+retentionPolicyColumns+" FROM retention_policies ORDER BY user, device", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			policies = append(policies, scanRetentionPolicy(stmt, 0))
+			return nil
+		},
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to query retention policies")
+	}
+	return policies, nil
+}
+
+func saveRetentionPolicy(conn *sqlite.Conn, p retentionPolicy) error {
+	if err := sqlitex.Execute(conn, "INSERT OR REPLACE INTO retention_policies ("+retentionPolicyColumns+") VALUES (?, ?, ?, ?, ?, ?)", &sqlitex.ExecOptions{
+		Args: []any{
+			p.User,
+			p.Device,
+			nullableInt(p.DeleteAfterDays),
+			nullableInt(p.DownsampleAfterDays),
+			nullableInt(p.DownsampleIntervalSecs),
+			nullableInt(p.MaxAcc),
+		},
+	}); err != nil {
+		return errors.Wrap(err, "failed to save retention policy")
+	}
+	return nil
+}
+
+func deleteRetentionPolicy(conn *sqlite.Conn, user, device string) (bool, error) {
+	if err := sqlitex.Execute(conn, "DELETE FROM retention_policies WHERE user = ? AND device = ?", &sqlitex.ExecOptions{
+		Args: []any{user, device},
+	}); err != nil {
+		return false, errors.Wrap(err, "failed to delete retention policy")
+	}
+	return conn.Changes() > 0, nil
+}
+
+// retentionResult is what enforcing a policy removed, or would remove, from a
+// device's history.
+type retentionResult struct {
+	User   string          `json:"user"`
+	Device string          `json:"device"`
+	Policy retentionPolicy `json:"policy"`
+
+	Expired     int `json:"expired"`
+	Inaccurate  int `json:"inaccurate"`
+	Downsampled int `json:"downsampled"`
+}
+
+const (
+	// retentionStayRadius is how far a device may move between two reports
+	// and still be considered stationary.
+	retentionStayRadius = 100
+	// retentionTripGap is the time without reports after which the next
+	// report is considered the start of a new trip, owntracks barely reports
+	// while the device is stationary.
+	retentionTripGap = 30 * time.Minute
+)
+
+type retentionPoint struct {
+	id        int64
+	tst       int64
+	p         Point
+	trigger   string
+	inregions string
+}
+
+// downsample returns the ids of the points to drop so at most one point is
+// kept per interval. Transitions (region triggers or a change of regions)
+// and the endpoints of trips (where the device starts or stops moving) are
+// always kept, and do not take up the one point kept for their interval.
+func downsample(points []retentionPoint, interval int64) []int64 {
+	keep := func(i int) bool {
+		pt := points[i]
+		if pt.trigger == "c" || pt.trigger == "b" {
+			return true
+		}
+		if i == 0 || i == len(points)-1 {
+			return false
+		}
+		prev, next := points[i-1], points[i+1]
+		if pt.inregions != prev.inregions {
+			return true
+		}
+		gap := int64(retentionTripGap / time.Second)
+		if pt.tst-prev.tst >= gap || next.tst-pt.tst >= gap {
+			return true
+		}
+		movedIn := prev.p.DistanceTo(pt.p) >= retentionStayRadius
+		movedOut := pt.p.DistanceTo(next.p) >= retentionStayRadius
+		return movedIn != movedOut
+	}
+
+	var drop []int64
+	bucket := int64(-1)
+	for i, pt := range points {
+		if keep(i) {
+			continue
+		}
+		if b := pt.tst / interval; b != bucket {
+			bucket = b
+			continue
+		}
+		drop = append(drop, pt.id)
+	}
+	return drop
+}
+
+// The rules of a policy remove reports in order, each only from the reports
+// the rules before it left. These match the reports the delete_after_days
+// (?3 is the cutoff) and max_acc (?4) rules remove, ?3 and ?4 are NULL when
+// the policy has no such rule.
+const (
+	retentionExpired    = `IFNULL(?3 IS NOT NULL AND json_extract(data, '$.tst') < ?3, 0)`
+	retentionInaccurate = `IFNULL(?4 IS NOT NULL AND json_extract(data, '$.acc') > ?4 AND COALESCE(json_extract(data, '$.t'), '') NOT IN ('c', 'b'), 0)`
+)
+
+// removeReports deletes the reports matching where, or in dryRun mode only
+// counts them, and returns how many there are.
+func removeReports(conn *sqlite.Conn, dryRun bool, where string, args []any) (int, error) {
+	if !dryRun {
+		if err := sqlitex.Execute(conn, "DELETE FROM location_reports WHERE "+where, &sqlitex.ExecOptions{
+			Args: args,
+		}); err != nil {
+			return 0, err
+		}
+		return conn.Changes(), nil
+	}
+	var n int
+	if err := sqlitex.Execute(conn, "SELECT COUNT(*) FROM location_reports WHERE "+where, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			n = stmt.ColumnInt(0)
+			return nil
+		},
+	}); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// applyRetention enforces all retention policies. In dryRun mode nothing is
+// deleted, the results tell what would be, and only reads are made so the
+// report does not hold up writers.
+func applyRetention(ctx context.Context, conn *sqlite.Conn, now time.Time, dryRun bool) (_ []retentionResult, err error) {
+	if !dryRun {
+		var release func(*error)
+		if release, err = saveWrite(conn); err != nil {
+			return nil, err
+		}
+		defer release(&err)
+	}
+
+	type target struct {
+		userID int
+		result retentionResult
+	}
+	var targets []target
+	// a device uses its own policy, or the policy of its user otherwise
+	const targetsQuery = `
+		SELECT
+			d.user_id, u.user, d.device,
+			p.user, p.device, p.delete_after_days, p.downsample_after_days,
+			p.downsample_interval_secs, p.max_acc
+		FROM (SELECT DISTINCT user_id, device FROM location_reports) AS d
+		INNER JOIN users AS u ON u.id = d.user_id
+		INNER JOIN retention_policies AS p ON p.user = u.user AND p.device = (
+			SELECT MAX(device) FROM retention_policies
+			WHERE user = u.user AND device IN (d.device, '')
+		)
+		ORDER BY u.user, d.device
+	`
+	if err := sqlitex.Execute(conn, targetsQuery, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			targets = append(targets, target{
+				userID: stmt.ColumnInt(0),
+				result: retentionResult{
+					User:   stmt.ColumnText(1),
+					Device: stmt.ColumnText(2),
+					Policy: scanRetentionPolicy(stmt, 3),
+				},
+			})
+			return nil
+		},
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to query retention targets")
+	}
+
+	results := []retentionResult{}
+	for _, t := range targets {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		res := t.result
+		p := res.Policy
+		args := []any{t.userID, res.Device, nil, nil}
+		if p.DeleteAfterDays != nil {
+			args[2] = now.AddDate(0, 0, -*p.DeleteAfterDays).Unix()
+			n, err := removeReports(conn, dryRun, "user_id = ?1 AND device = ?2 AND "+retentionExpired, args[:3])
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to delete expired reports")
+			}
+			res.Expired = n
+		}
+		if p.MaxAcc != nil {
+			args[3] = *p.MaxAcc
+			n, err := removeReports(conn, dryRun, "user_id = ?1 AND device = ?2 AND "+retentionInaccurate+" AND NOT "+retentionExpired, args)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to delete inaccurate reports")
+			}
+			res.Inaccurate = n
+		}
+		if p.DownsampleAfterDays != nil && p.DownsampleIntervalSecs != nil {
+			cutoff := now.AddDate(0, 0, -*p.DownsampleAfterDays).Unix()
+			var points []retentionPoint
+			if err := sqlitex.Execute(conn, `
+				SELECT
+					id,
+					json_extract(data, '$.tst'),
+					json_extract(data, '$.lat'),
+					json_extract(data, '$.lon'),
+					COALESCE(json_extract(data, '$.t'), ''),
+					COALESCE(json_extract(data, '$.inregions'), '')
+				FROM location_reports
+				WHERE user_id = ?1 AND device = ?2 AND json_extract(data, '$.tst') < ?5
+					AND NOT `+retentionExpired+` AND NOT `+retentionInaccurate+`
+				ORDER BY json_extract(data, '$.tst'), id
+			`, &sqlitex.ExecOptions{
+				Args: append(args, cutoff),
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					points = append(points, retentionPoint{
+						id:        stmt.ColumnInt64(0),
+						tst:       stmt.ColumnInt64(1),
+						p:         Point{stmt.ColumnFloat(2), stmt.ColumnFloat(3)},
+						trigger:   stmt.ColumnText(4),
+						inregions: stmt.ColumnText(5),
+					})
+					return nil
+				},
+			}); err != nil {
+				return nil, errors.Wrap(err, "failed to query reports to downsample")
+			}
+			drop := downsample(points, int64(*p.DownsampleIntervalSecs))
+			if !dryRun {
+				for _, id := range drop {
+					if err := sqlitex.Execute(conn, "DELETE FROM location_reports WHERE id = ?", &sqlitex.ExecOptions{
+						Args: []any{id},
+					}); err != nil {
+						return nil, errors.Wrap(err, "failed to delete downsampled report")
+					}
+				}
+			}
+			res.Downsampled = len(drop)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// startRetention enforces the retention policies every interval until the
+// returned stop func is called.
+func startRetention(cfg configRetention, db *sqlitemigration.Pool) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := runRetention(ctx, db); err != nil {
+				slog.Error("retention enforcement failed", slog.String("err", err.Error()))
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func runRetention(ctx context.Context, db *sqlitemigration.Pool) error {
+	conn, err := getConn(ctx, db)
+	if err != nil {
+		return errors.Wrap(err, "failed to get db conn")
+	}
+	defer db.Put(conn)
+	results, err := applyRetention(ctx, conn, time.Now(), false)
+	if err != nil {
+		return err
+	}
+	for _, res := range results {
+		if removed := res.Expired + res.Inaccurate + res.Downsampled; removed > 0 {
+			slog.Info("retention enforced",
+				slog.String("user", res.User),
+				slog.String("device", res.Device),
+				slog.String("removed", fmt.Sprintf("%d expired, %d inaccurate, %d downsampled", res.Expired, res.Inaccurate, res.Downsampled)),
+			)
+		}
+	}
+	return nil
+}
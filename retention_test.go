@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestApplyRetentionDryRun(t *testing.T) {
+	db := testDB(t, testConfig(t))
+	ctx := context.Background()
+	conn, err := db.Get(ctx)
+	if err != nil {
+		t.Fatalf("failed to get conn: %v", err)
+	}
+	defer db.Put(conn)
+	userID, err := getUserID(ctx, conn, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a report every 5 minutes for 10 days, every 7th one inaccurate
+	const reports = 10 * 24 * 12
+	now := time.Unix(1700000000, 0)
+	for i := range reports {
+		acc := 10
+		if i%7 == 0 {
+			acc = 500
+		}
+		tst := now.Unix() - int64(i)*300
+		if err := sqlitex.Execute(conn, "INSERT INTO location_reports (user_id, device, data) VALUES (?1, 'phone', ?2)", &sqlitex.ExecOptions{
+			Args: []any{userID, fmt.Sprintf(`{"_type":"location","lat":52.52,"lon":%v,"tst":%d,"acc":%d}`, 13.4+float64(i%2)*0.01, tst, acc)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	days, downsampleDays, interval, maxAcc := 8, 2, 3600, 100
+	if err := saveRetentionPolicy(conn, retentionPolicy{
+		User:                   "alice",
+		DeleteAfterDays:        &days,
+		DownsampleAfterDays:    &downsampleDays,
+		DownsampleIntervalSecs: &interval,
+		MaxAcc:                 &maxAcc,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	dry, err := applyRetention(ctx, conn, now, true)
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	if got := testQuery(t, db, "SELECT COUNT(*) FROM location_reports"); got[0] != fmt.Sprint(reports) {
+		t.Errorf("dry run left %s reports", got[0])
+	}
+	applied, err := applyRetention(ctx, conn, now, false)
+	if err != nil {
+		t.Fatalf("retention failed: %v", err)
+	}
+	if len(dry) != 1 || len(applied) != 1 {
+		t.Fatalf("dry run reported %d results, retention %d", len(dry), len(applied))
+	}
+	res := applied[0]
+	if d := dry[0]; d.Expired != res.Expired || d.Inaccurate != res.Inaccurate || d.Downsampled != res.Downsampled {
+		t.Errorf("dry run reported %d expired, %d inaccurate, %d downsampled, retention removed %d, %d, %d",
+			d.Expired, d.Inaccurate, d.Downsampled, res.Expired, res.Inaccurate, res.Downsampled)
+	}
+	if res.Expired == 0 || res.Inaccurate == 0 || res.Downsampled == 0 {
+		t.Errorf("nothing removed by some rule: %+v", res)
+	}
+	remaining := reports - res.Expired - res.Inaccurate - res.Downsampled
+	if got := testQuery(t, db, "SELECT COUNT(*) FROM location_reports"); got[0] != fmt.Sprint(remaining) {
+		t.Errorf("%s reports are left, want %d", got[0], remaining)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// zone.tab from the tz database maps time zones to the country they are in.
+//
+//go:embed zone.tab
+var zoneTab []byte
+
+var zoneCountries = func() map[string]string {
+	m := map[string]string{}
+	s := bufio.NewScanner(bytes.NewReader(zoneTab))
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 {
+			continue
+		}
+		m[fields[2]] = fields[0]
+	}
+	return m
+}()
+
+type statsPeriod string
+
+const (
+	statsDay   statsPeriod = "day"
+	statsMonth statsPeriod = "month"
+)
+
+const (
+	// statsMaxGap is the longest time between two reports that is still
+	// counted as moving or stationary, longer gaps are unknown.
+	statsMaxGap = 30 * time.Minute
+	// statsMovingSpeed is the speed in km/h from which the device is
+	// considered moving.
+	statsMovingSpeed = 2
+	// statsMaxPeriods limits how many periods one request may cover.
+	statsMaxPeriods = 1000
+)
+
+// truncate returns the start of the period t is in. Periods are in UTC.
+func (p statsPeriod) truncate(t time.Time) time.Time {
+	t = t.UTC()
+	if p == statsMonth {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func (p statsPeriod) next(start time.Time) time.Time {
+	if p == statsMonth {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+func (p statsPeriod) format(start time.Time) string {
+	if p == statsMonth {
+		return start.Format("2006-01")
+	}
+	return start.Format("2006-01-02")
+}
+
+// bucket is the sql expression for the start of the period a report is in.
+func (p statsPeriod) bucket() string {
+	if p == statsMonth {
+		return `CAST(strftime('%s', json_extract(data, '$.tst'), 'unixepoch', 'start of month') AS INTEGER)`
+	}
+	return `(json_extract(data, '$.tst') - json_extract(data, '$.tst') % 86400)`
+}
+
+type periodStats struct {
+	Start   string `json:"start"`
+	Reports int    `json:"reports"`
+	// Distance is in meters.
+	Distance float64 `json:"distance"`
+	// Moving and Stationary are in seconds, time between reports further
+	// apart than statsMaxGap is in neither.
+	Moving     int64 `json:"moving"`
+	Stationary int64 `json:"stationary"`
+	// MaxSpeed is in km/h.
+	MaxSpeed  float64  `json:"max_speed"`
+	Cells     int      `json:"cells"`
+	Countries []string `json:"countries"`
+	TimeZones []string `json:"time_zones"`
+}
+
+// statsFingerprint identifies the reports of a period, cached stats are
+// stale when reports were added to or removed from their period since.
+type statsFingerprint struct {
+	reports int
+	maxID   int64
+}
+
+func statsDeviceCond(device string) string {
+	if device == "" {
+		return ""
+	}
+	return "AND device = ?2"
+}
+
+func statsFingerprints(conn *sqlite.Conn, user, device string, period statsPeriod, from, to time.Time) (map[int64]statsFingerprint, error) {
+	query := fmt.Sprintf(`
+		SELECT %s AS start, COUNT(*), MAX(id)
+		FROM location_reports
+		WHERE user_id = (SELECT id FROM users WHERE user = ?1)
+			%s
+			AND json_extract(data, '$.tst') >= ?3
+			AND json_extract(data, '$.tst') < ?4
+		GROUP BY start
+	`, period.bucket(), statsDeviceCond(device))
+	out := map[int64]statsFingerprint{}
+	if err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+		Args: []any{user, device, from.Unix(), to.Unix()},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			out[stmt.ColumnInt64(0)] = statsFingerprint{
+				reports: stmt.ColumnInt(1),
+				maxID:   stmt.ColumnInt64(2),
+			}
+			return nil
+		},
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to count reports")
+	}
+	return out, nil
+}
+
+type cachedStats struct {
+	fp    statsFingerprint
+	stats periodStats
+}
+
+func loadCachedStats(conn *sqlite.Conn, user, device string, period statsPeriod, from, to time.Time) (map[int64]cachedStats, error) {
+	const query = `
+		SELECT start, reports, max_id, data
+		FROM stats_cache
+		WHERE user = ?1 AND device = ?2 AND period = ?3 AND start >= ?4 AND start < ?5
+	`
+	out := map[int64]cachedStats{}
+	if err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+		Args: []any{user, device, string(period), from.Unix(), to.Unix()},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			var c cachedStats
+			c.fp = statsFingerprint{reports: stmt.ColumnInt(1), maxID: stmt.ColumnInt64(2)}
+			if err := json.Unmarshal([]byte(stmt.ColumnText(3)), &c.stats); err != nil {
+				// an unreadable entry is recomputed
+				return nil
+			}
+			out[stmt.ColumnInt64(0)] = c
+			return nil
+		},
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to query stats cache")
+	}
+	return out, nil
+}
+
+func saveCachedStats(conn *sqlite.Conn, user, device string, period statsPeriod, start int64, c cachedStats) error {
+	data, err := json.Marshal(c.stats)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	const query = `
+		INSERT OR REPLACE INTO stats_cache (user, device, period, start, reports, max_id, data)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7)
+	`
+	if err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+		Args: []any{user, device, string(period), start, c.fp.reports, c.fp.maxID, string(data)},
+	}); err != nil {
+		return errors.Wrap(err, "failed to cache stats")
+	}
+	return nil
+}
+
+// computeStats computes the stats of the reports between from and to, for
+// all of the user's devices when device is empty. Outliers are left out.
+func computeStats(conn *sqlite.Conn, user, device string, from, to time.Time) (periodStats, error) {
+	query := fmt.Sprintf(`
+		SELECT
+			device,
+			json_extract(data, '$.lat'),
+			json_extract(data, '$.lon'),
+			json_extract(data, '$.tst'),
+			COALESCE(json_extract(data, '$.acc'), 0),
+			COALESCE(json_extract(data, '$.vel'), 0),
+			COALESCE(json_extract(data, '$.ghash'), ''),
+			COALESCE(json_extract(data, '$.tzname'), '')
+		FROM location_reports
+		WHERE user_id = (SELECT id FROM users WHERE user = ?1)
+			%s
+			AND json_extract(data, '$.tst') >= ?3
+			AND json_extract(data, '$.tst') < ?4
+			AND json_extract(data, '$.lat') IS NOT NULL
+			AND json_extract(data, '$.outlier') IS NULL
+		ORDER BY device, json_extract(data, '$.tst')
+	`, statsDeviceCond(device))
+
+	var s periodStats
+	cells := map[string]struct{}{}
+	countries := map[string]struct{}{}
+	zones := map[string]struct{}{}
+	var prev plausibilityFix
+	prevDevice := ""
+	first := true
+	maxGap := int64(statsMaxGap / time.Second)
+	if err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+		Args: []any{user, device, from.Unix(), to.Unix()},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			fix := plausibilityFix{
+				p:   Point{stmt.ColumnFloat(1), stmt.ColumnFloat(2)},
+				tst: stmt.ColumnInt64(3),
+				acc: stmt.ColumnFloat(4),
+			}
+			s.MaxSpeed = max(s.MaxSpeed, stmt.ColumnFloat(5))
+			if gh := stmt.ColumnText(6); gh != "" {
+				cells[gh] = struct{}{}
+			}
+			if zone := stmt.ColumnText(7); zone != "" {
+				zones[zone] = struct{}{}
+				if cc, ok := zoneCountries[zone]; ok {
+					countries[cc] = struct{}{}
+				}
+			}
+
+			dev := stmt.ColumnText(0)
+			if !first && dev == prevDevice {
+				s.Distance += prev.p.DistanceTo(fix.p)
+				if dt := fix.tst - prev.tst; dt <= maxGap {
+					speed := prev.speedTo(fix)
+					s.MaxSpeed = max(s.MaxSpeed, speed)
+					if speed >= statsMovingSpeed {
+						s.Moving += dt
+					} else {
+						s.Stationary += dt
+					}
+				}
+			}
+			first = false
+			prev, prevDevice = fix, dev
+			return nil
+		},
+	}); err != nil {
+		return periodStats{}, errors.Wrap(err, "failed to query reports")
+	}
+
+	s.Distance = math.Round(s.Distance)
+	s.MaxSpeed = math.Round(s.MaxSpeed*10) / 10
+	s.Cells = len(cells)
+	s.Countries = sortedKeys(countries)
+	s.TimeZones = sortedKeys(zones)
+	return s, nil
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// statsFor returns the stats of each period between from and to that has
+// reports. Stats of completed periods are cached.
+func statsFor(conn *sqlite.Conn, user, device string, period statsPeriod, from, to, now time.Time) (_ []periodStats, err error) {
+	release := sqlitex.Save(conn)
+	defer release(&err)
+
+	fps, err := statsFingerprints(conn, user, device, period, from, to)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := loadCachedStats(conn, user, device, period, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []periodStats{}
+	for start := from; start.Before(to); start = period.next(start) {
+		fp, ok := fps[start.Unix()]
+		if !ok {
+			continue
+		}
+		if c, ok := cache[start.Unix()]; ok && c.fp == fp {
+			out = append(out, c.stats)
+			continue
+		}
+		end := period.next(start)
+		s, err := computeStats(conn, user, device, start, end)
+		if err != nil {
+			return nil, err
+		}
+		s.Start = period.format(start)
+		s.Reports = fp.reports
+		if !end.After(now) {
+			if err := saveCachedStats(conn, user, device, period, start.Unix(), cachedStats{fp: fp, stats: s}); err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
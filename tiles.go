@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// tileSize is the width and height of slippy map tiles in pixels.
+const tileSize = 256
+
+// mercatorMaxLat is the latitude where web mercator maps end.
+const mercatorMaxLat = 85.05112878
+
+const maxTileZoom = 22
+
+type tile struct {
+	z, x, y int
+}
+
+func (t tile) String() string {
+	return fmt.Sprintf("%d/%d/%d", t.z, t.x, t.y)
+}
+
+func (t tile) valid() bool {
+	if t.z < 0 || t.z > maxTileZoom {
+		return false
+	}
+	n := 1 << t.z
+	return t.x >= 0 && t.x < n && t.y >= 0 && t.y < n
+}
+
+// worldPixel returns the position of a point in pixels on the whole web
+// mercator map at zoom z.
+func worldPixel(lat, lon float64, z int) (float64, float64) {
+	n := float64(int(tileSize) << z)
+	lat = max(-mercatorMaxLat, min(mercatorMaxLat, lat))
+	rad := lat * math.Pi / 180
+	x := (lon + 180) / 360 * n
+	y := (1 - math.Log(math.Tan(rad)+1/math.Cos(rad))/math.Pi) / 2 * n
+	return x, y
+}
+
+// worldPixelLatLon is the inverse of worldPixel.
+func worldPixelLatLon(x, y float64, z int) (float64, float64) {
+	n := float64(int(tileSize) << z)
+	lon := x/n*360 - 180
+	lat := math.Atan(math.Sinh(math.Pi*(1-2*y/n))) * 180 / math.Pi
+	return lat, lon
+}
+
+func tileAt(lat, lon float64, z int) tile {
+	x, y := worldPixel(lat, lon, z)
+	last := (1 << z) - 1
+	return tile{
+		z: z,
+		x: max(0, min(last, int(x)/tileSize)),
+		y: max(0, min(last, int(y)/tileSize)),
+	}
+}
+
+// bounds returns the corners of the tile grown by margin pixels on each
+// side.
+func (t tile) bounds(margin float64) (minLat, minLon, maxLat, maxLon float64) {
+	x0 := float64(t.x*tileSize) - margin
+	y0 := float64(t.y*tileSize) - margin
+	maxLat, minLon = worldPixelLatLon(x0, y0, t.z)
+	minLat, maxLon = worldPixelLatLon(x0+tileSize+2*margin, y0+tileSize+2*margin, t.z)
+	return minLat, minLon, maxLat, maxLon
+}
+
+func (t tile) center() (float64, float64) {
+	return worldPixelLatLon(float64(t.x*tileSize+tileSize/2), float64(t.y*tileSize+tileSize/2), t.z)
+}
+
+const (
+	// heatRadius is the radius in pixels a point spreads its heat over.
+	heatRadius = 8
+	// heatScale is the density at which a pixel is 63% of the way to the
+	// hottest color. The scale is the same for every tile, so neighbouring
+	// tiles match up.
+	heatScale = 4
+)
+
+// heatGradient is the colors heat goes through from cold to hot.
+var heatGradient = []color.NRGBA{
+	{0, 0, 255, 0},
+	{0, 0, 255, 160},
+	{0, 255, 255, 190},
+	{0, 255, 0, 210},
+	{255, 255, 0, 230},
+	{255, 0, 0, 250},
+}
+
+func heatColor(v float64) color.NRGBA {
+	v = max(0, min(1, v)) * float64(len(heatGradient)-1)
+	i := min(int(v), len(heatGradient)-2)
+	f := v - float64(i)
+	a, b := heatGradient[i], heatGradient[i+1]
+	lerp := func(x, y uint8) uint8 {
+		return uint8(math.Round(float64(x) + (float64(y)-float64(x))*f))
+	}
+	return color.NRGBA{lerp(a.R, b.R), lerp(a.G, b.G), lerp(a.B, b.B), lerp(a.A, b.A)}
+}
+
+// heatLayer collects points and renders them as a heatmap onto a tile.
+type heatLayer struct {
+	t tile
+	// counts has the number of points per pixel of the tile including a
+	// margin of heatRadius on each side, so points just outside the tile
+	// warm its edges
+	counts []float64
+}
+
+const heatLayerSize = tileSize + 2*heatRadius
+
+func newHeatLayer(t tile) *heatLayer {
+	return &heatLayer{t: t, counts: make([]float64, heatLayerSize*heatLayerSize)}
+}
+
+func (h *heatLayer) add(lat, lon float64) {
+	x, y := worldPixel(lat, lon, h.t.z)
+	px := int(math.Floor(x)) - h.t.x*tileSize + heatRadius
+	py := int(math.Floor(y)) - h.t.y*tileSize + heatRadius
+	if px < 0 || py < 0 || px >= heatLayerSize || py >= heatLayerSize {
+		return
+	}
+	h.counts[py*heatLayerSize+px]++
+}
+
+// draw paints the heatmap over img, which must be tileSize square.
+func (h *heatLayer) draw(img *image.NRGBA) {
+	var kernel [2*heatRadius + 1][2*heatRadius + 1]float64
+	for dy := -heatRadius; dy <= heatRadius; dy++ {
+		for dx := -heatRadius; dx <= heatRadius; dx++ {
+			d := math.Sqrt(float64(dx*dx + dy*dy))
+			if d <= heatRadius {
+				kernel[dy+heatRadius][dx+heatRadius] = 1 - d/heatRadius
+			}
+		}
+	}
+	heat := make([]float64, tileSize*tileSize)
+	for cy := range heatLayerSize {
+		for cx := range heatLayerSize {
+			n := h.counts[cy*heatLayerSize+cx]
+			if n == 0 {
+				continue
+			}
+			for ky := range kernel {
+				y := cy + ky - 2*heatRadius
+				if y < 0 || y >= tileSize {
+					continue
+				}
+				for kx, k := range kernel[ky] {
+					x := cx + kx - 2*heatRadius
+					if x < 0 || x >= tileSize || k == 0 {
+						continue
+					}
+					heat[y*tileSize+x] += n * k
+				}
+			}
+		}
+	}
+	for i, v := range heat {
+		if v == 0 {
+			continue
+		}
+		c := heatColor(1 - math.Exp(-v/heatScale))
+		x, y := i%tileSize, i/tileSize
+		img.SetNRGBA(x, y, blendNRGBA(img.NRGBAAt(x, y), c))
+	}
+}
+
+// blendNRGBA draws src over dst.
+func blendNRGBA(dst, src color.NRGBA) color.NRGBA {
+	sa := float64(src.A) / 255
+	da := float64(dst.A) / 255
+	a := sa + da*(1-sa)
+	if a == 0 {
+		return color.NRGBA{}
+	}
+	mix := func(s, d uint8) uint8 {
+		return uint8(math.Round((float64(s)*sa + float64(d)*da*(1-sa)) / a))
+	}
+	return color.NRGBA{mix(src.R, dst.R), mix(src.G, dst.G), mix(src.B, dst.B), uint8(math.Round(a * 255))}
+}
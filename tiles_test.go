@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestTileValid(t *testing.T) {
+	for _, tc := range []struct {
+		t    tile
+		want bool
+	}{
+		{tile{0, 0, 0}, true},
+		{tile{2, 3, 3}, true},
+		{tile{2, 4, 0}, false},
+		{tile{2, 0, -1}, false},
+		{tile{-1, 0, 0}, false},
+		{tile{maxTileZoom + 1, 0, 0}, false},
+		{tile{64, 0, 0}, false},
+	} {
+		if got := tc.t.valid(); got != tc.want {
+			t.Errorf("%s valid() = %v, want %v", tc.t, got, tc.want)
+		}
+	}
+}
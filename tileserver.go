@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/pkg/errors"
+)
+
+type configTiles struct {
+	// URL is the raster tile server to draw maps on, e.g.
+	// https://tile.openstreetmap.org/{z}/{x}/{y}.png. Maps have a plain
+	// background when it is empty. Mind the usage policy of the tile server,
+	// most require attribution wherever their tiles are shown.
+	URL string
+	// CacheDir keeps downloaded tiles, tiles are downloaded for every render
+	// when it is empty.
+	CacheDir string
+	// CacheMaxAge is how long a cached tile is used before it is downloaded
+	// again.
+	CacheMaxAge time.Duration `envDefault:"720h"`
+	UserAgent   string        `envDefault:"gotracks"`
+}
+
+type tileServer struct {
+	cfg    configTiles
+	client *http.Client
+}
+
+func newTileServer(cfg configTiles) *tileServer {
+	client := cleanhttp.DefaultPooledClient()
+	client.Timeout = 10 * time.Second
+	return &tileServer{cfg: cfg, client: client}
+}
+
+func (s *tileServer) enabled() bool {
+	return s.cfg.URL != ""
+}
+
+func (s *tileServer) url(t tile) string {
+	return strings.NewReplacer(
+		"{z}", strconv.Itoa(t.z),
+		"{x}", strconv.Itoa(t.x),
+		"{y}", strconv.Itoa(t.y),
+	).Replace(s.cfg.URL)
+}
+
+// cachePath returns where a tile is cached, tiles of different servers are
+// kept apart.
+func (s *tileServer) cachePath(t tile) string {
+	sum := sha256.Sum256([]byte(s.cfg.URL))
+	return filepath.Join(s.cfg.CacheDir, hex.EncodeToString(sum[:6]), strconv.Itoa(t.z), strconv.Itoa(t.x), strconv.Itoa(t.y))
+}
+
+func (s *tileServer) cached(t tile) ([]byte, bool) {
+	if s.cfg.CacheDir == "" {
+		return nil, false
+	}
+	name := s.cachePath(t)
+	fi, err := os.Stat(name)
+	if err != nil || time.Since(fi.ModTime()) > s.cfg.CacheMaxAge {
+		return nil, false
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+func (s *tileServer) store(t tile, data []byte) error {
+	name := s.cachePath(t)
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return errors.WithStack(err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tile-*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.WithStack(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp.Name(), name))
+}
+
+func (s *tileServer) fetch(ctx context.Context, t tile) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url(t), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid tile url")
+	}
+	req.Header.Set("User-Agent", s.cfg.UserAgent)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch tile")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch tile %s: %s", t, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read tile")
+	}
+	return data, nil
+}
+
+// get returns the image of a tile from the cache, or from the tile server
+// when it is not cached.
+func (s *tileServer) get(ctx context.Context, t tile) (image.Image, error) {
+	data, ok := s.cached(t)
+	if !ok {
+		var err error
+		if data, err = s.fetch(ctx, t); err != nil {
+			return nil, err
+		}
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode tile %s", t)
+	}
+	if !ok && s.cfg.CacheDir != "" {
+		if err := s.store(t, data); err != nil {
+			slog.WarnContext(ctx, "failed to cache tile", slog.String("tile", t.String()), slog.String("err", err.Error()))
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+type configTracing struct {
+	// Endpoint is the url of an OTLP/HTTP collector, e.g.
+	// "http://localhost:4318", tracing is disabled when it is empty.
+	Endpoint    string
+	ServiceName string `envDefault:"gotracks"`
+	// SampleRatio is the share of traces that are recorded, traces started
+	// by a sampled parent are always recorded.
+	SampleRatio float64 `envDefault:"1"`
+}
+
+// tracer is used for all spans, it does nothing until a tracer provider is
+// set up by startTracing.
+var tracer = otel.Tracer("code.nkcmr.net/gotracks")
+
+// startTracing exports spans to the configured collector, the returned func
+// flushes the spans that are still buffered.
+func startTracing(cfg configTracing) (func(), error) {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create otlp exporter")
+	}
+	tp := newTracerProvider(cfg, exporter)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = tp.Shutdown(ctx)
+	}, nil
+}
+
+// newTracerProvider batches spans to exporter, any exporter can be used, like
+// an in-memory one in tests.
+func newTracerProvider(cfg configTracing, exporter sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(cfg.ServiceName),
+		)),
+	)
+}
+
+// endSpan records err on the span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedExecute is sqlitex.Execute in a span of its own, name is a short
+// description of what the query does.
+func tracedExecute(ctx context.Context, conn *sqlite.Conn, name, query string, opts *sqlitex.ExecOptions) (err error) {
+	_, span := tracer.Start(ctx, "sql "+name, trace.WithAttributes(
+		semconv.DBSystemSqlite,
+		attribute.String("db.statement", query),
+	))
+	defer func() { endSpan(span, err) }()
+	return sqlitex.Execute(conn, query, opts)
+}
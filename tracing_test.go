@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"code.nkcmr.net/gotracks/internal/basicauth"
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testTracing installs a global tracer provider that records spans in memory.
+// It is installed once, as the package's tracers only ever delegate to the
+// first global provider.
+var testTracing = sync.OnceValues(func() (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := newTracerProvider(configTracing{ServiceName: "gotracks", SampleRatio: 1}, exporter)
+	otel.SetTracerProvider(tp)
+	return tp, exporter
+})
+
+func TestPubTracing(t *testing.T) {
+	tp, exporter := testTracing()
+	exporter.Reset()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+
+	cfg := testConfig(t)
+	db := testDB(t, cfg)
+	hash, err := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	liveLoc := newLiveLocations()
+	r := chi.NewRouter()
+	r.Use(basicauth.Middleware("gotracks", basicauth.InMemoryCredStore{"alice": string(hash)}))
+	PubEndpoint(r, cfg, liveLoc, db)
+	// a cmd in the outbox makes the publish read and update it
+	addOutboxCmd(t, db, "alice", "phone", map[string]any{"_type": "cmd", "action": "reportLocation"})
+
+	const callerTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("POST", "/pub", strings.NewReader(`{"_type":"location","lat":52.52,"lon":13.405,"tst":1700000000}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Limit-U", "alice")
+	req.Header.Set("X-Limit-D", "phone")
+	req.Header.Set("Traceparent", "00-"+callerTrace+"-00f067aa0ba902b7-01")
+	req.SetBasicAuth("alice", "pw")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	// the broadcast happens in the background
+	liveLoc.close(context.Background())
+	if err := tp.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	byID := map[trace.SpanID]tracetest.SpanStub{}
+	for _, s := range spans {
+		byID[s.SpanContext.SpanID()] = s
+	}
+	// parents maps each span name to its parent's name
+	parents := map[string]string{}
+	var server tracetest.SpanStub
+	for _, s := range spans {
+		if s.SpanContext.TraceID().String() != callerTrace {
+			t.Errorf("span %q is not part of the caller's trace", s.Name)
+		}
+		parent, ok := byID[s.Parent.SpanID()]
+		if !ok {
+			server = s
+			continue
+		}
+		if prev, ok := parents[s.Name]; ok && prev != parent.Name {
+			t.Errorf("span %q has parents %q and %q", s.Name, prev, parent.Name)
+		}
+		parents[s.Name] = parent.Name
+		if strings.HasPrefix(s.Name, "sql ") {
+			var stmt bool
+			for _, a := range s.Attributes {
+				stmt = stmt || a.Key == "db.statement" && a.Value.AsString() != ""
+			}
+			if !stmt {
+				t.Errorf("span %q has no db.statement", s.Name)
+			}
+		}
+	}
+	if server.Name != "POST /pub" || server.SpanKind != trace.SpanKindServer {
+		t.Fatalf("root span is %q of kind %v", server.Name, server.SpanKind)
+	}
+	for name, parent := range map[string]string{
+		"enrich location":                  "POST /pub",
+		"enrich geohash":                   "enrich location",
+		"enrich timezone":                  "enrich location",
+		"enrich load location":             "enrich location",
+		"db pool get":                      "POST /pub",
+		"sql user id":                      "POST /pub",
+		"sql insert user":                  "POST /pub",
+		"sql report order":                 "POST /pub",
+		"plausibility check":               "POST /pub",
+		"place lookup":                     "POST /pub",
+		"sql insert report":                "POST /pub",
+		"sql outbox consumer index":        "POST /pub",
+		"sql outbox items":                 "POST /pub",
+		"sql outbox update consumer index": "POST /pub",
+		"broadcast location":               "POST /pub",
+	} {
+		if got, ok := parents[name]; !ok {
+			t.Errorf("no %q span", name)
+		} else if got != parent {
+			t.Errorf("span %q is a child of %q, want %q", name, got, parent)
+		}
+		delete(parents, name)
+	}
+	for name, parent := range parents {
+		t.Errorf("unexpected span %q, child of %q", name, parent)
+	}
+}